@@ -6,5 +6,57 @@ type Config struct {
 	RootCA     string `env:"ROOT_CA"`
 	ClientCert string `env:"CLIENT_CERT"`
 	ClientKey  string `env:"CLIENT_KEY"`
-	RemoteUrl  string `env:"REMOTE_URL"`
+	// comma separated tunnel servers, tried in the order of UPSTREAM_POLICY. wss://host/path runs the tunnel inside
+	// a WebSocket upgrade to path, for networks that only let HTTPS through.
+	RemoteUrl string `env:"REMOTE_URL"`
+	// priority, round-robin or rtt
+	UpstreamPolicy string `env:"UPSTREAM_POLICY" default:"priority"`
+	// seconds between health checks of the tunnel servers, 0 disables them
+	HealthCheckInterval int `env:"HEALTH_CHECK_INTERVAL" default:"30"`
+	// number of multiplexed connections kept open to REMOTE_URL
+	TunnelPoolSize int `env:"TUNNEL_POOL_SIZE" default:"2"`
+	// codecs offered to the server in order of preference: brotli, zstd, identity, or adaptive-brotli / adaptive-zstd.
+	// The first one compresses upstream traffic.
+	TunnelCodecs string `env:"TUNNEL_CODECS" default:"brotli"`
+	// JSON file of rules routing destinations direct, through the tunnel, or blocking them. Everything is tunnelled if not set.
+	RouteFile string `env:"ROUTE_FILE"`
+	// limits of request headers from clients, answered with 431 when exceeded
+	MaxHeaderBytes int `env:"MAX_HEADER_BYTES" default:"65536"`
+	MaxHeaders     int `env:"MAX_HEADERS" default:"100"`
+	// SOCKS5 listener is disabled unless set. Username / password authentication is required if SOCKS_USER is set.
+	SocksListenAddr string `env:"SOCKS_LISTEN_ADDR"`
+	SocksUser       string `env:"SOCKS_USER"`
+	SocksPassword   string `env:"SOCKS_PASSWORD"`
+	// listener for TCP connections intercepted by the firewall, disabled unless set. Linux only.
+	TransparentListenAddr string `env:"TRANSPARENT_LISTEN_ADDR"`
+	// redirect for iptables REDIRECT, tproxy for TPROXY, which also needs the capability CAP_NET_ADMIN
+	TransparentMode string `env:"TRANSPARENT_MODE" default:"redirect"`
+	// CA minting certificates to intercept the HTTPS of MITM_HOSTS, which clients must trust. Disabled unless set.
+	MitmCaCert string `env:"MITM_CA_CERT"`
+	MitmCaKey  string `env:"MITM_CA_KEY"`
+	// comma separated domains, including their subdomains, whose CONNECTs through the tunnel are intercepted,
+	// so the plaintext compresses, e.g. example.com,example.org
+	MitmHosts string `env:"MITM_HOSTS"`
+	// bytes of responses to plain http and intercepted requests kept in memory, so repeated fetches do not cross
+	// the tunnel. 0 disables the cache.
+	HttpCacheBytes int64 `env:"HTTP_CACHE_BYTES" default:"33554432"`
+	// largest response body kept
+	HttpCacheMaxEntryBytes int64 `env:"HTTP_CACHE_MAX_ENTRY_BYTES" default:"4194304"`
+	// comma separated DNS servers tried in order, for everything the forwarder resolves: udp://host[:53], or just
+	// host[:port], tcp://host[:53], tls://host[:853] for DNS over TLS, https://host/dns-query for DNS over HTTPS, or
+	// tunnel://host[:53] to ask host from the tunnel server. The system resolver is used if empty, except on Android.
+	DnsServers string `env:"DNS_SERVERS"`
+	// answers of DNS_SERVERS kept for as long as their TTL allows, 0 disables the cache
+	DnsCacheSize int `env:"DNS_CACHE_SIZE" default:"4096"`
+	// admin listener serving /metrics, disabled unless set
+	AdminAddr string `env:"ADMIN_ADDR"`
+	// seconds connections being served get to finish on shutdown, before they are closed
+	ShutdownGrace int `env:"SHUTDOWN_GRACE" default:"30"`
+	// seconds a connection may go without traffic in either direction, 0 disables it.
+	// Also bounds the wait for the next request on kept alive http connections.
+	IdleTimeout int `env:"IDLE_TIMEOUT" default:"300"`
+	// seconds a connection may stay open at all, 0 disables it
+	MaxLifetime int `env:"MAX_LIFETIME" default:"0"`
+	// seconds before keepalive probes start on idle TCP connections, 0 keeps the default of 15 and -1 disables them
+	TcpKeepAlive int `env:"TCP_KEEPALIVE" default:"30"`
 }
@@ -1,6 +1,84 @@
-//go:build !android
-
 package main
 
-func SetDNS() {
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lib/dns"
+	"net"
+	"strings"
+)
+
+var ErrDnsServer = errors.New("invalid dns server")
+
+// tunnelDialer reaches DNS servers from the tunnel server, over UDP relayed through the tunnel
+type tunnelDialer struct {
+	tunnel *Upstreams
+	dialer *net.Dialer
+}
+
+func (d tunnelDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if network != "udp" {
+		return nil, fmt.Errorf("%w: %s through the tunnel", ErrDnsServer, network)
+	}
+
+	return DialPacket(ctx, addr, d.tunnel, d.dialer)
+}
+
+// SetDNS resolves everything through servers, comma separated DNS_SERVERS or defaultDnsServers if empty, caching
+// cacheSize answers. The tunnel servers themselves are resolved by the servers not reached through the tunnel, or
+// by the system resolver if there are none. It returns nil and changes nothing if there are no servers.
+func SetDNS(servers string, cacheSize int, tunnel *Upstreams, dialer *net.Dialer) (*dns.Resolver, error) {
+	if servers == "" {
+		servers = defaultDnsServers
+	}
+
+	// the system resolver, which swapping net.DefaultResolver leaves alone
+	direct := *dialer
+	direct.Resolver = &net.Resolver{}
+
+	var upstreams, bootstrap []dns.Upstream
+
+	for _, s := range strings.Split(servers, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		var d dns.Dialer = &direct
+		if addr, ok := strings.CutPrefix(s, "tunnel://"); ok {
+			s, d = "udp://"+addr, tunnelDialer{tunnel: tunnel, dialer: &direct}
+		}
+
+		up, err := dns.NewUpstream(s, d)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrDnsServer, err.Error())
+		}
+
+		upstreams = append(upstreams, up)
+		if d == &direct {
+			bootstrap = append(bootstrap, up)
+		}
+	}
+
+	if len(upstreams) == 0 {
+		return nil, nil
+	}
+
+	var cache *dns.Cache
+	if cacheSize > 0 {
+		cache = dns.NewCache(cacheSize)
+	}
+
+	ret := dns.NewResolver(upstreams, cache)
+	net.DefaultResolver = ret.NetResolver()
+
+	if tunnel != nil {
+		if len(bootstrap) > 0 {
+			tunnel.SetResolver(dns.NewResolver(bootstrap, cache).NetResolver())
+		} else {
+			tunnel.SetResolver(direct.Resolver)
+		}
+	}
+
+	return ret, nil
 }
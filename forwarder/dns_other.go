@@ -0,0 +1,6 @@
+//go:build !android
+
+package main
+
+// the system resolver
+const defaultDnsServers = ""
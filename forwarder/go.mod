@@ -2,4 +2,23 @@ module forwarder
 
 go 1.23
 
-require github.com/andybalholm/brotli v1.1.0
+require (
+	github.com/andybalholm/brotli v1.1.0
+	github.com/dop251/goja v0.0.0-20241009100908-5f46f2705ca3
+	github.com/gofiber/fiber/v2 v2.52.5
+	github.com/quic-go/quic-go v0.54.1
+)
+
+require (
+	github.com/dlclark/regexp2 v1.11.4 // indirect
+	github.com/go-sourcemap/sourcemap v2.1.3+incompatible // indirect
+	github.com/google/pprof v0.0.0-20230207041349-798e818bf904 // indirect
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"lib"
+	"lib/handshake"
+	"lib/http1"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrHttpBody = errors.New("malformed HTTP body")
+var ErrUnsupportedScheme = errors.New("unsupported scheme")
+
+// hopHeaders only apply to a single connection. Transfer-Encoding is kept, as bodies are relayed as they are.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Upgrade"}
+
+// stripHopHeaders removes hop-by-hop headers, including those named in Connection.
+// An Upgrade, e.g. to websocket, is passed on.
+func stripHopHeaders(h http1.Headers) (ret http1.Headers, upgrade string) {
+	if h.HasToken("Connection", "upgrade") {
+		upgrade = h.Get("Upgrade")
+	}
+
+	var named []string
+	for _, v := range h {
+		if strings.EqualFold(v.Name, "Connection") || strings.EqualFold(v.Name, "Proxy-Connection") {
+			for _, t := range strings.Split(v.Value, ",") {
+				if t = strings.TrimSpace(t); t != "" {
+					named = append(named, t)
+				}
+			}
+		}
+	}
+
+	ret = h
+	for _, name := range append(named, hopHeaders...) {
+		ret = ret.Del(name)
+	}
+
+	if upgrade != "" {
+		ret = append(ret, http1.Header{Name: "Connection", Value: "Upgrade"}, http1.Header{Name: "Upgrade", Value: upgrade})
+	}
+
+	return
+}
+
+// keepAlive tells whether the connection stays open after the message, by its version and Connection header
+func keepAlive(version string, h http1.Headers) bool {
+	if h.HasToken("Connection", "close") || h.HasToken("Proxy-Connection", "close") {
+		return false
+	}
+
+	if version == "HTTP/1.0" {
+		return h.HasToken("Connection", "keep-alive") || h.HasToken("Proxy-Connection", "keep-alive")
+	}
+
+	return true
+}
+
+// bodyLength returns the length of the body framed by h, or -1 if it is chunked
+func bodyLength(h http1.Headers) (int64, error) {
+	if te := h.Get("Transfer-Encoding"); te != "" {
+		codings := strings.Split(te, ",")
+		if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+			return 0, ErrHttpBody
+		}
+		return -1, nil
+	}
+
+	if cl := h.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || n < 0 {
+			return 0, ErrHttpBody
+		}
+		return n, nil
+	}
+
+	return 0, nil
+}
+
+// copyChunked relays a chunked body including its trailers, without decoding it
+func copyChunked(dst io.Writer, src *bufio.Reader) error {
+	for {
+		line, err := src.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+
+		size, _, _ := strings.Cut(strings.TrimSpace(string(line)), ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return ErrHttpBody
+		}
+
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		// chunk data and its CRLF
+		if _, err := io.CopyN(dst, src, n+2); err != nil {
+			return err
+		}
+	}
+
+	// trailers, up to the empty line
+	for {
+		line, err := src.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+
+		if len(line) <= 2 {
+			return nil
+		}
+	}
+}
+
+// copyBody relays a body of length bytes, -1 if chunked
+func copyBody(dst io.Writer, src *bufio.Reader, length int64) error {
+	if length < 0 {
+		return copyChunked(dst, src)
+	}
+
+	_, err := io.CopyN(dst, src, length)
+	return err
+}
+
+type flusher interface {
+	Flush() error
+}
+
+func flush(w io.Writer) error {
+	if f, ok := w.(flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// captureWriter keeps a copy of what it writes, up to limit bytes
+type captureWriter struct {
+	io.Writer
+	buf      []byte
+	limit    int64
+	overflow bool
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if int64(len(w.buf)+len(b)) > w.limit {
+			w.overflow, w.buf = true, nil
+		} else {
+			w.buf = append(w.buf, b...)
+		}
+	}
+	return w.Writer.Write(b)
+}
+
+// flushWriter sends every write right away, for traffic that is not request / response
+type flushWriter struct {
+	io.Writer
+}
+
+func (w flushWriter) Write(b []byte) (n int, err error) {
+	if n, err = w.Writer.Write(b); err != nil {
+		return
+	}
+	return n, flush(w.Writer)
+}
+
+// httpUpstream is a kept-alive connection to an origin, through the tunnel or direct
+type httpUpstream struct {
+	addr   string
+	tunnel *Upstreams
+	conn   net.Conn
+	r      *bufio.Reader
+}
+
+// dialHttpUpstream connects to addr. Through the tunnel, method is handshake.MethodTls for intercepted requests,
+// handshake.MethodConnect otherwise.
+func dialHttpUpstream(addr string, method string, tunnel *Upstreams, dialer *net.Dialer) (*httpUpstream, error) {
+	ret := &httpUpstream{addr: addr, tunnel: tunnel}
+
+	if tunnel == nil {
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ret.conn = conn
+		ret.r = bufio.NewReader(conn)
+		return ret, nil
+	}
+
+	req := handshake.Request{Method: method, Addr: addr, Version: handshake.Version}
+	stream, _, err := tunnel.Connect(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.conn = stream
+	ret.r = bufio.NewReader(replyReader(stream))
+
+	return ret, nil
+}
+
+// requestTarget returns the origin of an absolute-form request, and the request target to send it
+func requestTarget(rawUrl string) (addr string, host string, uri string, err error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return
+	}
+
+	if u.Scheme != "http" || u.Host == "" {
+		err = ErrUnsupportedScheme
+		return
+	}
+
+	host = u.Host
+	addr = u.Hostname() + ":"
+	if p := u.Port(); p != "" {
+		addr += p
+	} else {
+		addr += "80"
+	}
+
+	// as sent, rather than re-escaped by url.URL
+	uri = "/"
+	rest := rawUrl[strings.Index(rawUrl, "://")+3:]
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		uri = rest[i:]
+		if uri[0] == '?' {
+			uri = "/" + uri
+		}
+	}
+
+	return
+}
+
+// HttpProxy serves plain http requests of a client connection, each one sent to its own origin.
+// Connections to origins are kept alive while consecutive requests go to the same one.
+// Responses are answered from HttpCache where they can be.
+type HttpProxy struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	tunnel   *Upstreams
+	router   *Router
+	dialer   *net.Dialer
+	logger   lib.Logger
+	upstream *httpUpstream
+	// host:port of the intercepted connection, whose requests are in origin-form and all go to it through tunnel.
+	// Empty for plain http.
+	origin string
+}
+
+// protocol labels the metrics of the connection
+func (p *HttpProxy) protocol() string {
+	if p.origin != "" {
+		return "https"
+	}
+	return "http"
+}
+
+func (p *HttpProxy) closeUpstream() {
+	if p.upstream != nil {
+		p.upstream.conn.Close()
+		p.upstream = nil
+	}
+}
+
+// fail answers the client with status, before anything of the response has been sent
+func (p *HttpProxy) fail(status *http1.ProxyStatus) {
+	countConnection(p.protocol(), status)
+	p.conn.Write(status.Response())
+}
+
+// writeHead writes the status line and headers of res to the client
+func (p *HttpProxy) writeHead(res http1.Response, body ...[]byte) error {
+	sb := strings.Builder{}
+	lib.BuildString(&sb, res.Version, " ", strconv.Itoa(res.StatusCode), " ", res.Reason, "\r\n")
+	res.Headers.Build(&sb)
+	sb.WriteString("\r\n")
+
+	return lib.WriteAll(p.conn, append([][]byte{[]byte(sb.String())}, body...)...)
+}
+
+// serveCached answers req with entry, or with a 304 Not Modified if the conditionals of req match it
+func (p *HttpProxy) serveCached(req http1.Request, entry *http1.CacheEntry, keepAlive bool, log lib.Logger) (bool, error) {
+	now := time.Now()
+
+	res, body := entry.At(now), entry.Body
+	if entry.NotModified(req) {
+		res, body = entry.NotModifiedAt(now), nil
+	}
+
+	res.Version = "HTTP/1.1"
+	if keepAlive {
+		res.Headers = append(res.Headers, http1.Header{Name: "Connection", Value: "keep-alive"})
+	} else {
+		res.Headers = append(res.Headers, http1.Header{Name: "Connection", Value: "close"})
+	}
+
+	countConnection(p.protocol(), nil)
+	log.Debug().Value("status", res.StatusCode).Value("age", res.Headers.Get("Age")).Msg("served from cache")
+
+	if err := p.writeHead(res, body); err != nil {
+		return false, err
+	}
+	return keepAlive, nil
+}
+
+// safeMethod tells whether requests with method leave the stored responses of their target valid, RFC 9111 4.4
+func safeMethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS" || method == "TRACE"
+}
+
+// Serve handles req, and the requests following it on the connection
+func (p *HttpProxy) Serve(req http1.Request) {
+	defer p.conn.Close()
+	defer p.closeUpstream()
+
+	connectionsActive.With(p.protocol()).Inc()
+	defer connectionsActive.With(p.protocol()).Dec()
+
+	for {
+		log := p.logger.With().Value("url", req.Url).Value("method", req.Method).Logger()
+
+		next, err := p.serveRequest(req, log)
+		if err != nil {
+			log.Err().Value("error", err.Error()).Msg("failed to proxy request")
+			return
+		}
+
+		if !next {
+			log.Info().Msg("closed read/write")
+			return
+		}
+
+		if ConnTimeouts.Idle > 0 {
+			p.conn.SetReadDeadline(time.Now().Add(ConnTimeouts.Idle))
+		}
+
+		req, err = http1.ReadRequest(p.r, HttpLimits)
+		p.conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			if res := http1.Reject(err); res != nil {
+				p.conn.Write(res)
+			}
+
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Info().Msg("closed idle connection")
+			} else if err != io.EOF {
+				log.Info().Value("error", err.Error()).Msg("parse http request error")
+			}
+			return
+		}
+	}
+}
+
+// serveRequest relays one request and its response. It returns true if the client connection stays open for another.
+func (p *HttpProxy) serveRequest(req http1.Request, log lib.Logger) (bool, error) {
+	var addr, host, uri, key string
+	via, method := p.tunnel, handshake.MethodConnect
+
+	if p.origin != "" {
+		addr, uri, method = p.origin, req.Url, handshake.MethodTls
+		if host = req.Headers.Get("Host"); host == "" {
+			host, _, _ = net.SplitHostPort(p.origin)
+		}
+		key = "https://" + addr + uri
+	} else {
+		var err error
+		if addr, host, uri, err = requestTarget(req.Url); err != nil {
+			p.fail(proxyStatus(http.StatusBadRequest, http1.HttpRequestError, err))
+			return false, err
+		}
+
+		var ok bool
+		if via, ok = p.router.Via(context.Background(), addr, p.tunnel, log); !ok {
+			p.fail(errorStatus(ErrRouteBlocked))
+			return false, nil
+		}
+		key = "http://" + addr + uri
+	}
+
+	reqLength, err := bodyLength(req.Headers)
+	if err != nil {
+		p.fail(proxyStatus(http.StatusBadRequest, http1.HttpRequestError, err))
+		return false, err
+	}
+
+	clientKeepAlive := keepAlive(req.Version, req.Headers)
+	// stripped in place, req.Headers is still needed by the cache
+	headers, upgrade := stripHopHeaders(slices.Clone(req.Headers))
+	headers = append(http1.Headers{{Name: "Host", Value: host}}, headers.Del("Host")...)
+
+	cacheable := HttpCache != nil && reqLength == 0 && http1.Cacheable(req)
+
+	// stored response being revalidated
+	var entry *http1.CacheEntry
+	if cacheable {
+		if entry = HttpCache.Lookup(key, req); entry != nil {
+			if entry.Fresh(req, time.Now()) {
+				cacheRequests.With("hit").Inc()
+				return p.serveCached(req, entry, clientKeepAlive, log)
+			}
+
+			if entry.HasValidators() {
+				headers = entry.Conditional(headers)
+			} else {
+				entry = nil
+			}
+		}
+	}
+
+	if p.upstream != nil && (p.upstream.addr != addr || p.upstream.tunnel != via) {
+		p.closeUpstream()
+	}
+
+	if p.upstream == nil {
+		log.Info().Msg("connecting")
+
+		start := time.Now()
+		if p.upstream, err = dialHttpUpstream(addr, method, via, p.dialer); err != nil {
+			p.fail(errorStatus(err))
+			return false, err
+		}
+		dialSeconds.With(routeName(via)).Observe(time.Since(start).Seconds())
+	}
+
+	up := p.upstream
+	requestTime := time.Now()
+
+	sb := strings.Builder{}
+	lib.BuildString(&sb, req.Method, " ", uri, " ", req.Version, "\r\n")
+	headers.Build(&sb)
+	sb.WriteString("\r\n")
+
+	if _, err := io.WriteString(up.conn, sb.String()); err != nil {
+		p.fail(errorStatus(err))
+		return false, err
+	}
+
+	if err := copyBody(up.conn, p.r, reqLength); err != nil {
+		return false, err
+	}
+
+	if err := flush(up.conn); err != nil {
+		p.fail(errorStatus(err))
+		return false, err
+	}
+
+	for {
+		res, err := http1.ReadResponse(up.r, HttpLimits)
+		if err != nil {
+			p.fail(proxyStatus(http.StatusBadGateway, http1.HttpProtocolError, err))
+			return false, err
+		}
+
+		resLength := int64(0)
+		untilClose := false
+		noBody := req.Method == "HEAD" || res.StatusCode < 200 || res.StatusCode == 204 || res.StatusCode == 304
+
+		if !noBody {
+			if resLength, err = bodyLength(res.Headers); err != nil {
+				p.fail(proxyStatus(http.StatusBadGateway, http1.HttpProtocolError, err))
+				return false, err
+			}
+
+			untilClose = res.Headers.Get("Transfer-Encoding") == "" && res.Headers.Get("Content-Length") == ""
+		}
+
+		upstreamKeepAlive := keepAlive(res.Version, res.Headers) && !untilClose
+
+		// strips in place, res.Headers is not used afterwards
+		resHeaders, resUpgrade := stripHopHeaders(res.Headers)
+
+		switching := res.StatusCode == 101 && upgrade != "" && resUpgrade != ""
+		next := clientKeepAlive && !untilClose && !switching
+
+		// as stored, without the headers of either connection
+		stored := res
+		stored.Headers = resHeaders
+		responseTime := time.Now()
+
+		if res.StatusCode >= 200 && HttpCache != nil {
+			if !safeMethod(req.Method) && res.StatusCode < 400 {
+				HttpCache.Invalidate(key)
+			}
+
+			if entry != nil && res.StatusCode == 304 {
+				cacheRequests.With("revalidated").Inc()
+				entry = HttpCache.Update(key, entry, stored, requestTime, responseTime)
+
+				if !upstreamKeepAlive {
+					p.closeUpstream()
+				}
+				return p.serveCached(req, entry, clientKeepAlive, log)
+			}
+
+			if cacheable {
+				cacheRequests.With("miss").Inc()
+			}
+		}
+
+		// the body is kept as it is relayed, if the response may be stored
+		var capture *captureWriter
+		if cacheable && res.StatusCode >= 200 && !untilClose && HttpCache.Storable(req, stored, resLength) {
+			capture = &captureWriter{Writer: p.conn, limit: HttpCache.MaxEntryBytes()}
+		}
+
+		if !switching && res.StatusCode >= 200 {
+			if next {
+				resHeaders = append(resHeaders, http1.Header{Name: "Connection", Value: "keep-alive"})
+			} else {
+				resHeaders = append(resHeaders, http1.Header{Name: "Connection", Value: "close"})
+			}
+		}
+
+		res.Headers = resHeaders
+		if err := p.writeHead(res); err != nil {
+			return false, err
+		}
+
+		if switching {
+			countConnection(p.protocol(), nil)
+			log.Info().Value("upgrade", upgrade).Msg("switched protocol")
+			p.splice()
+			return false, nil
+		}
+
+		// interim responses, e.g. 100 Continue, are followed by the final one
+		if res.StatusCode < 200 {
+			continue
+		}
+
+		countConnection(p.protocol(), nil)
+
+		if untilClose {
+			_, err = io.Copy(p.conn, up.r)
+			return false, err
+		}
+
+		if capture == nil {
+			err = copyBody(p.conn, up.r, resLength)
+		} else if err = copyBody(capture, up.r, resLength); err == nil && !capture.overflow {
+			HttpCache.Store(key, req, stored, capture.buf, requestTime, responseTime)
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		if !upstreamKeepAlive {
+			p.closeUpstream()
+		}
+
+		return next, nil
+	}
+}
+
+// splice relays raw bytes both ways after a protocol switch, until either side closes
+func (p *HttpProxy) splice() {
+	up := p.upstream
+	done := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(flushWriter{up.conn}, p.r)
+		done <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(p.conn, up.r)
+		done <- err
+	}()
+
+	<-done
+}
@@ -4,10 +4,17 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"lib"
+	"lib/codec"
+	"lib/http1"
+	"lib/metrics"
 	"lib/structured_logger"
 	"net"
+	"net/url"
 	"os"
+	"strings"
 	"time"
+
+	fiber "github.com/gofiber/fiber/v2"
 )
 
 func main() {
@@ -16,14 +23,6 @@ func main() {
 
 	lib.AppScope.Init(logger)
 
-	SetDNS()
-
-	var serverAddr lib.NetworkAddress
-
-	if config.RemoteUrl != "" {
-		serverAddr = lib.Must(lib.UrlToAddress(config.RemoteUrl))
-	}
-
 	var rootCAs *x509.CertPool
 	if config.RootCA != "" {
 		rootCAs = x509.NewCertPool()
@@ -33,32 +32,175 @@ func main() {
 
 	certs := lib.Must(tls.LoadX509KeyPair(config.ClientCert, config.ClientKey))
 
-	var tlsConfig *tls.Config
-
-	if serverAddr.Host != "" {
-		tlsConfig = &tls.Config{
-			ServerName:         serverAddr.Host,
-			Certificates:       []tls.Certificate{certs},
-			RootCAs:            rootCAs,
-			MinVersion:         tls.VersionTLS13,
-			InsecureSkipVerify: true,
-			// resumption
-			ClientSessionCache: tls.NewLRUClientSessionCache(1024),
+	keepAlive := time.Second * time.Duration(config.TcpKeepAlive)
+
+	dialer := NewTFODialer()
+	dialer.KeepAlive = keepAlive
+
+	var tunnel *Upstreams
+
+	if config.RemoteUrl != "" {
+		codecs := lib.Must(codec.ParseList(config.TunnelCodecs))
+		// resumption
+		sessionCache := tls.NewLRUClientSessionCache(1024)
+
+		var upstreams []*Upstream
+
+		for _, remoteUrl := range strings.Split(config.RemoteUrl, ",") {
+			remoteUrl = strings.TrimSpace(remoteUrl)
+			serverAddr := lib.Must(lib.UrlToAddress(remoteUrl))
+
+			remote := lib.Must(url.Parse(remoteUrl))
+
+			nextProtos := []string{TunnelProtocol, LegacyTunnelProtocol}
+			switch remote.Scheme {
+			case "wss":
+				// through networks only letting web traffic out
+				nextProtos = []string{"http/1.1"}
+			case "quic":
+				// streams map to QUIC streams, only multiplexing servers speak it
+				nextProtos = []string{TunnelProtocol}
+			}
+
+			tlsConfig := &tls.Config{
+				ServerName:         serverAddr.Host,
+				Certificates:       []tls.Certificate{certs},
+				RootCAs:            rootCAs,
+				MinVersion:         tls.VersionTLS13,
+				InsecureSkipVerify: true,
+				ClientSessionCache: sessionCache,
+				NextProtos:         nextProtos,
+			}
+
+			upstreams = append(upstreams, NewUpstream(remoteUrl, NewTunnel(serverAddr.Address, tlsConfig, dialer, config.TunnelPoolSize, codecs, remote)))
 		}
+
+		tunnel = lib.Must(NewUpstreams(upstreams, config.UpstreamPolicy, logger))
+
+		metrics.NewGaugeFunc(registry, "smp_forwarder_tunnel_sessions", "Multiplexed connections open to tunnel servers.", func() float64 {
+			n := 0
+			for _, up := range upstreams {
+				n += up.NumSessions()
+			}
+			return float64(n)
+		})
 	}
 
-	lc := net.ListenConfig{}
+	resolver := lib.Must(SetDNS(config.DnsServers, config.DnsCacheSize, tunnel, dialer))
+	if resolver != nil {
+		metrics.NewCounterFunc(registry, "smp_forwarder_dns_cache_hits_total", "DNS queries answered from the cache.", func() float64 {
+			return float64(resolver.Stats.Hits.Load())
+		})
+		metrics.NewCounterFunc(registry, "smp_forwarder_dns_cache_misses_total", "DNS queries sent to DNS_SERVERS.", func() float64 {
+			return float64(resolver.Stats.Misses.Load())
+		})
+		metrics.NewCounterFunc(registry, "smp_forwarder_dns_upstream_failures_total", "Failed queries to each of DNS_SERVERS.", func() float64 {
+			return float64(resolver.Stats.Failures.Load())
+		})
+	}
 
-	server := lib.Must(lc.Listen(lib.AppScope.Context, "tcp", config.ListenAddr))
+	// after SetDNS, which changes how tunnels resolve the servers
+	if tunnel != nil && config.HealthCheckInterval > 0 {
+		lib.AppScope.Go(func() {
+			tunnel.HealthCheck(lib.AppScope.Context, time.Second*time.Duration(config.HealthCheckInterval))
+		})
+	}
 
-	dialer := NewTFODialer()
+	router := lib.Must(LoadRouter(config.RouteFile))
+
+	var interceptor *Interceptor
+	if config.MitmCaCert != "" {
+		ca := lib.Must(lib.LoadCertAuthority(config.MitmCaCert, config.MitmCaKey, 1024))
+		interceptor = NewInterceptor(ca, config.MitmHosts)
+	}
+
+	HttpLimits = http1.Limits{
+		MaxHeaderBytes: config.MaxHeaderBytes,
+		MaxHeaders:     config.MaxHeaders,
+	}
+
+	if config.HttpCacheBytes > 0 {
+		HttpCache = http1.NewCache(config.HttpCacheBytes, config.HttpCacheMaxEntryBytes)
+
+		metrics.NewGaugeFunc(registry, "smp_forwarder_http_cache_bytes", "Size of the responses in the HTTP cache.", func() float64 {
+			return float64(HttpCache.Bytes())
+		})
+	}
+
+	ConnTimeouts = lib.Timeouts{
+		Idle:     time.Second * time.Duration(config.IdleTimeout),
+		Lifetime: time.Second * time.Duration(config.MaxLifetime),
+	}
+
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	conns := lib.NewConnSet()
+
+	server := lib.Must(lc.Listen(lib.AppScope.Context, "tcp", config.ListenAddr))
 
 	lib.AppScope.GoWithClose(func() {
-		StartListener(lib.AppScope.Context, server, serverAddr.Address, tlsConfig, dialer, logger)
+		StartListener(lib.AppScope.Context, server, conns, func(conn net.Conn) {
+			HandleConnection(conn, tunnel, router, interceptor, dialer, logger)
+		}, logger)
 	}, func() bool {
 		server.(*net.TCPListener).SetDeadline(time.Now())
 		return false
 	})
 
+	if config.SocksListenAddr != "" {
+		var auth *SocksAuth
+		if config.SocksUser != "" {
+			auth = &SocksAuth{
+				User:     config.SocksUser,
+				Password: config.SocksPassword,
+			}
+		}
+
+		socksServer := lib.Must(lc.Listen(lib.AppScope.Context, "tcp", config.SocksListenAddr))
+
+		lib.AppScope.GoWithClose(func() {
+			StartListener(lib.AppScope.Context, socksServer, conns, func(conn net.Conn) {
+				HandleSocksConnection(conn, auth, tunnel, router, dialer, logger)
+			}, logger)
+		}, func() bool {
+			socksServer.(*net.TCPListener).SetDeadline(time.Now())
+			return false
+		})
+	}
+
+	if config.TransparentListenAddr != "" {
+		transparentServer := lib.Must(ListenTransparent(lib.AppScope.Context, lc, config.TransparentListenAddr, config.TransparentMode))
+
+		lib.AppScope.GoWithClose(func() {
+			StartListener(lib.AppScope.Context, transparentServer, conns, func(conn net.Conn) {
+				HandleTransparentConnection(conn, transparentServer.Addr(), config.TransparentMode, tunnel, router, dialer, logger)
+			}, logger)
+		}, func() bool {
+			transparentServer.(*net.TCPListener).SetDeadline(time.Now())
+			return false
+		})
+	}
+
+	if config.AdminAddr != "" {
+		admin := lib.Must(lib.NewFiber(func(app *fiber.App) error {
+			app.Get("/metrics", ServeMetrics)
+			return nil
+		}))
+
+		lib.AppScope.Go(func() {
+			if err := admin.Start(lib.AppScope.Context, config.AdminAddr, time.Second*5); err != nil {
+				logger.Err().Value("error", err.Error()).Msg("admin listener stopped")
+			}
+		})
+	}
+
+	lib.AppScope.Go(func() {
+		<-lib.AppScope.Context.Done()
+		Drain(conns, time.Second*time.Duration(config.ShutdownGrace), logger)
+
+		if tunnel != nil {
+			tunnel.Close()
+		}
+	})
+
 	lib.AppScope.Done(false)
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"lib"
+	"lib/codec"
+	"lib/metrics"
+
+	fiber "github.com/gofiber/fiber/v2"
+)
+
+var registry = metrics.NewRegistry()
+
+var (
+	connectionsActive = metrics.NewGauge(registry, "smp_forwarder_connections_active",
+		"Client connections being served.", "protocol")
+	connectionsTotal = metrics.NewCounter(registry, "smp_forwarder_connections_total",
+		"Client connections, or requests of plain http and intercepted https, by outcome: ok or the Proxy-Status error type.", "protocol", "outcome")
+	dialSeconds = metrics.NewHistogram(registry, "smp_forwarder_dial_seconds",
+		"Time to reach destinations, including the reply of the tunnel server.", metrics.DefBuckets, "route")
+	upstreamUp = metrics.NewGauge(registry, "smp_forwarder_upstream_up",
+		"Whether the tunnel server is considered healthy.", "upstream")
+	upstreamRtt = metrics.NewGauge(registry, "smp_forwarder_upstream_rtt_seconds",
+		"Smoothed TLS handshake time of the tunnel server.", "upstream")
+	tlsFailures = metrics.NewCounter(registry, "smp_forwarder_tls_handshake_failures_total",
+		"Failed TLS handshakes with tunnel servers by reason.", "reason")
+	cacheRequests = metrics.NewCounter(registry, "smp_forwarder_http_cache_requests_total",
+		"Cacheable requests by how they were answered: hit, revalidated, or miss when sent to the origin.", "result")
+)
+
+var bufPool = lib.NewBufferPool(32 * 1024)
+
+func init() {
+	metrics.NewCounterFunc(registry, "smp_forwarder_tunnel_sent_bytes_total",
+		"Bytes sent through the tunnel, before compression.", func() float64 { return float64(codec.Totals.RawWritten.Load()) })
+	metrics.NewCounterFunc(registry, "smp_forwarder_tunnel_sent_wire_bytes_total",
+		"Bytes sent through the tunnel, after compression.", func() float64 { return float64(codec.Totals.WireWritten.Load()) })
+	metrics.NewCounterFunc(registry, "smp_forwarder_tunnel_received_bytes_total",
+		"Bytes received through the tunnel, after decompression.", func() float64 { return float64(codec.Totals.RawRead.Load()) })
+	metrics.NewCounterFunc(registry, "smp_forwarder_tunnel_received_wire_bytes_total",
+		"Bytes received through the tunnel, before decompression.", func() float64 { return float64(codec.Totals.WireRead.Load()) })
+
+	metrics.NewCounterFunc(registry, "smp_forwarder_buffers_allocated_total",
+		"Copy buffers allocated by the pool.", func() float64 { return float64(bufPool.Allocated()) })
+	metrics.NewGaugeFunc(registry, "smp_forwarder_buffers_in_use",
+		"Copy buffers taken from the pool.", func() float64 { return float64(bufPool.InUse()) })
+
+	metrics.RegisterRuntime(registry)
+}
+
+// routeName labels dials by whether they go through the tunnel
+func routeName(tunnel *Upstreams) string {
+	if tunnel == nil {
+		return "direct"
+	}
+	return "tunnel"
+}
+
+// countConnection counts a connection by the outcome of reaching its destination
+func countConnection(protocol string, err error) {
+	outcome := "ok"
+	if err != nil {
+		if outcome = errorStatus(err).ErrorType; outcome == "" {
+			outcome = "error"
+		}
+	}
+
+	connectionsTotal.With(protocol, outcome).Inc()
+}
+
+// ServeMetrics renders the registry in the Prometheus text format
+func ServeMetrics(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, metrics.ContentType)
+	return registry.Write(c)
+}
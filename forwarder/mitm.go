@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"lib"
+	"lib/handshake"
+	"lib/http1"
+	"net"
+	"strings"
+	"time"
+)
+
+// interceptHandshakeTimeout bounds the TLS handshake with intercepted clients
+const interceptHandshakeTimeout = time.Second * 10
+
+// Interceptor terminates the TLS of clients connecting to allowed hosts with certificates minted by a local CA, which
+// the clients must trust. Their HTTP/1.1 requests are served like plain http ones, through the tunnel, where they
+// compress, and the tunnel server speaks TLS with the host.
+type Interceptor struct {
+	ca      *lib.CertAuthority
+	domains []string
+}
+
+// NewInterceptor intercepts hosts, comma separated domains which include their subdomains
+func NewInterceptor(ca *lib.CertAuthority, hosts string) *Interceptor {
+	ret := &Interceptor{ca: ca}
+
+	for _, d := range strings.Split(hosts, ",") {
+		if d = strings.Trim(strings.ToLower(strings.TrimSpace(d)), "."); d != "" {
+			ret.domains = append(ret.domains, d)
+		}
+	}
+
+	return ret
+}
+
+// Match tells whether connections to addr, in host:port form, are intercepted. A nil Interceptor matches nothing.
+func (i *Interceptor) Match(addr string) bool {
+	if i == nil {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return matchDomain(i.domains, strings.TrimSuffix(strings.ToLower(host), "."))
+}
+
+// prefixConn reads what was read ahead of the connection first
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Intercept serves the requests of conn, a CONNECT to addr which has sent b so far, as plaintext through tunnel.
+// reply tells the client the outcome of the dial, before its TLS handshake. It returns false, having done nothing,
+// if the tunnel server predates handshake.MethodTls.
+func (i *Interceptor) Intercept(conn *net.TCPConn, addr string, tunnel *Upstreams, log lib.Logger, reply func(error) error, b []byte) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		reply(err)
+		conn.Close()
+		return true
+	}
+
+	cert, err := i.ca.Certificate(host)
+	if err != nil {
+		log.Err().Value("error", err.Error()).Msg("failed to mint certificate")
+		reply(err)
+		conn.Close()
+		return true
+	}
+
+	start := time.Now()
+
+	req := handshake.Request{Method: handshake.MethodTls, Addr: addr, Version: handshake.Version}
+	stream, tunnelReply, err := tunnel.Connect(context.Background(), req)
+
+	if err == nil && tunnelReply.Version < 2 {
+		// relayed as CONNECT, which left the destination waiting for TLS
+		stream.Close()
+		return false
+	}
+
+	if err != nil {
+		log.Err().Value("error", err.Error()).Msg("failed to connect to peer")
+		reply(err)
+		conn.Close()
+		return true
+	}
+
+	dialSeconds.With(routeName(tunnel)).Observe(time.Since(start).Seconds())
+	log.Debug().Value("peer", tunnelReply.Peer).Value("dial_time", tunnelReply.Meta.Get("Dial-Time")).Msg("intercepting through tunnel")
+
+	if err := reply(nil); err != nil {
+		log.Info().Value("error", err.Error()).Msg("failed to write reply")
+		stream.Close()
+		conn.Close()
+		return true
+	}
+
+	var clientConn net.Conn = conn
+	if len(b) > 0 {
+		clientConn = &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(b), conn)}
+	}
+
+	client := tls.Server(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		// the tunnel server speaks the same with the host
+		NextProtos: []string{"http/1.1"},
+	})
+
+	handshakeCtx, cancel := context.WithTimeout(context.Background(), interceptHandshakeTimeout)
+	err = client.HandshakeContext(handshakeCtx)
+	cancel()
+
+	if err != nil {
+		log.Info().Value("error", err.Error()).Msg("client TLS handshake failed")
+		stream.Close()
+		conn.Close()
+		return true
+	}
+
+	proxy := &HttpProxy{
+		conn:   client,
+		r:      bufio.NewReader(client),
+		tunnel: tunnel,
+		logger: log,
+		origin: addr,
+		// the stream dialed for the CONNECT serves the first requests
+		upstream: &httpUpstream{addr: addr, tunnel: tunnel, conn: stream, r: bufio.NewReader(replyReader(stream))},
+	}
+
+	if ConnTimeouts.Idle > 0 {
+		client.SetReadDeadline(time.Now().Add(ConnTimeouts.Idle))
+	}
+
+	httpReq, err := http1.ReadRequest(proxy.r, HttpLimits)
+	client.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		if res := http1.Reject(err); res != nil {
+			client.Write(res)
+		}
+
+		log.Info().Value("error", err.Error()).Msg("parse http request error")
+		stream.Close()
+		client.Close()
+		return true
+	}
+
+	proxy.Serve(httpReq)
+	return true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// PacPaths are served with the proxy auto-config of the router, for browsers and WPAD
+var PacPaths = []string{"/proxy.pac", "/wpad.dat"}
+
+const pacPrelude = `function portOf(url) {
+  var m = url.match(/^[a-z0-9+.-]+:\/\/[^\/?#]*:(\d+)/i);
+  if (m) return parseInt(m[1], 10);
+  return url.substring(0, 6).toLowerCase() == "https:" ? 443 : 80;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  var port = portOf(url);
+`
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func pacAny(or []string) string {
+	if len(or) == 1 {
+		return or[0]
+	}
+	return "(" + strings.Join(or, " || ") + ")"
+}
+
+// pacCondition expresses the criteria of a rule checked by match. The CIDR criterion is left to the forwarder.
+func (r *routeRule) pacCondition() string {
+	var and []string
+
+	if len(r.domains) > 0 {
+		var or []string
+		for _, d := range r.domains {
+			or = append(or, "host == "+jsString(d), "dnsDomainIs(host, "+jsString("."+d)+")")
+		}
+		and = append(and, pacAny(or))
+	}
+
+	if len(r.hosts) > 0 {
+		var or []string
+		for _, h := range r.hosts {
+			or = append(or, "shExpMatch(host, "+jsString(h)+")")
+		}
+		and = append(and, pacAny(or))
+	}
+
+	if len(r.ports) > 0 {
+		var or []string
+		for _, p := range r.ports {
+			if p.from == p.to {
+				or = append(or, "port == "+strconv.Itoa(int(p.from)))
+			} else {
+				or = append(or, "(port >= "+strconv.Itoa(int(p.from))+" && port <= "+strconv.Itoa(int(p.to))+")")
+			}
+		}
+		and = append(and, pacAny(or))
+	}
+
+	if len(and) == 0 {
+		return "true"
+	}
+
+	return strings.Join(and, " && ")
+}
+
+// Pac generates a proxy auto-config script sending all but direct traffic to proxy, in host:port form.
+// The forwarder tunnels or blocks what it receives. Rules matching by CIDR are left to the forwarder as well,
+// as the browser would have to resolve names and test them against every network.
+func (r *Router) Pac(proxy string) []byte {
+	toProxy := jsString("PROXY " + proxy)
+
+	sb := strings.Builder{}
+	sb.WriteString(pacPrelude)
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+
+		ret := toProxy
+		if rule.route == RouteDirect && !rule.hasCidr {
+			ret = `"DIRECT"`
+		}
+
+		sb.WriteString("  if (" + rule.pacCondition() + ") return " + ret + ";\n")
+	}
+
+	if r.route == RouteDirect {
+		sb.WriteString("  return \"DIRECT\";\n}\n")
+	} else {
+		sb.WriteString("  return " + toProxy + ";\n}\n")
+	}
+
+	return []byte(sb.String())
+}
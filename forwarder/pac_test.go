@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"lib/assert"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/dop251/goja"
+)
+
+// pacFunctions are the helpers of the PAC runtime of browsers the generated scripts use
+const pacFunctions = `
+function dnsDomainIs(host, domain) {
+  return host.length >= domain.length && host.substring(host.length - domain.length) == domain;
+}
+
+function shExpMatch(str, shexp) {
+  var re = shexp.replace(/[.+^${}()|\\]/g, "\\$&").replace(/\*/g, ".*").replace(/\?/g, ".");
+  return new RegExp("^" + re + "$").test(str);
+}
+`
+
+// findProxy runs the PAC of router as a browser would for rawUrl
+func findProxy(t *testing.T, router *Router, rawUrl string) string {
+	vm := goja.New()
+
+	_, err := vm.RunString(pacFunctions + string(router.Pac("127.0.0.1:8080")))
+	assert.Null(t, err)
+
+	find, ok := goja.AssertFunction(vm.Get("FindProxyForURL"))
+	assert.Equal(t, true, ok)
+
+	u, err := url.Parse(rawUrl)
+	assert.Null(t, err)
+
+	ret, err := find(goja.Undefined(), vm.ToValue(rawUrl), vm.ToValue(u.Hostname()))
+	assert.Null(t, err)
+
+	return ret.String()
+}
+
+// routeOf is what the forwarder decides for rawUrl
+func routeOf(router *Router, rawUrl string) Route {
+	u, _ := url.Parse(rawUrl)
+
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+
+	route, _ := router.Route(context.Background(), net.JoinHostPort(u.Hostname(), port))
+	return route
+}
+
+var pacUrls = []string{
+	"https://example.com/",
+	"https://WWW.Example.com/path?q=1",
+	"http://example.com/",
+	"http://example.com:8080/",
+	"https://example.com:9443/",
+	"https://ads.example.com/",
+	"https://notexample.com/",
+	"http://nas.lan/",
+	"http://printer:631/",
+	"http://a.printer:631/",
+	"http://mail.example.org:25/",
+	"http://192.168.1.1/",
+	"http://10.1.2.3/",
+	"http://[fd00::1]/",
+	"https://example.org/",
+}
+
+func TestPac(t *testing.T) {
+	for _, d := range []string{"tunnel", "direct"} {
+		router, err := NewRouter(RouteConfig{
+			Rules: []RouteRule{
+				{Action: "block", Domain: []string{"ads.example.com"}},
+				{Action: "direct", Domain: []string{"example.com"}, Ports: []string{"443", "8000-8999"}},
+				{Action: "direct", Host: []string{"*.lan", "printer"}},
+				{Action: "tunnel", Domain: []string{"example.org"}},
+				{Action: "block", Ports: []string{"25"}},
+			},
+			Default: d,
+		}, "")
+		assert.Null(t, err)
+
+		// without CIDR rules, the browser goes direct exactly when the forwarder would
+		for _, u := range pacUrls {
+			direct := routeOf(router, u) == RouteDirect
+			assert.Equal(t, direct, findProxy(t, router, u) == "DIRECT")
+		}
+	}
+}
+
+func TestPac_Cidr(t *testing.T) {
+	router, err := NewRouter(RouteConfig{
+		Rules: []RouteRule{
+			{Action: "direct", Domain: []string{"example.com"}},
+			{Action: "direct", Cidr: []string{"192.168.0.0/16", "fd00::/8"}},
+			{Action: "block", Cidr: []string{"10.0.0.0/8"}},
+			{Action: "direct", Host: []string{"*.lan"}},
+		},
+		Default: "direct",
+	}, "")
+	assert.Null(t, err)
+
+	// what is left to the forwarder may be direct too, but what the browser sends direct must be
+	for _, u := range pacUrls {
+		if findProxy(t, router, u) == "DIRECT" {
+			assert.Equal(t, RouteDirect, routeOf(router, u))
+		}
+	}
+
+	assert.Equal(t, "DIRECT", findProxy(t, router, "https://www.example.com/"))
+	assert.Equal(t, "PROXY 127.0.0.1:8080", findProxy(t, router, "http://192.168.1.1/"))
+	assert.Equal(t, "PROXY 127.0.0.1:8080", findProxy(t, router, "http://10.1.2.3/"))
+	assert.Equal(t, RouteBlock, routeOf(router, "http://10.1.2.3/"))
+}
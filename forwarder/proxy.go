@@ -3,132 +3,41 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
 	"errors"
 	"io"
 	"net"
-	"net/url"
+	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
-	"sync"
-
-	"github.com/andybalholm/brotli"
+	"time"
 
 	"lib"
+	"lib/codec"
+	"lib/handshake"
+	"lib/http1"
 )
 
-type HttpRequest struct {
-	Method  string
-	Url     string
-	Version string
-	Headers map[string]string
-}
-
-type HttpResponse struct {
-	StatusCode int
-	Reason     string
-	Version    string
-	Headers    map[string]string
-}
-
-var MaxHeadersSupported = 100
-var ErrHttpMalformedHeader = errors.New("malformed HTTP Header")
-var ErrExceedingHeaderCount = errors.New("exceeding max number of HTTP headers")
-
-func parseHttp(r *bufio.Reader, parseStartLine func(string) error) (headers map[string]string, err error) {
-	var b []byte
-
-	startLine := true
-	headers = map[string]string{}
-
-	for {
-		b, err = r.ReadSlice('\n')
-		if err != nil {
-			return
-		}
-
-		l := len(b)
-
-		if b[l-2] != '\r' {
-			err = ErrHttpMalformedHeader
-			return
-		}
-
-		b = b[:l-2]
-
-		bs := string(b)
-
-		if startLine {
-			if err = parseStartLine(bs); err != nil {
-				return
-			}
-
-			startLine = false
-			continue
-		}
+// HttpLimits bound the head of requests from clients, and of responses to them
+var HttpLimits = http1.DefaultLimits
 
-		if len(b) == 0 {
-			// HTTP header parse complete
-			break
-		}
-
-		s := strings.Split(bs, ": ")
-		if len(s) != 2 {
-			err = ErrHttpMalformedHeader
-			return
-		}
-		headers[strings.ToLower(s[0])] = s[1]
-
-		if len(headers) > MaxHeadersSupported {
-			err = ErrExceedingHeaderCount
-			return
-		}
-	}
-	return
-}
-
-func ParseHttpRequest(r io.Reader) (ret HttpRequest, remainingBytes []byte, err error) {
-	ret = HttpRequest{}
-
-	bufReader := bufio.NewReader(r)
-	ret.Headers, err = parseHttp(bufReader, func(s string) error {
-		ss := strings.Split(s, " ")
-		if len(ss) != 3 {
-			return ErrHttpMalformedHeader
-		}
-
-		ret.Method = ss[0]
-		ret.Url = ss[1]
-		ret.Version = ss[2]
-
-		if len(ret.Method) == 0 || len(ret.Url) == 0 || !strings.HasPrefix(ret.Version, "HTTP/") {
-			return ErrHttpMalformedHeader
-		}
-		return nil
-	})
-
-	l, n, buffered := 0, 0, bufReader.Buffered()
-	remainingBytes = make([]byte, buffered)
-
-	for {
-		if l >= buffered {
-			break
-		}
-
-		n, err = bufReader.Read(remainingBytes[l:])
-		if err != nil {
-			return
-		}
-		l += n
+// HttpCache answers plain http and intercepted requests with the responses it stores, nil disables it
+var HttpCache *http1.Cache
 
-	}
+// ConnTimeouts bound how long relayed connections may go without traffic, and how long they may stay open
+var ConnTimeouts lib.Timeouts
 
-	return
+// buffered takes what r has read ahead
+func buffered(r *bufio.Reader) []byte {
+	b, _ := r.Peek(r.Buffered())
+	ret := append([]byte{}, b...)
+	r.Discard(len(b))
+	return ret
 }
 
 var okResponse []byte = []byte("HTTP/1.1 200 OK\r\n\r\n")
 
-func Copy(dst io.Writer, src io.Reader, signal chan error, skipBytes int, initialData ...[]byte) {
+func Copy(dst io.Writer, src io.Reader, signal chan error, initialData ...[]byte) {
 	for _, d := range initialData {
 		if len(d) == 0 {
 			continue
@@ -141,20 +50,13 @@ func Copy(dst io.Writer, src io.Reader, signal chan error, skipBytes int, initia
 		}
 	}
 
-	n := 0
-	if skipBytes > n {
-		b := make([]byte, skipBytes)
-		r, err := src.Read(b)
-
-		if err != nil {
-			signal <- err
-			return
-		}
-
-		n += r
+	if _, err := io.Copy(dst, src); err != nil {
+		signal <- err
+		return
 	}
 
-	if _, err := io.Copy(dst, src); err != nil {
+	// the other direction may still be sending
+	if err := lib.CloseWrite(dst); err != nil {
 		signal <- err
 		return
 	}
@@ -162,26 +64,9 @@ func Copy(dst io.Writer, src io.Reader, signal chan error, skipBytes int, initia
 	close(signal)
 }
 
-var bufPool = sync.Pool{
-	New: func() any {
-		return make([]byte, 32*1024)
-	},
-}
-
-var cwp = sync.Pool{
-	New: func() any {
-		return brotli.NewWriter(nil)
-	},
-}
-
-var crp = sync.Pool{
-	New: func() any {
-		return brotli.NewReader(nil)
-	},
-}
-
-func CopyFromRaw(dst *brotli.Writer, src *lib.Socket, signal chan error, initialData ...[]byte) {
-	buf := bufPool.Get().([]byte)
+// CopyFromRaw compresses what src reads into dst, flushing whenever src has nothing more to read right away
+func CopyFromRaw(dst *codec.Conn, src *lib.Socket, watchdog *lib.Watchdog, signal chan error, initialData ...[]byte) {
+	buf := bufPool.Get()
 	blockRead := false
 	writtenSinceFlush := 0
 
@@ -211,6 +96,7 @@ func CopyFromRaw(dst *brotli.Writer, src *lib.Socket, signal chan error, initial
 		}
 
 		if nr > 0 {
+			watchdog.Touch()
 			nw, ew := dst.Write(buf[0:nr])
 
 			if nw < 0 || nr < nw {
@@ -244,6 +130,11 @@ func CopyFromRaw(dst *brotli.Writer, src *lib.Socket, signal chan error, initial
 				return
 			}
 
+			if err := dst.CloseWrite(); err != nil {
+				signal <- err
+				return
+			}
+
 			close(signal)
 			return
 		}
@@ -261,6 +152,26 @@ func CopyFromRaw(dst *brotli.Writer, src *lib.Socket, signal chan error, initial
 	}
 }
 
+// SpliceCopy relays src to dst without going through user space where lib.Splice can, passing the half-close on
+func SpliceCopy(dst, src *lib.Socket, watchdog *lib.Watchdog, signal chan error, initialData ...[]byte) {
+	if err := lib.WriteAll(dst, initialData...); err != nil {
+		signal <- err
+		return
+	}
+
+	if _, err := lib.Splice(dst, src, watchdog); err != nil {
+		signal <- err
+		return
+	}
+
+	if err := dst.CloseWrite(); err != nil {
+		signal <- err
+		return
+	}
+
+	close(signal)
+}
+
 func Select[T any](chans []chan T) (index int, value T, ok bool) {
 	rv := make([]reflect.SelectCase, len(chans))
 	t := reflect.Value{}
@@ -280,7 +191,9 @@ func Select[T any](chans []chan T) (index int, value T, ok bool) {
 	return
 }
 
-func CopyToRemote(conn *net.TCPConn, addr string, tlsConfig *tls.Config, dialer *net.Dialer, log lib.Logger, startCopy chan error, b ...[]byte) {
+// CopyToRemote connects to addr, and relays conn to it once reply has told the client the outcome.
+// Either side closing its write half is passed on to the other, the connection ends once both have, or on the first error.
+func CopyToRemote(conn *net.TCPConn, addr string, tunnel *Upstreams, dialer *net.Dialer, log lib.Logger, reply func(error) error, b ...[]byte) {
 	defer conn.Close()
 
 	raw, err := lib.NewSocket(conn)
@@ -290,149 +203,222 @@ func CopyToRemote(conn *net.TCPConn, addr string, tlsConfig *tls.Config, dialer
 		return
 	}
 
-	remote, err := dialer.Dial("tcp", addr)
+	var remote net.Conn
+	var stream *codec.Conn
+
+	start := time.Now()
+
+	if tunnel != nil {
+		var tunnelReply handshake.Reply
+
+		req := handshake.Request{Method: handshake.MethodConnect, Addr: addr, Version: handshake.Version}
+		if stream, tunnelReply, err = tunnel.Connect(context.Background(), req, b...); err == nil {
+			remote = stream
+			log.Debug().Value("peer", tunnelReply.Peer).Value("dial_time", tunnelReply.Meta.Get("Dial-Time")).Msg("connected through tunnel")
+		}
+	} else {
+		remote, err = dialer.Dial("tcp", addr)
+	}
 
 	if err != nil {
 		log.Err().Value("error", err.Error()).Msg("failed to connect to peer")
+		reply(err)
 		return
 	}
 
-	upstream := make(chan error)
-	downstream := make(chan error)
-
-	signals := []chan error{upstream, downstream}
-
-	var remoteConn io.ReadCloser = remote
-	defer remoteConn.Close()
-
-	if tlsConfig != nil {
-		tlsConn := tls.Client(remote, tlsConfig)
-		remoteConn = tlsConn
-
-		if err := tlsConn.Handshake(); err != nil {
-			log.Err().Value("error", err.Error()).Msg("failed to handshake with peer")
-			return
-		}
-
-		cw := cwp.Get().(*brotli.Writer)
-		cw.Reset(tlsConn)
-		defer func() {
-			defer recover()
-			cw.Close()
-			cwp.Put(cw)
-		}()
+	dialSeconds.With(routeName(tunnel)).Observe(time.Since(start).Seconds())
 
-		go CopyFromRaw(cw, raw, upstream, b...)
-	} else {
-		go Copy(remote, raw, upstream, 0, b...)
-	}
+	defer remote.Close()
 
-	if _, ok := <-startCopy; ok {
+	if err := reply(nil); err != nil {
+		log.Info().Value("error", err.Error()).Msg("failed to write reply")
 		return
 	}
 
-	var cr *brotli.Reader
-	if tlsConfig != nil {
-		cr = crp.Get().(*brotli.Reader)
-		if cr.Reset(remoteConn) != nil {
-			crp.Put(cr)
-			return
+	watchdog := lib.NewWatchdog(ConnTimeouts, func(error) {
+		conn.Close()
+		if stream != nil {
+			// unblocks the copies without waiting on the locks of stream
+			stream.Conn.Close()
+		} else {
+			remote.Close()
 		}
+	})
+
+	// buffered, so the copy still running after return does not block forever on its signal
+	upstream := make(chan error, 1)
+	downstream := make(chan error, 1)
+
+	signals := []chan error{upstream, downstream}
 
-		go Copy(conn, cr, downstream, len(okResponse))
+	if stream != nil {
+		go CopyFromRaw(stream, raw, watchdog, upstream)
+		go Copy(conn, watchdog.Reader(replyReader(stream)), downstream)
+	} else if remoteRaw, err := lib.NewSocket(remote); err == nil {
+		go SpliceCopy(remoteRaw, raw, watchdog, upstream, b...)
+		go SpliceCopy(raw, remoteRaw, watchdog, downstream)
 	} else {
-		go Copy(conn, remote, downstream, 0)
+		go Copy(remote, watchdog.Reader(raw), upstream, b...)
+		go Copy(conn, watchdog.Reader(remote), downstream)
 	}
 
-	for len(signals) > 0 {
-		i, e, ok := Select(signals)
+	waitCopies(signals, watchdog, log)
+}
 
-		if e == nil {
-			log.Info().Msg("closed read/write")
-		} else {
-			log.Err().Value("error", e.Error()).Msg("failed to read/write")
-		}
+// waitCopies waits for both directions of a connection to finish, or for the first to fail
+func waitCopies(signals []chan error, watchdog *lib.Watchdog, log lib.Logger) {
+	for len(signals) > 0 {
+		i, e, failed := Select(signals)
 
-		if ok {
+		if !failed {
 			signals = append(signals[:i], signals[i+1:]...)
 			continue
 		}
 
-		if cr != nil {
-			crp.Put(cr)
+		if err := watchdog.Stop(); err != nil {
+			log.Info().Value("error", err.Error()).Msg("closed connection")
+		} else {
+			log.Err().Value("error", e.Error()).Msg("failed to read/write")
 		}
 		return
 	}
+
+	watchdog.Stop()
+	log.Info().Msg("closed read/write")
+}
+
+// ProxyName identifies the forwarder in the Proxy-Status of error responses
+const ProxyName = "smp-forwarder"
+
+func proxyStatus(statusCode int, errorType string, err error) *http1.ProxyStatus {
+	return &http1.ProxyStatus{
+		Proxy:      ProxyName,
+		StatusCode: statusCode,
+		ErrorType:  errorType,
+		Details:    err.Error(),
+	}
 }
 
-func HandleConnection(conn net.Conn, serverAddr string, tlsConfig *tls.Config, dialer *net.Dialer, logger lib.Logger) {
-	req, b, err := ParseHttpRequest(conn)
+// errorStatus tells the client why its request failed. Refusals of the tunnel server are passed on as they are.
+func errorStatus(err error) *http1.ProxyStatus {
+	var status *http1.ProxyStatus
+	if errors.As(err, &status) {
+		return status
+	}
+
+	switch {
+	case errors.Is(err, ErrRouteBlocked):
+		return proxyStatus(http.StatusForbidden, http1.HttpRequestDenied, err)
+	case errors.Is(err, handshake.ErrBadReply):
+		return proxyStatus(http.StatusBadGateway, http1.HttpProtocolError, err)
+	}
+
+	status = http1.DialStatus(ProxyName, err)
+
+	// the destination may be fine, the tunnel is not
+	if errors.Is(err, ErrTunnelUnavailable) {
+		status.StatusCode = http.StatusServiceUnavailable
+	}
+
+	return status
+}
+
+// ServePac answers a request to the listener itself with the proxy auto-config of router
+func ServePac(conn net.Conn, req http1.Request, router *Router) error {
+	defer conn.Close()
+
+	proxy := req.Headers.Get("host")
+	if proxy == "" {
+		proxy = conn.LocalAddr().String()
+	}
+
+	pac := router.Pac(proxy)
+
+	sb := strings.Builder{}
+	lib.BuildString(&sb, "HTTP/1.1 200 OK\r\n",
+		"Content-Type: application/x-ns-proxy-autoconfig\r\n",
+		"Content-Length: ", strconv.Itoa(len(pac)), "\r\n",
+		"Connection: close\r\n\r\n")
+
+	return lib.WriteAll(conn, []byte(sb.String()), pac)
+}
+
+func HandleConnection(conn net.Conn, tunnel *Upstreams, router *Router, interceptor *Interceptor, dialer *net.Dialer, logger lib.Logger) {
+	br := bufio.NewReader(conn)
+	req, err := http1.ReadRequest(br, HttpLimits)
 
 	if err != nil {
+		if res := http1.Reject(err); res != nil {
+			conn.Write(res)
+		}
 		conn.Close()
 		logger.Err().Value("error", err.Error()).Msg("parse http request error")
 		return
 	}
 
-	host := req.Url
+	if req.Method == "GET" && lib.Contains(PacPaths, req.Url) {
+		if err := ServePac(conn, req, router); err != nil {
+			logger.Info().Value("error", err.Error()).Msg("failed to serve pac")
+		}
+		return
+	}
 
-	initData := []byte{}
 	if req.Method != "CONNECT" {
-		u, err := url.Parse(req.Url)
-		if err != nil {
-			logger.Err().Value("method", req.Method).Value("url", req.Url).Value("error", err.Error()).Msg("invalid url")
-			conn.Close()
-			return
+		proxy := &HttpProxy{
+			conn:   conn,
+			r:      br,
+			tunnel: tunnel,
+			router: router,
+			dialer: dialer,
+			logger: logger,
 		}
+		proxy.Serve(req)
+		return
+	}
 
-		if u.Scheme != "http" {
-			logger.Err().Value("method", req.Method).Value("url", req.Url).Msg("unsupported schema")
-			conn.Close()
-			return
-		}
+	host := req.Url
+	b := buffered(br)
 
-		host = u.Hostname() + ":"
-		if p := u.Port(); p != "" {
-			host += p
-		} else {
-			host += "80"
-		}
+	connectionsActive.With("connect").Inc()
+	defer connectionsActive.With("connect").Dec()
 
-		sb := strings.Builder{}
-		lib.BuildString(&sb, req.Method, " ", req.Url, " ", req.Version, "\r\n")
-		for k, v := range req.Headers {
-			lib.BuildString(&sb, k, ": ", v, "\r\n")
-		}
-		lib.BuildString(&sb, "\r\n")
-		initData = []byte(sb.String())
-	}
+	log := logger.With().Value("url", req.Url).Value("method", req.Method).Logger()
 
-	startCopy := make(chan error, 1)
+	via, ok := router.Via(context.Background(), host, tunnel, log)
+	if !ok {
+		countConnection("connect", ErrRouteBlocked)
+		conn.Write(errorStatus(ErrRouteBlocked).Response())
+		conn.Close()
+		return
+	}
 
-	log := logger.With().Value("url", req.Url).Value("method", req.Method).Logger()
 	log.Info().Msg("connecting")
 
-	if tlsConfig != nil {
-		go CopyToRemote(conn.(*net.TCPConn), serverAddr, tlsConfig, dialer, log, startCopy, []byte("CONNECT "+host+" HTTP/1.1\r\n\r\n"), initData, b)
-	} else {
-		go CopyToRemote(conn.(*net.TCPConn), host, nil, dialer, log, startCopy, initData, b)
-	}
+	reply := func(err error) error {
+		countConnection("connect", err)
 
-	if req.Method != "CONNECT" {
-		close(startCopy)
-		return
-	}
+		if err != nil {
+			conn.Write(errorStatus(err).Response())
+			return err
+		}
 
-	if _, err := conn.Write(okResponse); err != nil {
-		log.Info().Value("error", err.Error()).Msg("failed to write ok response")
+		_, err = conn.Write(okResponse)
+		return err
+	}
 
-		startCopy <- err
-	} else {
-		close(startCopy)
+	// only worth it where the plaintext gets compressed
+	if via != nil && interceptor.Match(host) {
+		if interceptor.Intercept(conn.(*net.TCPConn), host, via, log, reply, b) {
+			return
+		}
+		log.Warn().Msg("tunnel server cannot intercept, relaying as is")
 	}
+
+	CopyToRemote(conn.(*net.TCPConn), host, via, dialer, log, reply, b)
 }
 
-func StartListener(ctx context.Context, listener net.Listener, serverAddr string, tlsConfig *tls.Config, dialer *net.Dialer, logger lib.Logger) error {
+// StartListener serves connections until ctx is done, tracking them in conns
+func StartListener(ctx context.Context, listener net.Listener, conns *lib.ConnSet, handle func(net.Conn), logger lib.Logger) error {
 	defer listener.Close()
 
 	for !lib.IsDone(ctx) {
@@ -448,8 +434,33 @@ func StartListener(ctx context.Context, listener net.Listener, serverAddr string
 			return err
 		}
 
-		go HandleConnection(conn, serverAddr, tlsConfig, dialer, logger)
+		if !conns.Add(conn) {
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			defer conns.Remove(conn)
+			handle(conn)
+		}()
 	}
 
+	logger.Info().Value("addr", listener.Addr().String()).Msg("stopped accepting connections")
 	return nil
 }
+
+// Drain waits up to grace for the connections being served to finish once the listeners stop, and closes those left
+func Drain(conns *lib.ConnSet, grace time.Duration, logger lib.Logger) {
+	logger.Info().Value("connections", conns.Len()).Value("grace", grace.String()).Msg("draining connections")
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	if err := conns.Wait(ctx); err != nil {
+		logger.Warn().Value("connections", conns.Close()).Msg("closed connections left after grace period")
+		return
+	}
+
+	conns.Close()
+	logger.Info().Msg("all connections finished")
+}
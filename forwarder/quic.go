@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicConfig keeps tunnels over QUIC from idling out of NAT mappings between streams
+var quicConfig = &quic.Config{
+	KeepAlivePeriod: time.Second * 15,
+	MaxIdleTimeout:  time.Minute,
+}
+
+// quicTransport carries the streams of a tunnel on a single QUIC connection, one QUIC stream each, so a lost packet
+// only holds up the stream it belongs to. Connections resume in 0-RTT, opening streams before the handshake completes.
+type quicTransport struct {
+	// the UDP socket of all connections, bound on first use
+	udp func() (*quic.Transport, error)
+
+	lock sync.Mutex
+	conn *quic.Conn
+}
+
+func newQuicTransport() *quicTransport {
+	return &quicTransport{
+		udp: sync.OnceValues(func() (*quic.Transport, error) {
+			conn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return nil, err
+			}
+			return &quic.Transport{Conn: conn}, nil
+		}),
+	}
+}
+
+// live returns the connection unless it is gone
+func (q *quicTransport) live() *quic.Conn {
+	if q.conn != nil && q.conn.Context().Err() == nil {
+		return q.conn
+	}
+	return nil
+}
+
+// openQuic opens a stream on the QUIC connection to the server, dialing it first if there is none
+func (t *Tunnel) openQuic(ctx context.Context) (net.Conn, error) {
+	conn, err := t.quicConnection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if errors.Is(err, quic.Err0RTTRejected) {
+		// the server forgot the session, e.g. on restart: streams opened so far are lost, the next go in 1-RTT
+		if conn, err = conn.NextConnection(ctx); err != nil {
+			return nil, err
+		}
+		stream, err = conn.OpenStreamSync(ctx)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return lib.NewQuicStream(stream, conn), nil
+}
+
+// quicConnection returns the live QUIC connection, dialing one if it is gone, e.g. on idle timeout
+func (t *Tunnel) quicConnection(ctx context.Context) (*quic.Conn, error) {
+	t.quic.lock.Lock()
+	defer t.quic.lock.Unlock()
+
+	if conn := t.quic.live(); conn != nil {
+		return conn, nil
+	}
+
+	conn, err := t.dialQuic(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t.quic.conn = conn
+	return conn, nil
+}
+
+// dialQuic connects to the server over QUIC, resolving its address like TCP connections would
+func (t *Tunnel) dialQuic(ctx context.Context) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(t.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := t.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	portNum, err := resolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := t.quic.udp()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ips[0].Unmap(), uint16(portNum)))
+
+	conn, err := transport.DialEarly(ctx, addr, t.tlsConfig, quicConfig)
+	if err != nil {
+		tlsFailures.With(lib.TlsFailureReason(err)).Inc()
+		return nil, err
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"lib"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Route int
+
+const (
+	RouteTunnel Route = iota
+	RouteDirect
+	RouteBlock
+)
+
+var ErrInvalidRouteRule = errors.New("invalid route rule")
+var ErrRouteBlocked = errors.New("blocked by route rule")
+
+// resolveTimeout bounds local lookups for rules matching names by CIDR
+const resolveTimeout = time.Second * 5
+
+// A rule matches if every criterion it sets matches. Within a criterion, any item may match.
+type RouteRule struct {
+	// tunnel, direct or block
+	Action string `json:"action"`
+	// domain and its subdomains, e.g. example.com
+	Domain []string `json:"domain"`
+	// glob of the requested host name, e.g. *.internal
+	Host []string `json:"host"`
+	// CIDR of the destination address, e.g. 10.0.0.0/8
+	Cidr []string `json:"cidr"`
+	// files of CIDRs, one per line, e.g. a GeoIP country list. Relative to the rule file.
+	CidrFile []string `json:"cidrFile"`
+	// destination port or port range, e.g. 443 or 8000-8999
+	Ports []string `json:"ports"`
+	// host names are resolved locally to match Cidr / CidrFile. Otherwise only IP addresses can match.
+	Resolve bool `json:"resolve"`
+}
+
+// Rules are evaluated in order, and the first match decides. Default applies when nothing matches.
+type RouteConfig struct {
+	Rules   []RouteRule `json:"rules"`
+	Default string      `json:"default"`
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type ipRange struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+type routeRule struct {
+	route   Route
+	domains []string
+	hosts   []string
+	// sorted and merged, so a lookup is a binary search
+	ranges  []ipRange
+	hasCidr bool
+	ports   []portRange
+	resolve bool
+}
+
+// Router decides whether a destination is reached through the tunnel, directly, or not at all
+type Router struct {
+	rules []routeRule
+	route Route
+}
+
+// DefaultRouter sends everything through the tunnel
+var DefaultRouter = &Router{}
+
+func parseRoute(action string) (Route, error) {
+	switch strings.ToLower(action) {
+	case "tunnel":
+		return RouteTunnel, nil
+	case "direct":
+		return RouteDirect, nil
+	case "block":
+		return RouteBlock, nil
+	}
+
+	return 0, ErrInvalidRouteRule
+}
+
+func parsePortRange(s string) (ret portRange, err error) {
+	from, to, found := strings.Cut(s, "-")
+
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return
+	}
+
+	t := f
+	if found {
+		if t, err = strconv.ParseUint(strings.TrimSpace(to), 10, 16); err != nil {
+			return
+		}
+	}
+
+	if t < f {
+		err = ErrInvalidRouteRule
+		return
+	}
+
+	return portRange{uint16(f), uint16(t)}, nil
+}
+
+func prefixRange(p netip.Prefix) ipRange {
+	p = p.Masked()
+	from := p.Addr()
+
+	b := from.AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+	to, _ := netip.AddrFromSlice(b)
+
+	return ipRange{from, to}
+}
+
+func mergeRanges(ranges []ipRange) []ipRange {
+	slices.SortFunc(ranges, func(a, b ipRange) int {
+		return a.from.Compare(b.from)
+	})
+
+	ret := ranges[:0]
+	for _, r := range ranges {
+		if n := len(ret); n > 0 && ret[n-1].from.Is4() == r.from.Is4() &&
+			(r.from.Compare(ret[n-1].to) <= 0 || r.from == ret[n-1].to.Next()) {
+			if r.to.Compare(ret[n-1].to) > 0 {
+				ret[n-1].to = r.to
+			}
+			continue
+		}
+		ret = append(ret, r)
+	}
+
+	return ret
+}
+
+func loadCidrFile(file string) (ret []ipRange, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(line)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, prefixRange(prefix))
+	}
+
+	return ret, scanner.Err()
+}
+
+// NewRouter builds the rules of config. CidrFile names are resolved against dir.
+func NewRouter(config RouteConfig, dir string) (ret *Router, err error) {
+	ret = &Router{}
+
+	if config.Default != "" {
+		if ret.route, err = parseRoute(config.Default); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range config.Rules {
+		rule := routeRule{resolve: r.Resolve}
+
+		if rule.route, err = parseRoute(r.Action); err != nil {
+			return nil, err
+		}
+
+		for _, d := range r.Domain {
+			rule.domains = append(rule.domains, strings.Trim(strings.ToLower(d), "."))
+		}
+
+		for _, h := range r.Host {
+			rule.hosts = append(rule.hosts, strings.ToLower(h))
+		}
+
+		for _, c := range r.Cidr {
+			prefix, e := netip.ParsePrefix(c)
+			if e != nil {
+				return nil, e
+			}
+			rule.ranges = append(rule.ranges, prefixRange(prefix))
+		}
+
+		for _, f := range r.CidrFile {
+			if !path.IsAbs(f) {
+				f = path.Join(dir, f)
+			}
+
+			ranges, e := loadCidrFile(f)
+			if e != nil {
+				return nil, e
+			}
+			rule.ranges = append(rule.ranges, ranges...)
+		}
+
+		rule.hasCidr = len(r.Cidr) > 0 || len(r.CidrFile) > 0
+		rule.ranges = mergeRanges(rule.ranges)
+
+		for _, p := range r.Ports {
+			pr, e := parsePortRange(p)
+			if e != nil {
+				return nil, e
+			}
+			rule.ports = append(rule.ports, pr)
+		}
+
+		ret.rules = append(ret.rules, rule)
+	}
+
+	return
+}
+
+// LoadRouter reads a RouteConfig in JSON. Without a file everything goes through the tunnel.
+func LoadRouter(file string) (*Router, error) {
+	if file == "" {
+		return DefaultRouter, nil
+	}
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var config RouteConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, err
+	}
+
+	return NewRouter(config, path.Dir(file))
+}
+
+func matchDomain(domains []string, host string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchGlob(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *routeRule) matchIp(ip netip.Addr) bool {
+	ip = ip.Unmap()
+
+	i, _ := slices.BinarySearchFunc(r.ranges, ip, func(a ipRange, ip netip.Addr) int {
+		return a.to.Compare(ip)
+	})
+
+	return i < len(r.ranges) && r.ranges[i].from.Compare(ip) <= 0
+}
+
+// match checks everything but the CIDR criterion, which needs the addresses of host
+func (r *routeRule) match(host string, port uint16) bool {
+	if len(r.domains) > 0 && !matchDomain(r.domains, host) {
+		return false
+	}
+
+	if len(r.hosts) > 0 && !matchGlob(r.hosts, host) {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		found := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Route decides how to reach addr, in host:port form.
+// It returns the index of the deciding rule, or -1 for the default route.
+func (r *Router) Route(ctx context.Context, addr string) (Route, int) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	port, _ := strconv.ParseUint(p, 10, 16)
+
+	var ips []netip.Addr
+	resolved := false
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips, resolved = []netip.Addr{ip}, true
+	}
+
+	for i := range r.rules {
+		rule := &r.rules[i]
+
+		if !rule.match(host, uint16(port)) {
+			continue
+		}
+
+		if !rule.hasCidr {
+			return rule.route, i
+		}
+
+		if !resolved && rule.resolve {
+			resolveCtx, cancel := context.WithTimeout(ctx, resolveTimeout)
+			ips, _ = net.DefaultResolver.LookupNetIP(resolveCtx, "ip", host)
+			cancel()
+			resolved = true
+		}
+
+		for _, ip := range ips {
+			if rule.matchIp(ip) {
+				return rule.route, i
+			}
+		}
+	}
+
+	return r.route, -1
+}
+
+// Via returns the tunnel to reach addr through, or nil to dial it directly. ok is false if addr is blocked.
+// Without a tunnel, everything not blocked is dialed directly.
+func (r *Router) Via(ctx context.Context, addr string, tunnel *Upstreams, log lib.Logger) (via *Upstreams, ok bool) {
+	route, rule := r.Route(ctx, addr)
+
+	switch route {
+	case RouteBlock:
+		log.Warn().Value("rule", rule).Msg("blocked by route rule")
+		return nil, false
+	case RouteDirect:
+		log.Debug().Value("rule", rule).Msg("routed direct")
+		return nil, true
+	}
+
+	return tunnel, true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"lib/assert"
+	"net/netip"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRouter_Route(t *testing.T) {
+	dir := t.TempDir()
+	assert.Null(t, os.WriteFile(path.Join(dir, "cn.txt"), []byte("# country\n1.0.1.0/24\n1.0.2.0/23 # merged\n\n240e::/20\n"), 0600))
+
+	router, err := NewRouter(RouteConfig{
+		Rules: []RouteRule{
+			{Action: "block", Domain: []string{"ads.example.com"}},
+			{Action: "direct", Domain: []string{".Example.com."}, Ports: []string{"443", "8000-8999"}},
+			{Action: "direct", Host: []string{"*.lan", "printer"}},
+			{Action: "block", Ports: []string{"25"}},
+			{Action: "direct", Cidr: []string{"192.168.0.0/16", "fd00::/8"}},
+			{Action: "direct", CidrFile: []string{"cn.txt"}},
+			{Action: "direct", Cidr: []string{"127.0.0.0/8"}, Resolve: true, Host: []string{"localhost"}},
+		},
+		Default: "tunnel",
+	}, dir)
+	assert.Null(t, err)
+
+	for _, tc := range []struct {
+		addr  string
+		route Route
+		rule  int
+	}{
+		{"ads.example.com:443", RouteBlock, 0},
+		{"x.ads.example.com:80", RouteBlock, 0},
+		{"example.com:443", RouteDirect, 1},
+		{"WWW.Example.COM.:8080", RouteDirect, 1},
+		{"www.example.com:80", RouteTunnel, -1},
+		{"notexample.com:443", RouteTunnel, -1},
+		{"nas.lan:80", RouteDirect, 2},
+		{"printer:631", RouteDirect, 2},
+		{"a.printer:631", RouteTunnel, -1},
+		{"mail.example.org:25", RouteBlock, 3},
+		{"192.168.1.1:80", RouteDirect, 4},
+		{"[::ffff:192.168.1.1]:80", RouteDirect, 4},
+		{"[fd12::1]:80", RouteDirect, 4},
+		{"1.0.1.255:443", RouteDirect, 5},
+		{"1.0.3.1:443", RouteDirect, 5},
+		{"1.0.4.1:443", RouteTunnel, -1},
+		{"[240e:1::1]:443", RouteDirect, 5},
+		// names only match CIDRs if resolved
+		{"router.home:80", RouteTunnel, -1},
+		{"localhost:8080", RouteDirect, 6},
+		{"8.8.8.8", RouteTunnel, -1},
+	} {
+		route, rule := router.Route(context.Background(), tc.addr)
+		assert.Equal(t, tc.route, route)
+		assert.Equal(t, tc.rule, rule)
+	}
+
+	// the defaults
+	route, rule := DefaultRouter.Route(context.Background(), "example.com:443")
+	assert.Equal(t, RouteTunnel, route)
+	assert.Equal(t, -1, rule)
+
+	router, err = NewRouter(RouteConfig{Default: "direct"}, dir)
+	assert.Null(t, err)
+	route, _ = router.Route(context.Background(), "example.com:443")
+	assert.Equal(t, RouteDirect, route)
+}
+
+func TestNewRouter_Invalid(t *testing.T) {
+	for _, config := range []RouteConfig{
+		{Default: "proxy"},
+		{Rules: []RouteRule{{Action: "allow"}}},
+		{Rules: []RouteRule{{Action: "direct", Cidr: []string{"10.0.0.0"}}}},
+		{Rules: []RouteRule{{Action: "direct", Ports: []string{"90-80"}}}},
+		{Rules: []RouteRule{{Action: "direct", Ports: []string{"65536"}}}},
+		{Rules: []RouteRule{{Action: "direct", CidrFile: []string{"missing.txt"}}}},
+	} {
+		_, err := NewRouter(config, t.TempDir())
+		assert.NotNull(t, err)
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	ranges := mergeRanges([]ipRange{
+		prefixRange(netip.MustParsePrefix("10.0.1.0/24")),
+		prefixRange(netip.MustParsePrefix("10.0.0.0/24")),
+		prefixRange(netip.MustParsePrefix("10.0.0.128/25")),
+		prefixRange(netip.MustParsePrefix("10.0.3.7/24")),
+		prefixRange(netip.MustParsePrefix("::/0")),
+	})
+
+	var s string
+	for _, r := range ranges {
+		s += r.from.String() + "-" + r.to.String() + " "
+	}
+	assert.Equal(t, "10.0.0.0-10.0.1.255 10.0.3.0-10.0.3.255 ::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ", s)
+}
+
+func TestLoadRouter(t *testing.T) {
+	dir := t.TempDir()
+	assert.Null(t, os.WriteFile(path.Join(dir, "lan.txt"), []byte("10.0.0.0/8\n"), 0600))
+	assert.Null(t, os.WriteFile(path.Join(dir, "routes.json"), []byte(`{
+		"rules": [{"action": "direct", "cidrFile": ["lan.txt"]}],
+		"default": "block"
+	}`), 0600))
+
+	router, err := LoadRouter(path.Join(dir, "routes.json"))
+	assert.Null(t, err)
+
+	route, _ := router.Route(context.Background(), "10.1.2.3:22")
+	assert.Equal(t, RouteDirect, route)
+	route, _ = router.Route(context.Background(), "example.com:443")
+	assert.Equal(t, RouteBlock, route)
+
+	router, err = LoadRouter("")
+	assert.Null(t, err)
+	assert.Equal(t, DefaultRouter, router)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"lib"
+	"lib/http1"
+	"net"
+	"strconv"
+)
+
+// https://datatracker.ietf.org/doc/html/rfc1928
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoMethod = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdUdpAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksNetworkUnreachable  = 0x03
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCommandNotSupported = 0x07
+	socksAtypNotSupported    = 0x08
+)
+
+var ErrSocksVersion = errors.New("unsupported socks version")
+var ErrSocksAuth = errors.New("socks authentication failed")
+var ErrSocksAtyp = errors.New("unsupported socks address type")
+var ErrSocksAddress = errors.New("invalid socks address")
+var ErrSocksFragment = errors.New("fragmented socks datagram")
+
+type SocksAuth struct {
+	User     string
+	Password string
+}
+
+type SocksRequest struct {
+	Command byte
+	Host    string
+}
+
+func socksAuthenticate(conn io.ReadWriter, auth *SocksAuth) error {
+	buf := make([]byte, 255)
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+
+	if buf[0] != socksVersion {
+		return ErrSocksVersion
+	}
+
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	method := byte(socksAuthNone)
+	if auth != nil {
+		method = socksAuthPassword
+	}
+
+	if !lib.Contains(methods, method) {
+		conn.Write([]byte{socksVersion, socksAuthNoMethod})
+		return ErrSocksAuth
+	}
+
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+
+	if auth == nil {
+		return nil
+	}
+
+	// https://datatracker.ietf.org/doc/html/rfc1929
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+
+	password := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(user, []byte(auth.User)) != 1 || subtle.ConstantTimeCompare(password, []byte(auth.Password)) != 1 {
+		conn.Write([]byte{1, 1})
+		return ErrSocksAuth
+	}
+
+	_, err := conn.Write([]byte{1, 0})
+	return err
+}
+
+func readSocksAddr(r io.Reader) (host string, err error) {
+	buf := make([]byte, 255)
+	if _, err = io.ReadFull(r, buf[:1]); err != nil {
+		return
+	}
+
+	switch buf[0] {
+	case socksAtypIPv4:
+		if _, err = io.ReadFull(r, buf[:net.IPv4len]); err != nil {
+			return
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socksAtypIPv6:
+		if _, err = io.ReadFull(r, buf[:net.IPv6len]); err != nil {
+			return
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socksAtypDomain:
+		if _, err = io.ReadFull(r, buf[:1]); err != nil {
+			return
+		}
+
+		// an empty domain would make the address ":port"
+		if buf[0] == 0 {
+			err = ErrSocksAddress
+			return
+		}
+
+		domain := buf[:buf[0]]
+		if _, err = io.ReadFull(r, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		err = ErrSocksAtyp
+		return
+	}
+
+	if _, err = io.ReadFull(r, buf[:2]); err != nil {
+		return
+	}
+
+	host = net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf[:2]))))
+	return
+}
+
+func ParseSocksRequest(conn io.ReadWriter, auth *SocksAuth) (ret SocksRequest, err error) {
+	if err = socksAuthenticate(conn, auth); err != nil {
+		return
+	}
+
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+
+	if buf[0] != socksVersion {
+		err = ErrSocksVersion
+		return
+	}
+
+	ret.Command = buf[1]
+
+	switch ret.Host, err = readSocksAddr(conn); err {
+	case ErrSocksAtyp:
+		WriteSocksReply(conn, socksAtypNotSupported, nil)
+	case ErrSocksAddress:
+		WriteSocksReply(conn, socksGeneralFailure, nil)
+	}
+
+	return
+}
+
+// ParseSocksUdpHeader returns the destination of a datagram sent to the UDP relay, and the length of its header
+func ParseSocksUdpHeader(b []byte) (host string, headerLen int, err error) {
+	// RSV(2) FRAG(1). Fragmentation is not supported.
+	if len(b) < 3 || b[2] != 0 {
+		err = ErrSocksFragment
+		return
+	}
+
+	r := bytes.NewReader(b[3:])
+	if host, err = readSocksAddr(r); err != nil {
+		return
+	}
+
+	headerLen = len(b) - r.Len()
+	return
+}
+
+// WriteSocksReply writes the reply to a socks request. The bound address is reported as 0.0.0.0:0 if addr is nil.
+func WriteSocksReply(w io.Writer, rep byte, addr net.Addr) error {
+	b := []byte{socksVersion, rep, 0, socksAtypIPv4}
+
+	ip, port := net.IPv4zero.To4(), 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		b[3] = socksAtypIPv6
+	}
+
+	b = append(b, ip...)
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+
+	_, err := w.Write(b)
+	return err
+}
+
+func HandleSocksConnection(conn net.Conn, auth *SocksAuth, tunnel *Upstreams, router *Router, dialer *net.Dialer, logger lib.Logger) {
+	req, err := ParseSocksRequest(conn, auth)
+
+	if err != nil {
+		conn.Close()
+		logger.Err().Value("error", err.Error()).Msg("parse socks request error")
+		return
+	}
+
+	if req.Command == socksCmdUdpAssociate {
+		HandleSocksUdp(conn, req.Host, tunnel, router, dialer, logger)
+		return
+	}
+
+	if req.Command != socksCmdConnect {
+		WriteSocksReply(conn, socksCommandNotSupported, nil)
+		conn.Close()
+		logger.Err().Value("command", int(req.Command)).Msg("unsupported socks command")
+		return
+	}
+
+	connectionsActive.With("socks").Inc()
+	defer connectionsActive.With("socks").Dec()
+
+	log := logger.With().Value("url", req.Host).Value("method", "SOCKS").Logger()
+
+	via, ok := router.Via(context.Background(), req.Host, tunnel, log)
+	if !ok {
+		countConnection("socks", ErrRouteBlocked)
+		WriteSocksReply(conn, socksNotAllowed, nil)
+		conn.Close()
+		return
+	}
+
+	log.Info().Msg("connecting")
+
+	CopyToRemote(conn.(*net.TCPConn), req.Host, via, dialer, log, func(err error) error {
+		countConnection("socks", err)
+
+		if err != nil {
+			WriteSocksReply(conn, socksReplyCode(errorStatus(err)), nil)
+			return err
+		}
+
+		return WriteSocksReply(conn, socksSucceeded, nil)
+	})
+}
+
+// socksReplyCode is the closest socks reply to why the destination could not be reached
+func socksReplyCode(status *http1.ProxyStatus) byte {
+	switch status.ErrorType {
+	case http1.DestinationIpProhibited, http1.HttpRequestDenied:
+		return socksNotAllowed
+	case http1.DestinationIpUnroutable:
+		return socksNetworkUnreachable
+	case http1.DnsError, http1.DnsTimeout, http1.DestinationUnavailable, http1.ConnectionTimeout:
+		return socksHostUnreachable
+	case http1.ConnectionRefused:
+		return socksConnectionRefused
+	}
+
+	return socksGeneralFailure
+}
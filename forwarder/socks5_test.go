@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"lib/assert"
+	"testing"
+)
+
+// socksRequest parses in, a request after the greeting offering no authentication, and returns what was replied
+func socksRequest(in ...byte) (SocksRequest, []byte, error) {
+	var out bytes.Buffer
+	conn := struct {
+		io.Reader
+		io.Writer
+	}{bytes.NewReader(append([]byte{socksVersion, 1, socksAuthNone}, in...)), &out}
+
+	req, err := ParseSocksRequest(conn, nil)
+	return req, out.Bytes(), err
+}
+
+func TestParseSocksRequest(t *testing.T) {
+	for _, tc := range []struct {
+		in   []byte
+		host string
+	}{
+		{[]byte{5, socksCmdConnect, 0, socksAtypIPv4, 192, 0, 2, 1, 0x01, 0xbb}, "192.0.2.1:443"},
+		{append([]byte{5, socksCmdConnect, 0, socksAtypDomain, 11}, append([]byte("example.com"), 0, 80)...), "example.com:80"},
+		{[]byte{5, socksCmdConnect, 0, socksAtypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}, "[2001:db8::1]:53"},
+		{[]byte{5, socksCmdUdpAssociate, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}, "0.0.0.0:0"},
+	} {
+		req, out, err := socksRequest(tc.in...)
+		assert.Null(t, err)
+		assert.Equal(t, tc.in[1], req.Command)
+		assert.Equal(t, tc.host, req.Host)
+		assert.Equal(t, string([]byte{socksVersion, socksAuthNone}), string(out))
+	}
+
+	// the method reply, then the failure
+	failed := func(rep byte) string {
+		return string([]byte{socksVersion, socksAuthNone, socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	}
+
+	_, out, err := socksRequest(5, socksCmdConnect, 0, socksAtypDomain, 0, 0, 80)
+	assert.Equal(t, ErrSocksAddress, err)
+	assert.Equal(t, failed(socksGeneralFailure), string(out))
+
+	_, out, err = socksRequest(5, socksCmdConnect, 0, 0x02, 0, 0, 80)
+	assert.Equal(t, ErrSocksAtyp, err)
+	assert.Equal(t, failed(socksAtypNotSupported), string(out))
+
+	_, _, err = socksRequest(4, socksCmdConnect, 0, socksAtypIPv4, 192, 0, 2, 1, 0, 80)
+	assert.Equal(t, ErrSocksVersion, err)
+
+	// truncated anywhere
+	full := append([]byte{5, socksCmdConnect, 0, socksAtypDomain, 11}, append([]byte("example.com"), 0, 80)...)
+	for n := range len(full) {
+		_, _, err = socksRequest(full[:n]...)
+		assert.NotNull(t, err)
+	}
+}
+
+func TestParseSocksUdpHeader(t *testing.T) {
+	for _, tc := range []struct {
+		in        []byte
+		host      string
+		headerLen int
+	}{
+		{[]byte{0, 0, 0, socksAtypIPv4, 192, 0, 2, 1, 0, 53, 'h', 'i'}, "192.0.2.1:53", 10},
+		{append([]byte{0, 0, 0, socksAtypDomain, 4}, append([]byte("a.io"), 0x1f, 0x90, 'h', 'i')...), "a.io:8080", 11},
+		{[]byte{0, 0, 0, socksAtypIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 53}, "[::1]:53", 22},
+	} {
+		host, headerLen, err := ParseSocksUdpHeader(tc.in)
+		assert.Null(t, err)
+		assert.Equal(t, tc.host, host)
+		assert.Equal(t, tc.headerLen, headerLen)
+	}
+
+	for _, in := range [][]byte{
+		nil,
+		{0, 0},
+		// fragment 1
+		{0, 0, 1, socksAtypIPv4, 192, 0, 2, 1, 0, 53},
+		{0, 0, 0, socksAtypIPv4, 192, 0, 2},
+		{0, 0, 0, socksAtypIPv4, 192, 0, 2, 1, 0},
+		{0, 0, 0, socksAtypDomain, 0, 0, 53},
+		{0, 0, 0, socksAtypDomain, 4, 'a', '.'},
+		{0, 0, 0, 0x02, 0, 53},
+	} {
+		_, _, err := ParseSocksUdpHeader(in)
+		assert.NotNull(t, err)
+	}
+}
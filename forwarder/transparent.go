@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"lib"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+)
+
+// modes of TRANSPARENT_MODE
+const (
+	// iptables REDIRECT, the original destination is kept by conntrack
+	TransparentRedirect = "redirect"
+	// iptables TPROXY, the connection is accepted on the original destination
+	TransparentTproxy = "tproxy"
+)
+
+var ErrTransparentUnsupported = errors.New("transparent proxying is only supported on linux")
+var ErrUnknownTransparentMode = errors.New("unknown transparent mode")
+var ErrNotRedirected = errors.New("connection was not redirected by the firewall")
+
+// sniffTimeout bounds the wait for the client to speak first, which it does not for e.g. SMTP
+const sniffTimeout = time.Millisecond * 500
+
+// ListenTransparent listens on addr for connections the firewall intercepted with mode
+func ListenTransparent(ctx context.Context, lc net.ListenConfig, addr string, mode string) (net.Listener, error) {
+	switch mode {
+	case TransparentRedirect:
+	case TransparentTproxy:
+		lc.Control = transparentControl
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownTransparentMode, mode)
+	}
+
+	return lc.Listen(ctx, "tcp", addr)
+}
+
+// originalDestination returns where the client was connecting to before the firewall sent it here
+func originalDestination(conn *net.TCPConn, listener net.Addr, mode string) (dst netip.AddrPort, err error) {
+	if mode == TransparentTproxy {
+		dst = conn.LocalAddr().(*net.TCPAddr).AddrPort()
+	} else if dst, err = originalDst(conn); err != nil {
+		return
+	}
+
+	// connected to the listener itself, relaying would loop back here
+	l := listener.(*net.TCPAddr).AddrPort()
+	if dst.Port() == l.Port() && (l.Addr().IsUnspecified() || dst.Addr().Unmap() == l.Addr().Unmap()) {
+		return dst, ErrNotRedirected
+	}
+	return
+}
+
+// HandleTransparentConnection relays a connection intercepted by the firewall to its original destination.
+// The destination is named by the TLS server name or HTTP Host the client sends, if any, so routes and the
+// tunnel server see host names rather than addresses.
+func HandleTransparentConnection(conn net.Conn, listener net.Addr, mode string, tunnel *Upstreams, router *Router, dialer *net.Dialer, logger lib.Logger) {
+	tcpConn := conn.(*net.TCPConn)
+
+	dst, err := originalDestination(tcpConn, listener, mode)
+	if err != nil {
+		conn.Close()
+		logger.Err().Value("remote", conn.RemoteAddr().String()).Value("error", err.Error()).Msg("failed to get original destination")
+		return
+	}
+
+	// large enough for a whole TLS record
+	br := bufio.NewReaderSize(conn, 16*1024+5)
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	host, err := lib.SniffHost(br)
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, lib.ErrMalformedClientHello) {
+		conn.Close()
+		if err != io.EOF {
+			logger.Info().Value("destination", dst.String()).Value("error", err.Error()).Msg("failed to sniff host")
+		}
+		return
+	}
+
+	addr := dst.String()
+	if host != "" {
+		addr = net.JoinHostPort(host, strconv.Itoa(int(dst.Port())))
+	}
+
+	connectionsActive.With("transparent").Inc()
+	defer connectionsActive.With("transparent").Dec()
+
+	log := logger.With().Value("url", addr).Value("method", "TRANSPARENT").Value("destination", dst.String()).Logger()
+
+	via, ok := router.Via(context.Background(), addr, tunnel, log)
+	if !ok {
+		countConnection("transparent", ErrRouteBlocked)
+		conn.Close()
+		return
+	}
+
+	log.Info().Msg("connecting")
+
+	// nothing to tell the client, which thinks it is connected already
+	CopyToRemote(tcpConn, addr, via, dialer, log, func(err error) error {
+		countConnection("transparent", err)
+		return err
+	}, buffered(br))
+}
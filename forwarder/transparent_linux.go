@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+)
+
+const (
+	// SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST of the same value
+	soOriginalDst = 80
+	// IP_TRANSPARENT, IPV6_TRANSPARENT
+	ipTransparent   = 19
+	ipv6Transparent = 75
+)
+
+// transparentControl lets a TPROXY listener accept connections to addresses that are not its own
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if e := c.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1); err != nil {
+			return
+		}
+
+		if sa, _ := syscall.Getsockname(int(fd)); sa != nil {
+			if _, ok := sa.(*syscall.SockaddrInet6); ok {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			}
+		}
+	}); e != nil {
+		return e
+	}
+	return err
+}
+
+// originalDst asks conntrack where a connection redirected by iptables REDIRECT was going
+func originalDst(conn *net.TCPConn) (dst netip.AddrPort, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	v4 := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap().Is4()
+
+	if e := raw.Control(func(fd uintptr) {
+		if v4 {
+			// a sockaddr_in, in a struct large enough to hold it
+			var mreq *syscall.IPv6Mreq
+			if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err != nil {
+				err = os.NewSyscallError("getsockopt", err)
+				return
+			}
+
+			sa := mreq.Multiaddr
+			dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			return
+		}
+
+		// a sockaddr_in6, same
+		var info *syscall.IPv6MTUInfo
+		if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst); err != nil {
+			err = os.NewSyscallError("getsockopt", err)
+			return
+		}
+
+		// in network byte order
+		port := binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+		dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), port)
+	}); e != nil {
+		err = e
+	}
+	return
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return ErrTransparentUnsupported
+}
+
+func originalDst(conn *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, ErrTransparentUnsupported
+}
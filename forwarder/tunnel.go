@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"lib"
+	"lib/codec"
+	"lib/mux"
+	"lib/websocket"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+// TunnelProtocol is negotiated with ALPN. The server multiplexes streams over the connection when it agrees on it,
+// and each stream negotiates its codecs.
+const TunnelProtocol = "smp/2"
+
+// LegacyTunnelProtocol multiplexes streams compressed with brotli
+const LegacyTunnelProtocol = "smp/1"
+
+type tunnelSession struct {
+	*mux.Session
+	protocol string
+}
+
+// Tunnel keeps a small pool of long-lived multiplexed connections to the server
+type Tunnel struct {
+	addr      string
+	tlsConfig *tls.Config
+	dialer    *net.Dialer
+	poolSize  int
+	// offered to the server in order of preference
+	codecs []codec.ID
+	// the tunnel runs inside a WebSocket upgrade to it, over TLS speaking HTTP/1.1, if not nil
+	webSocket *url.URL
+	// streams are carried by QUIC instead of multiplexed TLS connections, if not nil
+	quic *quicTransport
+
+	lock     sync.Mutex
+	sessions []tunnelSession
+	pending  int
+	// closed, and replaced, whenever a pending dial ends
+	dialed chan struct{}
+}
+
+// NewTunnel connects to addr the way the scheme of remote asks for: wss over WebSocket, quic over QUIC, and TLS
+// otherwise
+func NewTunnel(addr string, tlsConfig *tls.Config, dialer *net.Dialer, poolSize int, codecs []codec.ID, remote *url.URL) *Tunnel {
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
+	d := *dialer
+
+	ret := &Tunnel{
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		dialer:    &d,
+		poolSize:  poolSize,
+		codecs:    codecs,
+		dialed:    make(chan struct{}),
+	}
+
+	switch remote.Scheme {
+	case "wss":
+		ret.webSocket = remote
+	case "quic":
+		ret.quic = newQuicTransport()
+	}
+
+	return ret
+}
+
+// SetResolver changes how the server address is resolved, e.g. when DNS itself goes through the tunnel. Dials read
+// it unsynchronized, so it is only set before the first.
+func (t *Tunnel) SetResolver(resolver *net.Resolver) {
+	t.dialer.Resolver = resolver
+}
+
+// Dial opens a compressed stream on a pooled session, or on the QUIC connection.
+// Servers without multiplexing support get a dedicated TLS connection per call.
+func (t *Tunnel) Dial(ctx context.Context) (*codec.Conn, error) {
+	if t.quic != nil {
+		stream, err := t.openQuic(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return t.wrap(stream, TunnelProtocol)
+	}
+
+	// only with a slot of the pool reserved is a connection dialed
+	for {
+		session, reserved, dialed := t.session()
+
+		if session.Session != nil {
+			stream, err := session.Open()
+			if err == nil {
+				return t.wrap(stream, session.protocol)
+			}
+
+			// e.g. out of stream ids, another one is tried
+			t.retire(session.Session)
+			continue
+		}
+
+		if reserved {
+			break
+		}
+
+		// every slot is being dialed
+		select {
+		case <-dialed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	conn, protocol, err := t.dial(ctx)
+
+	if err != nil || (protocol != TunnelProtocol && protocol != LegacyTunnelProtocol) {
+		t.lock.Lock()
+		t.release()
+		t.lock.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		return t.wrap(conn, protocol)
+	}
+
+	session := tunnelSession{Session: mux.Client(conn), protocol: protocol}
+
+	t.lock.Lock()
+	t.sessions = append(t.sessions, session)
+	t.release()
+	t.lock.Unlock()
+
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	return t.wrap(stream, protocol)
+}
+
+// wrap negotiates codecs with servers that support it, and falls back to brotli otherwise
+func (t *Tunnel) wrap(conn net.Conn, protocol string) (ret *codec.Conn, err error) {
+	if protocol == TunnelProtocol {
+		ret, err = codec.Client(conn, t.codecs)
+	} else {
+		ret, err = codec.Legacy(conn)
+	}
+
+	if err != nil {
+		conn.Close()
+	}
+	return
+}
+
+// dial connects to the server, returning the protocol agreed on by ALPN, or by the WebSocket subprotocol
+func (t *Tunnel) dial(ctx context.Context) (net.Conn, string, error) {
+	conn, err := t.dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tlsConn := tls.Client(conn, t.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		tlsFailures.With(lib.TlsFailureReason(err)).Inc()
+		conn.Close()
+		return nil, "", err
+	}
+
+	if t.webSocket == nil {
+		return tlsConn, tlsConn.ConnectionState().NegotiatedProtocol, nil
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		tlsConn.SetDeadline(deadline)
+	}
+
+	ws, err := websocket.Client(tlsConn, t.webSocket.Host, t.webSocket.RequestURI(), []string{TunnelProtocol, LegacyTunnelProtocol})
+	if err != nil {
+		tlsConn.Close()
+		return nil, "", err
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+	return ws, ws.Protocol(), nil
+}
+
+// probe connects to the server the way a new session would, and hangs up
+func (t *Tunnel) probe(ctx context.Context) error {
+	if t.quic != nil {
+		conn, err := t.dialQuic(ctx)
+		if err != nil {
+			return err
+		}
+		return conn.CloseWithError(lib.QuicNoError, "")
+	}
+
+	conn, _, err := t.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// release frees the slot reserved by a dial that ended, waking up the streams waiting for it. t.lock is held.
+func (t *Tunnel) release() {
+	t.pending--
+	close(t.dialed)
+	t.dialed = make(chan struct{})
+}
+
+// retire takes session out of the pool, leaving its streams to finish before it is closed
+func (t *Tunnel) retire(session *mux.Session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sessions = slices.DeleteFunc(t.sessions, func(s tunnelSession) bool {
+		return s.Session == session
+	})
+
+	session.CloseIdle()
+}
+
+// session returns the least loaded live session.
+// It returns nil and reserves a slot if the pool has room for another connection, or nil and a channel closed
+// once a pending dial ends if it has not.
+func (t *Tunnel) session() (ret tunnelSession, reserved bool, dialed chan struct{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// sessions of a server going away are left to finish their streams
+	live := t.sessions[:0]
+	for _, s := range t.sessions {
+		if !s.IsClosed() && !s.GoingAway() {
+			live = append(live, s)
+		} else {
+			s.CloseIdle()
+		}
+	}
+	clear(t.sessions[len(live):])
+	t.sessions = live
+
+	if len(t.sessions)+t.pending < t.poolSize {
+		t.pending++
+		return ret, true, nil
+	}
+
+	for _, s := range t.sessions {
+		if ret.Session == nil || s.NumStreams() < ret.NumStreams() {
+			ret = s
+		}
+	}
+
+	if ret.Session == nil {
+		dialed = t.dialed
+	}
+	return
+}
+
+// NumSessions counts live multiplexed connections, QUIC ones included
+func (t *Tunnel) NumSessions() int {
+	if t.quic != nil {
+		t.quic.lock.Lock()
+		defer t.quic.lock.Unlock()
+
+		if t.quic.live() != nil {
+			return 1
+		}
+		return 0
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ret := 0
+	for _, s := range t.sessions {
+		if !s.IsClosed() && !s.GoingAway() {
+			ret++
+		}
+	}
+	return ret
+}
+
+func (t *Tunnel) Close() {
+	if t.quic != nil {
+		t.quic.lock.Lock()
+		if conn := t.quic.live(); conn != nil {
+			conn.CloseWithError(lib.QuicNoError, "")
+		}
+		t.quic.conn = nil
+		t.quic.lock.Unlock()
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, s := range t.sessions {
+		s.Close()
+	}
+	t.sessions = nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"lib/assert"
+	"lib/codec"
+	"lib/mux"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// listenTunnel serves multiplexed sessions over TLS, sending each one to sessions
+func listenTunnel(t *testing.T, sessions chan<- *mux.Session) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Null(t, err)
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, &key.PublicKey, key)
+	assert.Null(t, err)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{TunnelProtocol},
+	})
+	assert.Null(t, err)
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sessions <- mux.Server(conn)
+		}
+	}()
+
+	return l
+}
+
+func TestTunnel_GoAway(t *testing.T) {
+	sessions := make(chan *mux.Session, 2)
+	l := listenTunnel(t, sessions)
+
+	tunnel := NewTunnel(l.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{TunnelProtocol}},
+		&net.Dialer{}, 1, []codec.ID{codec.Identity}, &url.URL{Scheme: "tls"})
+	defer tunnel.Close()
+
+	stream, err := tunnel.Dial(context.Background())
+	assert.Null(t, err)
+
+	server := <-sessions
+	defer server.Close()
+	assert.Null(t, server.GoAway())
+
+	for deadline := time.Now().Add(time.Second * 5); tunnel.NumSessions() > 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 0, tunnel.NumSessions())
+
+	// the next stream goes to a new session
+	other, err := tunnel.Dial(context.Background())
+	assert.Null(t, err)
+	defer other.Close()
+	defer (<-sessions).Close()
+
+	// the retired session carries on with its stream
+	select {
+	case <-server.Closed():
+		t.Fatal("session closed with a stream open")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	// and is closed once done with it
+	stream.Close()
+
+	select {
+	case <-server.Closed():
+	case <-time.After(time.Second * 5):
+		t.Fatal("retired session left open")
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"lib"
+	"lib/codec"
+	"lib/handshake"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type hostAddr string
+
+func (a hostAddr) Network() string {
+	return "udp"
+}
+
+func (a hostAddr) String() string {
+	return string(a)
+}
+
+// TunnelPacketConn relays datagrams to a single destination through the tunnel, each with a 2 byte length prefix.
+// Read and Write preserve message boundaries. It implements net.PacketConn, so the Go resolver treats it as UDP.
+type TunnelPacketConn struct {
+	*codec.Conn
+	addr hostAddr
+
+	readLock sync.Mutex
+	// reads the reply of the server with the first datagram, so sending does not wait for it
+	reply     legacyReply
+	writeLock sync.Mutex
+}
+
+func DialUdp(ctx context.Context, tunnel *Upstreams, addr string) (*TunnelPacketConn, error) {
+	conn, err := tunnel.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &TunnelPacketConn{
+		Conn:  conn,
+		addr:  hostAddr(addr),
+		reply: legacyReply{conn: conn},
+	}
+
+	req := handshake.Request{Method: handshake.MethodUdp, Addr: addr, Version: handshake.Version}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// DialPacket opens a UDP association to addr, through the tunnel if there is one
+func DialPacket(ctx context.Context, addr string, tunnel *Upstreams, dialer *net.Dialer) (net.Conn, error) {
+	if tunnel != nil {
+		return DialUdp(ctx, tunnel, addr)
+	}
+
+	return dialer.DialContext(ctx, "udp", addr)
+}
+
+func (c *TunnelPacketConn) Read(b []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	return lib.ReadDatagram(&c.reply, b)
+}
+
+func (c *TunnelPacketConn) Write(b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if err = lib.WriteDatagram(c.Conn, b); err != nil {
+		return
+	}
+
+	if err = c.Conn.Flush(); err != nil {
+		return
+	}
+
+	return len(b), nil
+}
+
+func (c *TunnelPacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, err = c.Read(b)
+	return n, c.addr, err
+}
+
+func (c *TunnelPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func (c *TunnelPacketConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// maxQueuedDatagrams to a destination are kept while it is dialed, later ones are dropped
+const maxQueuedDatagrams = 16
+
+// udpPeer is the association to one destination. Datagrams wait in queue until conn is dialed.
+type udpPeer struct {
+	conn  net.Conn
+	queue [][]byte
+}
+
+// UdpRelay serves a SOCKS5 UDP association. Datagrams to each destination are relayed on their own association.
+type UdpRelay struct {
+	conn   *net.UDPConn
+	tunnel *Upstreams
+	router *Router
+	dialer *net.Dialer
+	log    lib.Logger
+
+	lock sync.Mutex
+	// datagrams are only accepted from its IP, and its port once known
+	client *net.UDPAddr
+	peers  map[string]*udpPeer
+	closed bool
+}
+
+// NewUdpRelay relays datagrams of client, the address of the control connection with the port given in UDP
+// ASSOCIATE. A zero port is taken from the first datagram.
+func NewUdpRelay(conn *net.UDPConn, client *net.UDPAddr, tunnel *Upstreams, router *Router, dialer *net.Dialer, log lib.Logger) *UdpRelay {
+	return &UdpRelay{
+		conn:   conn,
+		client: client,
+		tunnel: tunnel,
+		router: router,
+		dialer: dialer,
+		log:    log,
+		peers:  map[string]*udpPeer{},
+	}
+}
+
+func (r *UdpRelay) Serve() {
+	buf := make([]byte, lib.MaxDatagramSize)
+
+	for {
+		n, addr, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		r.lock.Lock()
+		if r.client.Port == 0 && addr.IP.Equal(r.client.IP) {
+			r.client = addr
+		}
+		client := r.client
+		r.lock.Unlock()
+
+		if !addr.IP.Equal(client.IP) || addr.Port != client.Port {
+			continue
+		}
+
+		host, headerLen, err := ParseSocksUdpHeader(buf[:n])
+		if err != nil {
+			r.log.Debug().Value("error", err.Error()).Msg("dropped socks datagram")
+			continue
+		}
+
+		r.send(host, buf[:headerLen], buf[headerLen:n])
+	}
+}
+
+// send writes payload to the association of host, dialing it in the background first if there is none
+func (r *UdpRelay) send(host string, header []byte, payload []byte) {
+	r.lock.Lock()
+
+	if r.closed {
+		r.lock.Unlock()
+		return
+	}
+
+	peer, ok := r.peers[host]
+	if !ok {
+		peer = &udpPeer{}
+		r.peers[host] = peer
+		go r.dial(host, peer, bytes.Clone(header), r.client)
+	}
+
+	conn := peer.conn
+	if conn == nil {
+		if len(peer.queue) < maxQueuedDatagrams {
+			peer.queue = append(peer.queue, bytes.Clone(payload))
+		}
+		r.lock.Unlock()
+		return
+	}
+
+	r.lock.Unlock()
+
+	if _, err := conn.Write(payload); err != nil {
+		r.log.Err().Value("url", host).Value("error", err.Error()).Msg("failed to relay datagram")
+	}
+}
+
+// dial connects peer, sends what was queued meanwhile, then relays replies until the association ends
+func (r *UdpRelay) dial(host string, peer *udpPeer, header []byte, client *net.UDPAddr) {
+	conn, err := r.connect(host)
+
+	r.lock.Lock()
+	if err != nil || r.closed {
+		if r.peers[host] == peer {
+			delete(r.peers, host)
+		}
+		r.lock.Unlock()
+
+		if err != nil {
+			r.log.Err().Value("url", host).Value("error", err.Error()).Msg("failed to connect to peer")
+		} else {
+			conn.Close()
+		}
+		return
+	}
+
+	peer.conn = conn
+	queue := peer.queue
+	peer.queue = nil
+	r.lock.Unlock()
+
+	for _, b := range queue {
+		if _, err := conn.Write(b); err != nil {
+			r.log.Err().Value("url", host).Value("error", err.Error()).Msg("failed to relay datagram")
+		}
+	}
+
+	r.reply(host, peer, header, client)
+}
+
+func (r *UdpRelay) connect(host string) (net.Conn, error) {
+	via, ok := r.router.Via(context.Background(), host, r.tunnel, r.log.With().Value("url", host).Logger())
+	if !ok {
+		countConnection("udp", ErrRouteBlocked)
+		return nil, ErrRouteBlocked
+	}
+
+	start := time.Now()
+	conn, err := DialPacket(context.Background(), host, via, r.dialer)
+	countConnection("udp", err)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dialSeconds.With(routeName(via)).Observe(time.Since(start).Seconds())
+	return conn, nil
+}
+
+// reply relays datagrams from peer back to the client, prefixed with the socks header of the peer
+func (r *UdpRelay) reply(host string, peer *udpPeer, header []byte, client *net.UDPAddr) {
+	buf := make([]byte, len(header)+lib.MaxDatagramSize)
+	copy(buf, header)
+
+	for {
+		n, err := peer.conn.Read(buf[len(header):])
+		if err != nil {
+			break
+		}
+
+		if _, err := r.conn.WriteToUDP(buf[:len(header)+n], client); err != nil {
+			break
+		}
+	}
+
+	r.lock.Lock()
+	if r.peers[host] == peer {
+		delete(r.peers, host)
+	}
+	r.lock.Unlock()
+
+	peer.conn.Close()
+}
+
+func (r *UdpRelay) Close() {
+	r.conn.Close()
+
+	r.lock.Lock()
+	r.closed = true
+	peers := r.peers
+	r.peers = map[string]*udpPeer{}
+	r.lock.Unlock()
+
+	for _, peer := range peers {
+		if peer.conn != nil {
+			peer.conn.Close()
+		}
+	}
+}
+
+// HandleSocksUdp serves UDP ASSOCIATE. addr is the address the client said it sends datagrams from.
+func HandleSocksUdp(conn net.Conn, addr string, tunnel *Upstreams, router *Router, dialer *net.Dialer, logger lib.Logger) {
+	defer conn.Close()
+
+	// only the host of the control connection may use the association, from the port it gave if any
+	client := &net.UDPAddr{IP: conn.RemoteAddr().(*net.TCPAddr).IP}
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		client.Port, _ = strconv.Atoi(p)
+	}
+
+	laddr := conn.LocalAddr().(*net.TCPAddr)
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP})
+
+	if err != nil {
+		WriteSocksReply(conn, socksGeneralFailure, nil)
+		logger.Err().Value("error", err.Error()).Msg("failed to listen udp")
+		return
+	}
+
+	log := logger.With().Value("url", udp.LocalAddr().String()).Value("method", "SOCKS UDP").Logger()
+	relay := NewUdpRelay(udp, client, tunnel, router, dialer, log)
+	defer relay.Close()
+
+	if err := WriteSocksReply(conn, socksSucceeded, udp.LocalAddr()); err != nil {
+		log.Info().Value("error", err.Error()).Msg("failed to write socks reply")
+		return
+	}
+
+	connectionsActive.With("udp").Inc()
+	defer connectionsActive.With("udp").Dec()
+
+	log.Info().Msg("associated")
+	go relay.Serve()
+
+	// the association lasts as long as the control connection
+	io.Copy(io.Discard, conn)
+	log.Info().Msg("closed association")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"lib"
+	"lib/assert"
+	"lib/structured_logger"
+	"net"
+	"testing"
+	"time"
+)
+
+func listenUdp(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Null(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+// socksDatagram is payload to addr with the SOCKS5 UDP header
+func socksDatagram(addr *net.UDPAddr, payload string) []byte {
+	b := append([]byte{0, 0, 0, socksAtypIPv4}, addr.IP.To4()...)
+	b = binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+	return append(b, payload...)
+}
+
+// receive returns the payload of the next datagram of conn, or "" if none comes soon
+func receive(conn *net.UDPConn) string {
+	buf := make([]byte, lib.MaxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+
+	n, err := conn.Read(buf)
+	if err != nil || n < 10 {
+		return ""
+	}
+	return string(buf[10:n])
+}
+
+func TestUdpRelay_Client(t *testing.T) {
+	echo := listenUdp(t)
+	go func() {
+		buf := make([]byte, lib.MaxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	target := echo.LocalAddr().(*net.UDPAddr)
+
+	client := listenUdp(t)
+	other := listenUdp(t)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	for _, allowed := range []*net.UDPAddr{
+		// the port given in UDP ASSOCIATE
+		{IP: clientAddr.IP, Port: clientAddr.Port},
+		// the port of the first datagram from the host of the control connection
+		{IP: clientAddr.IP},
+	} {
+		relayConn := listenUdp(t)
+		relay := NewUdpRelay(relayConn, allowed, nil, DefaultRouter, &net.Dialer{}, structured_logger.NewLogger("error"))
+		go relay.Serve()
+
+		if allowed.Port != 0 {
+			other.WriteToUDP(socksDatagram(target, "intruder"), relayConn.LocalAddr().(*net.UDPAddr))
+			assert.Equal(t, "", receive(other))
+		}
+
+		// queued while the destination is dialed
+		for _, s := range []string{"a", "b", "c"} {
+			client.WriteToUDP(socksDatagram(target, s), relayConn.LocalAddr().(*net.UDPAddr))
+		}
+
+		got := map[string]bool{}
+		for range 3 {
+			got[receive(client)] = true
+		}
+		assert.Equal(t, true, got["a"] && got["b"] && got["c"])
+
+		other.WriteToUDP(socksDatagram(target, "intruder"), relayConn.LocalAddr().(*net.UDPAddr))
+		assert.Equal(t, "", receive(other))
+
+		relay.Close()
+	}
+
+	// another host
+	relayConn := listenUdp(t)
+	relay := NewUdpRelay(relayConn, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}, nil, DefaultRouter, &net.Dialer{}, structured_logger.NewLogger("error"))
+	defer relay.Close()
+	go relay.Serve()
+
+	client.WriteToUDP(socksDatagram(target, "a"), relayConn.LocalAddr().(*net.UDPAddr))
+	assert.Equal(t, "", receive(client))
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"lib"
+	"lib/codec"
+	"lib/handshake"
+	"lib/http1"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// Policies decide the order in which upstreams are tried
+const (
+	PolicyPriority   = "priority"
+	PolicyRoundRobin = "round-robin"
+	PolicyRtt        = "rtt"
+)
+
+// connectTimeout bounds waiting for the server to reply to a tunnel request
+const connectTimeout = time.Second * 15
+
+var ErrNoUpstream = errors.New("no upstream configured")
+var ErrTunnelUnavailable = errors.New("no tunnel server reachable")
+var ErrUpstreamPolicy = errors.New("unknown upstream policy")
+
+type Upstream struct {
+	*Tunnel
+	Url     string
+	healthy atomic.Bool
+	// smoothed TLS handshake time in nanoseconds, 0 until measured
+	rtt atomic.Int64
+}
+
+func NewUpstream(url string, tunnel *Tunnel) *Upstream {
+	ret := &Upstream{
+		Tunnel: tunnel,
+		Url:    url,
+	}
+	ret.healthy.Store(true)
+	upstreamUp.With(url).Set(1)
+	return ret
+}
+
+func (u *Upstream) setHealthy(healthy bool, log lib.Logger) {
+	if u.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	if healthy {
+		upstreamUp.With(u.Url).Set(1)
+		log.Info().Value("upstream", u.Url).Msg("upstream is up")
+	} else {
+		upstreamUp.With(u.Url).Set(0)
+		log.Warn().Value("upstream", u.Url).Msg("upstream is down")
+	}
+}
+
+// Upstreams fails over between tunnel servers
+type Upstreams struct {
+	upstreams []*Upstream
+	policy    string
+	next      atomic.Uint32
+	log       lib.Logger
+}
+
+func NewUpstreams(upstreams []*Upstream, policy string, log lib.Logger) (*Upstreams, error) {
+	if len(upstreams) == 0 {
+		return nil, ErrNoUpstream
+	}
+
+	switch policy {
+	case PolicyPriority, PolicyRoundRobin, PolicyRtt:
+	default:
+		return nil, ErrUpstreamPolicy
+	}
+
+	return &Upstreams{
+		upstreams: upstreams,
+		policy:    policy,
+		log:       log,
+	}, nil
+}
+
+// order returns healthy upstreams in the order of the policy, followed by the rest as a last resort
+func (u *Upstreams) order() []*Upstream {
+	healthy := make([]*Upstream, 0, len(u.upstreams))
+	var down []*Upstream
+
+	for _, up := range u.upstreams {
+		if up.healthy.Load() {
+			healthy = append(healthy, up)
+		} else {
+			down = append(down, up)
+		}
+	}
+
+	switch u.policy {
+	case PolicyRoundRobin:
+		if len(healthy) > 1 {
+			i := int(u.next.Add(1) % uint32(len(healthy)))
+			healthy = append(healthy[i:], healthy[:i]...)
+		}
+	case PolicyRtt:
+		slices.SortStableFunc(healthy, func(a, b *Upstream) int {
+			return cmp.Compare(rttOrMax(a), rttOrMax(b))
+		})
+	}
+
+	return append(healthy, down...)
+}
+
+// rttOrMax sorts upstreams not measured yet last
+func rttOrMax(u *Upstream) int64 {
+	if rtt := u.rtt.Load(); rtt > 0 {
+		return rtt
+	}
+	return int64(time.Hour)
+}
+
+// Dial opens a stream on the first upstream that accepts it
+func (u *Upstreams) Dial(ctx context.Context) (conn *codec.Conn, err error) {
+	for _, up := range u.order() {
+		if conn, err = up.Dial(ctx); err == nil {
+			return
+		}
+
+		u.log.Warn().Value("upstream", up.Url).Value("error", err.Error()).Msg("failed to dial upstream")
+		up.setHealthy(false, u.log)
+	}
+
+	return
+}
+
+// Connect sends req, followed by early data, on a new stream and waits for the server to reply.
+// Requests failing before the first byte of reply are retried on the next upstream, as are those the server refuses
+// with 503 for being over the limits. Other refusals are returned as *http1.ProxyStatus.
+// Legacy servers do not flush their reply until the destination sends data, so it is left to replyReader on their streams.
+func (u *Upstreams) Connect(ctx context.Context, req handshake.Request, early ...[]byte) (conn *codec.Conn, reply handshake.Reply, err error) {
+	for _, up := range u.order() {
+		attemptCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+
+		if conn, err = up.Dial(attemptCtx); err == nil {
+			if reply, err = connect(attemptCtx, conn, req, early); err == nil {
+				cancel()
+				up.setHealthy(true, u.log)
+				return
+			}
+
+			conn.Close()
+		}
+		cancel()
+
+		var status *http1.ProxyStatus
+		if errors.As(err, &status) {
+			if status.StatusCode != http.StatusServiceUnavailable {
+				return nil, reply, err
+			}
+
+			u.log.Warn().Value("upstream", up.Url).Value("error", err.Error()).Msg("upstream refused stream")
+			continue
+		}
+
+		if errors.Is(err, handshake.ErrBadReply) {
+			return nil, reply, err
+		}
+
+		u.log.Warn().Value("upstream", up.Url).Value("error", err.Error()).Msg("failed to connect through upstream")
+		up.setHealthy(false, u.log)
+	}
+
+	if _, ok := err.(*http1.ProxyStatus); ok {
+		return nil, reply, err
+	}
+
+	return nil, reply, fmt.Errorf("%w: %w", ErrTunnelUnavailable, err)
+}
+
+func connect(ctx context.Context, conn *codec.Conn, req handshake.Request, early [][]byte) (reply handshake.Reply, err error) {
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return
+	}
+
+	for _, b := range early {
+		if _, err = conn.Write(b); err != nil {
+			return
+		}
+	}
+
+	if err = conn.Flush(); err != nil {
+		return
+	}
+
+	if !conn.Negotiated() {
+		return
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	if reply, err = handshake.ReadReply(conn); err != nil {
+		return
+	}
+
+	return reply, reply.Err()
+}
+
+// legacyReply reads the reply of the server with the first Read. Legacy servers send it along with the first data
+// of the destination.
+type legacyReply struct {
+	conn *codec.Conn
+	read bool
+}
+
+func (r *legacyReply) Read(b []byte) (int, error) {
+	if !r.read {
+		reply, err := handshake.ReadReply(r.conn)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := reply.Err(); err != nil {
+			return 0, err
+		}
+
+		r.read = true
+	}
+
+	return r.conn.Read(b)
+}
+
+// replyReader reads what the destination sends on a stream returned by Connect, past the reply of the server
+func replyReader(conn *codec.Conn) io.Reader {
+	if conn.Negotiated() {
+		return conn
+	}
+	return &legacyReply{conn: conn}
+}
+
+// check measures the TLS handshake time of each upstream
+func (u *Upstreams) check(ctx context.Context) {
+	for _, up := range u.upstreams {
+		dialCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+		start := time.Now()
+		err := up.probe(dialCtx)
+		cancel()
+
+		if err != nil {
+			u.log.Debug().Value("upstream", up.Url).Value("error", err.Error()).Msg("health check failed")
+			up.setHealthy(false, u.log)
+			continue
+		}
+
+		sample := int64(time.Since(start))
+		if rtt := up.rtt.Load(); rtt > 0 {
+			sample = rtt - rtt/8 + sample/8
+		}
+		up.rtt.Store(sample)
+		upstreamRtt.With(up.Url).Set(time.Duration(sample).Seconds())
+
+		up.setHealthy(true, u.log)
+	}
+}
+
+// HealthCheck checks upstreams every interval until ctx is done
+func (u *Upstreams) HealthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		u.check(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetResolver changes how the server addresses are resolved, e.g. when DNS itself goes through the tunnel. Only
+// before anything dials them, health checks included.
+func (u *Upstreams) SetResolver(resolver *net.Resolver) {
+	for _, up := range u.upstreams {
+		up.SetResolver(resolver)
+	}
+}
+
+func (u *Upstreams) Close() {
+	for _, up := range u.upstreams {
+		up.Close()
+	}
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrNotCertAuthority = errors.New("certificate is not a CA")
+
+const (
+	// how long minted certificates are valid
+	leafValidity = time.Hour * 24 * 7
+	// minted certificates are replaced this long before they expire
+	leafRenewal = time.Hour
+)
+
+// CertAuthority mints certificates for any host, signed by a CA that clients trust, e.g. to intercept their TLS.
+// Minted certificates are cached.
+type CertAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// shared by all minted certificates, minting is then only signing
+	leafKey *ecdsa.PrivateKey
+
+	lock  sync.Mutex
+	cache *LRU[string, *tls.Certificate]
+}
+
+// NewCertAuthority takes the PEM encoded certificate and key of the CA, and keeps up to size minted certificates
+func NewCertAuthority(certPem []byte, keyPem []byte, size int) (*CertAuthority, error) {
+	pair, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if !cert.IsCA {
+		return nil, ErrNotCertAuthority
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CertAuthority{
+		cert:    cert,
+		key:     pair.PrivateKey.(crypto.Signer),
+		leafKey: leafKey,
+		cache:   NewLRU[string, *tls.Certificate](size, size),
+	}, nil
+}
+
+func LoadCertAuthority(certFile string, keyFile string, size int) (*CertAuthority, error) {
+	certPem, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCertAuthority(certPem, keyPem, size)
+}
+
+// Certificate returns a certificate for host, a name or an IP address
+func (ca *CertAuthority) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	ca.lock.Lock()
+	cert, ok := ca.cache.Get(host)
+	ca.lock.Unlock()
+
+	if ok && time.Until(cert.Leaf.NotAfter) > leafRenewal {
+		return cert, nil
+	}
+
+	cert, err := ca.mint(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ca.lock.Lock()
+	ca.cache.Set(host, cert)
+	ca.lock.Unlock()
+
+	return cert, nil
+}
+
+func (ca *CertAuthority) mint(host string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		// clocks of clients may be behind
+		NotBefore:   now.Add(-leafRenewal),
+		NotAfter:    now.Add(leafValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &ca.leafKey.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,70 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"lib/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCa makes the PEM encoded certificate and key of a CA, or of a leaf if isCa is false
+func testCa(t *testing.T, isCa bool) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Null(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24 * 365),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCa,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Null(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Null(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestCertAuthority(t *testing.T) {
+	certPem, keyPem := testCa(t, true)
+	ca, err := NewCertAuthority(certPem, keyPem, 2)
+	assert.Null(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPem)
+
+	for _, host := range []string{"example.com", "127.0.0.1", "::1"} {
+		cert, err := ca.Certificate(host)
+		assert.Null(t, err)
+
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		assert.Null(t, err)
+	}
+
+	// cached, by the name in any case
+	a, _ := ca.Certificate("example.org")
+	b, _ := ca.Certificate("Example.org.")
+	assert.Equal(t, true, a == b)
+
+	_, err = a.Leaf.Verify(x509.VerifyOptions{DNSName: "other.org", Roots: roots})
+	assert.NotNull(t, err)
+}
+
+func TestCertAuthority_NotCa(t *testing.T) {
+	certPem, keyPem := testCa(t, false)
+	_, err := NewCertAuthority(certPem, keyPem, 2)
+	assert.Equal(t, ErrNotCertAuthority, err)
+}
@@ -0,0 +1,211 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+	"lib"
+)
+
+// An adaptive stream starts with the compressed stream cut into frames with a 2 byte length prefix.
+// A zero length frame ends the compressed part. Everything after it is passed through as is.
+//
+//	| length (2) | compressed (length) | ... | 0 (2) | raw ... |
+
+// SampleSize is the number of bytes compressed before the ratio is checked
+var SampleSize int64 = 64 * 1024
+
+// MaxRatio is the compressed to raw size ratio above which a stream falls back to passthrough
+var MaxRatio = 0.9
+
+const maxFrameSize = 65535
+
+type frameWriter struct {
+	dst io.Writer
+	n   int64
+}
+
+func (w *frameWriter) Write(b []byte) (n int, err error) {
+	var header [2]byte
+
+	for len(b) > 0 {
+		size := min(len(b), maxFrameSize)
+		binary.BigEndian.PutUint16(header[:], uint16(size))
+
+		if err = lib.WriteAll(w.dst, header[:], b[:size]); err != nil {
+			return
+		}
+
+		n += size
+		w.n += int64(size)
+		b = b[size:]
+	}
+
+	return
+}
+
+func (w *frameWriter) end() error {
+	_, err := w.dst.Write([]byte{0, 0})
+	return err
+}
+
+type adaptiveWriter struct {
+	dst    io.Writer
+	frames frameWriter
+	// nil once the stream passes through
+	cw      Writer
+	written int64
+	sampled bool
+}
+
+func newAdaptiveWriter(id ID, w io.Writer) *adaptiveWriter {
+	ret := &adaptiveWriter{
+		dst:    w,
+		frames: frameWriter{dst: w},
+	}
+	ret.cw, _ = NewWriter(id, &ret.frames)
+	return ret
+}
+
+func (w *adaptiveWriter) Write(b []byte) (n int, err error) {
+	if w.cw == nil {
+		return w.dst.Write(b)
+	}
+
+	if n, err = w.cw.Write(b); err != nil {
+		return
+	}
+
+	w.written += int64(n)
+
+	if w.sampled || w.written < SampleSize {
+		return
+	}
+
+	w.sampled = true
+
+	if err = w.cw.Flush(); err != nil {
+		return
+	}
+
+	if float64(w.frames.n) > float64(w.written)*MaxRatio {
+		err = w.passthrough()
+	}
+
+	return
+}
+
+// passthrough ends the compressed part of the stream
+func (w *adaptiveWriter) passthrough() error {
+	cw := w.cw
+	w.cw = nil
+
+	if err := cw.Close(); err != nil {
+		return err
+	}
+
+	return w.frames.end()
+}
+
+func (w *adaptiveWriter) Flush() error {
+	if w.cw == nil {
+		return nil
+	}
+
+	return w.cw.Flush()
+}
+
+func (w *adaptiveWriter) Close() error {
+	if w.cw == nil {
+		return nil
+	}
+
+	return w.passthrough()
+}
+
+type frameReader struct {
+	src       io.Reader
+	remaining int
+	ended     bool
+}
+
+func (r *frameReader) Read(b []byte) (n int, err error) {
+	for r.remaining == 0 {
+		if r.ended {
+			return 0, io.EOF
+		}
+
+		var header [2]byte
+		if _, err = io.ReadFull(r.src, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+
+		r.remaining = int(binary.BigEndian.Uint16(header[:]))
+		r.ended = r.remaining == 0
+	}
+
+	n, err = r.src.Read(b[:min(len(b), r.remaining)])
+	r.remaining -= n
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+type adaptiveReader struct {
+	src    io.Reader
+	frames frameReader
+	id     ID
+	// nil once the stream passes through
+	cr Reader
+}
+
+func newAdaptiveReader(id ID, r io.Reader) *adaptiveReader {
+	return &adaptiveReader{
+		src:    r,
+		frames: frameReader{src: r},
+		id:     id,
+	}
+}
+
+func (r *adaptiveReader) Read(b []byte) (n int, err error) {
+	if r.frames.ended && r.cr == nil {
+		return r.src.Read(b)
+	}
+
+	if r.cr == nil {
+		if r.cr, err = NewReader(r.id, &r.frames); err != nil {
+			return
+		}
+	}
+
+	n, err = r.cr.Read(b)
+	if err != io.EOF {
+		return
+	}
+
+	// the compressed part ended. Skip to the end marker in case the decoder stopped short of it.
+	if _, err = io.Copy(io.Discard, &r.frames); err != nil {
+		return
+	}
+
+	r.cr.Close()
+	r.cr = nil
+
+	if n > 0 {
+		return n, nil
+	}
+
+	return r.src.Read(b)
+}
+
+func (r *adaptiveReader) Close() error {
+	if r.cr != nil {
+		r.cr.Close()
+		r.cr = nil
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ID identifies the compression of one direction of a tunnel stream on the wire
+type ID byte
+
+const (
+	Identity ID = iota
+	Brotli
+	Zstd
+)
+
+// Adaptive is combined with a compressing codec. The stream falls back to passthrough if the sampled ratio is poor.
+const Adaptive ID = 0x80
+
+var ErrUnknownCodec = errors.New("unknown codec")
+
+var names = map[ID]string{
+	Identity: "identity",
+	Brotli:   "brotli",
+	Zstd:     "zstd",
+}
+
+func (id ID) base() ID {
+	return id &^ Adaptive
+}
+
+func (id ID) Valid() bool {
+	_, ok := names[id.base()]
+	return ok && id != Identity|Adaptive
+}
+
+func (id ID) String() string {
+	if !id.Valid() {
+		return "unknown"
+	}
+
+	if id&Adaptive != 0 {
+		return "adaptive-" + names[id.base()]
+	}
+
+	return names[id]
+}
+
+// Parse accepts a codec name, e.g. "zstd", or "adaptive-zstd". "adaptive" alone compresses with brotli.
+func Parse(name string) (ID, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if name == "adaptive" {
+		return Brotli | Adaptive, nil
+	}
+
+	adaptive := strings.HasPrefix(name, "adaptive-")
+	name = strings.TrimPrefix(name, "adaptive-")
+
+	for id, n := range names {
+		if n != name {
+			continue
+		}
+
+		if adaptive {
+			id |= Adaptive
+		}
+
+		if !id.Valid() {
+			break
+		}
+		return id, nil
+	}
+
+	return 0, ErrUnknownCodec
+}
+
+// ParseList parses a comma separated list of codec names
+func ParseList(s string) (ret []ID, err error) {
+	for _, name := range strings.Split(s, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+
+		id, err := Parse(name)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, id)
+	}
+
+	return
+}
+
+// Writer compresses into an underlying writer.
+// Close ends the compressed stream and releases the writer, but leaves the underlying writer open.
+type Writer interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// Reader decompresses from an underlying reader. Close releases the reader.
+type Reader interface {
+	io.Reader
+	Close() error
+}
+
+var brotliWriters = sync.Pool{
+	New: func() any {
+		return brotli.NewWriter(nil)
+	},
+}
+
+var brotliReaders = sync.Pool{
+	New: func() any {
+		return brotli.NewReader(nil)
+	},
+}
+
+var zstdWriters = sync.Pool{
+	New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return w
+	},
+}
+
+var zstdReaders = sync.Pool{
+	New: func() any {
+		// a single goroutine decodes in sync mode, without background workers
+		r, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		return r
+	},
+}
+
+type brotliWriter struct {
+	*brotli.Writer
+}
+
+func (w brotliWriter) Close() error {
+	err := w.Writer.Close()
+	brotliWriters.Put(w.Writer)
+	return err
+}
+
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+func (w zstdWriter) Close() error {
+	err := w.Encoder.Close()
+	zstdWriters.Put(w.Encoder)
+	return err
+}
+
+type identityWriter struct {
+	io.Writer
+}
+
+func (w identityWriter) Flush() error {
+	return nil
+}
+
+func (w identityWriter) Close() error {
+	return nil
+}
+
+type brotliReader struct {
+	*brotli.Reader
+}
+
+func (r brotliReader) Close() error {
+	brotliReaders.Put(r.Reader)
+	return nil
+}
+
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r zstdReader) Close() error {
+	// drops the reference to the underlying reader
+	r.Decoder.Reset(nil)
+	zstdReaders.Put(r.Decoder)
+	return nil
+}
+
+type identityReader struct {
+	io.Reader
+}
+
+func (r identityReader) Close() error {
+	return nil
+}
+
+func NewWriter(id ID, w io.Writer) (Writer, error) {
+	if !id.Valid() {
+		return nil, ErrUnknownCodec
+	}
+
+	if id&Adaptive != 0 {
+		return newAdaptiveWriter(id.base(), w), nil
+	}
+
+	switch id {
+	case Brotli:
+		cw := brotliWriters.Get().(*brotli.Writer)
+		cw.Reset(w)
+		return brotliWriter{cw}, nil
+	case Zstd:
+		cw := zstdWriters.Get().(*zstd.Encoder)
+		cw.Reset(w)
+		return zstdWriter{cw}, nil
+	}
+
+	return identityWriter{w}, nil
+}
+
+func NewReader(id ID, r io.Reader) (Reader, error) {
+	if !id.Valid() {
+		return nil, ErrUnknownCodec
+	}
+
+	if id&Adaptive != 0 {
+		return newAdaptiveReader(id.base(), r), nil
+	}
+
+	switch id {
+	case Brotli:
+		cr := brotliReaders.Get().(*brotli.Reader)
+		if err := cr.Reset(r); err != nil {
+			brotliReaders.Put(cr)
+			return nil, err
+		}
+		return brotliReader{cr}, nil
+	case Zstd:
+		cr := zstdReaders.Get().(*zstd.Decoder)
+		if err := cr.Reset(r); err != nil {
+			zstdReaders.Put(cr)
+			return nil, err
+		}
+		return zstdReader{cr}, nil
+	}
+
+	return identityReader{r}, nil
+}
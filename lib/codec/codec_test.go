@@ -0,0 +1,244 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"lib/assert"
+	"net"
+	"testing"
+)
+
+func roundTrip(t *testing.T, id ID, data []byte) (wire int) {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	w, err := NewWriter(id, &buf)
+	assert.Equal(t, nil, err)
+
+	// written in chunks with flushes in between, like a copy loop does
+	for b := data; len(b) > 0; {
+		n := min(len(b), 10000)
+		_, err = w.Write(b[:n])
+		assert.Equal(t, nil, err)
+		assert.Equal(t, nil, w.Flush())
+		b = b[n:]
+	}
+	assert.Equal(t, nil, w.Close())
+
+	wire = buf.Len()
+
+	// the reader must not depend on the underlying reader being a bytes.Buffer
+	r, err := NewReader(id, io.MultiReader(&buf))
+	assert.Equal(t, nil, err)
+	defer r.Close()
+
+	got, err := io.ReadAll(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, bytes.Equal(data, got))
+	return
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 5000)
+
+	for _, id := range []ID{Identity, Brotli, Zstd, Brotli | Adaptive, Zstd | Adaptive} {
+		wire := roundTrip(t, id, data)
+
+		if id != Identity && wire > len(data)/10 {
+			t.Errorf("%v compressed %d to %d", id, len(data), wire)
+		}
+	}
+}
+
+func TestCodec_AdaptivePassthrough(t *testing.T) {
+	data := make([]byte, SampleSize*4)
+	rand.Read(data)
+
+	wire := roundTrip(t, Zstd|Adaptive, data)
+
+	// only the sample went through the compressor
+	assert.Equal(t, true, wire < len(data)+int(SampleSize/10))
+}
+
+func TestCodec_Parse(t *testing.T) {
+	ids, err := ParseList("zstd, adaptive, adaptive-zstd,identity")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(ids))
+	assert.Equal(t, Zstd, ids[0])
+	assert.Equal(t, Brotli|Adaptive, ids[1])
+	assert.Equal(t, "adaptive-zstd", ids[2].String())
+	assert.Equal(t, Identity, ids[3])
+
+	_, err = Parse("adaptive-identity")
+	assert.Equal(t, ErrUnknownCodec, err)
+}
+
+// tcpPair is buffered unlike net.Pipe, as both ends write their side of the negotiation without waiting
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	assert.Equal(t, nil, err)
+
+	s, err := l.Accept()
+	assert.Equal(t, nil, err)
+
+	return c, s
+}
+
+func TestCodec_Negotiate(t *testing.T) {
+	c, s := tcpPair(t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		server, err := Server(s, []ID{Zstd, Brotli, Identity})
+		assert.Equal(t, nil, err)
+		defer server.Close()
+
+		b := make([]byte, 5)
+		_, err = io.ReadFull(server, b)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "hello", string(b))
+
+		server.Write([]byte("world"))
+		server.Flush()
+
+		// the client ends its compressed stream when it closes
+		_, err = io.Copy(io.Discard, server)
+		assert.Equal(t, nil, err)
+	}()
+
+	client, err := Client(c, []ID{Brotli, Zstd})
+	assert.Equal(t, nil, err)
+
+	client.Write([]byte("hello"))
+	client.Flush()
+
+	b := make([]byte, 5)
+	_, err = io.ReadFull(client, b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "world", string(b))
+
+	client.Close()
+	<-done
+}
+
+func TestCodec_NegotiateRefused(t *testing.T) {
+	for _, tc := range []struct {
+		offer []ID
+		err   error
+	}{
+		// the client compresses with a codec the server did not enable
+		{[]ID{Brotli, Zstd}, ErrNegotiation},
+		{[]ID{Zstd | Adaptive}, ErrNegotiation},
+		{[]ID{Identity, Brotli}, nil},
+		{[]ID{Zstd}, nil},
+	} {
+		c, s := tcpPair(t)
+
+		done := make(chan error, 1)
+		go func() {
+			server, err := Server(s, []ID{Zstd})
+			if err == nil {
+				server.Close()
+			} else {
+				s.Close()
+			}
+			done <- err
+		}()
+
+		client, err := Client(c, tc.offer)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, tc.err, <-done)
+
+		if tc.err != nil {
+			// closed without a reply
+			_, err = client.Read(make([]byte, 1))
+			assert.NotNull(t, err)
+		}
+		client.Close()
+	}
+}
+
+func TestConn_CloseWrite(t *testing.T) {
+	for _, id := range []ID{Brotli, Zstd, Identity} {
+		c, s := tcpPair(t)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			server, err := Server(s, []ID{id})
+			assert.Equal(t, nil, err)
+			defer server.Close()
+
+			// the client half-closes, the server still replies
+			b, err := io.ReadAll(server)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, "request", string(b))
+
+			server.Write([]byte("reply"))
+			server.Close()
+		}()
+
+		client, err := Client(c, []ID{id})
+		assert.Equal(t, nil, err)
+
+		client.Write([]byte("request"))
+		assert.Equal(t, nil, client.CloseWrite())
+
+		_, err = client.Write([]byte("more"))
+		assert.Equal(t, net.ErrClosed, err)
+
+		b, err := io.ReadAll(client)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "reply", string(b))
+
+		client.Close()
+		<-done
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c, s := tcpPair(t)
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		server, err := Server(s, []ID{Brotli})
+		assert.Equal(t, nil, err)
+		accepted <- server
+	}()
+
+	client, err := Client(c, []ID{Brotli})
+	assert.Equal(t, nil, err)
+	defer client.Close()
+
+	server := <-accepted
+	defer server.Close()
+
+	// each read arrives without waiting for the next, or for the end
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		n, err := Copy(client, pr)
+		assert.Equal(t, int64(10), n)
+		done <- err
+	}()
+
+	b := make([]byte, 5)
+	for _, chunk := range []string{"hello", "world"} {
+		pw.Write([]byte(chunk))
+		_, err = io.ReadFull(server, b)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, chunk, string(b))
+	}
+
+	pw.Close()
+	assert.Equal(t, nil, <-done)
+}
@@ -0,0 +1,282 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var ErrNegotiation = errors.New("codec negotiation failed")
+
+// Conn compresses both directions of a tunnel stream. Each direction may use a different codec.
+//
+// The client opens a stream with its offer, in plain text before anything compressed:
+//
+//	| count (1) | codec (1) ... |
+//
+// The first codec in the offer compresses what the client sends. The server answers with a single byte,
+// the codec it picked for its replies.
+type Conn struct {
+	net.Conn
+
+	readLock sync.Mutex
+	cr       Reader
+	// codecs the server may pick from, nil once the reply codec is known
+	offer      []ID
+	negotiated bool
+
+	writeLock sync.Mutex
+	cw        Writer
+
+	closeOnce sync.Once
+}
+
+// Legacy compresses both directions with brotli and skips negotiation, for peers that predate it
+func Legacy(conn net.Conn) (*Conn, error) {
+	cr, err := NewReader(Brotli, wireReader{conn})
+	if err != nil {
+		return nil, err
+	}
+
+	cw, _ := NewWriter(Brotli, wireWriter{conn})
+
+	return &Conn{
+		Conn: conn,
+		cr:   cr,
+		cw:   cw,
+	}, nil
+}
+
+// Client sends offer, in order of preference. The reply codec is read with the first Read.
+// Servers reply with Identity if they support none of the offer, but refuse the stream if they do not support the
+// first.
+func Client(conn net.Conn, offer []ID) (*Conn, error) {
+	if len(offer) == 0 || len(offer) > 255 {
+		return nil, ErrNegotiation
+	}
+
+	b := make([]byte, 0, len(offer)+1)
+	b = append(b, byte(len(offer)))
+	for _, id := range offer {
+		if !id.Valid() {
+			return nil, ErrUnknownCodec
+		}
+		b = append(b, byte(id))
+	}
+
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+
+	cw, _ := NewWriter(offer[0], wireWriter{conn})
+
+	return &Conn{
+		Conn:       conn,
+		cw:         cw,
+		offer:      offer,
+		negotiated: true,
+	}, nil
+}
+
+// Server reads the offer of the client, and replies with the first codec in it that is also in accept.
+// It fails with ErrNegotiation if the client compresses with a codec other than Identity that is not in accept.
+func Server(conn net.Conn, accept []ID) (*Conn, error) {
+	b := make([]byte, 255)
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return nil, err
+	}
+
+	offer := b[:b[0]]
+	if len(offer) == 0 {
+		return nil, ErrNegotiation
+	}
+
+	if _, err := io.ReadFull(conn, offer); err != nil {
+		return nil, err
+	}
+
+	// what the client sends is already compressed with it, there is nothing to fall back to
+	if ID(offer[0]) != Identity && !contains(accept, ID(offer[0])) {
+		return nil, ErrNegotiation
+	}
+
+	cr, err := NewReader(ID(offer[0]), wireReader{conn})
+	if err != nil {
+		return nil, err
+	}
+
+	reply := Identity
+	for _, id := range offer {
+		if contains(accept, ID(id)) {
+			reply = ID(id)
+			break
+		}
+	}
+
+	if _, err := conn.Write([]byte{byte(reply)}); err != nil {
+		cr.Close()
+		return nil, err
+	}
+
+	cw, _ := NewWriter(reply, wireWriter{conn})
+
+	return &Conn{
+		Conn:       conn,
+		cr:         cr,
+		cw:         cw,
+		negotiated: true,
+	}, nil
+}
+
+// Negotiated is false for Legacy connections
+func (c *Conn) Negotiated() bool {
+	return c.negotiated
+}
+
+func contains(ids []ID, id ID) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate reads the reply codec of the server
+func (c *Conn) negotiate() error {
+	var b [1]byte
+	if _, err := io.ReadFull(c.Conn, b[:]); err != nil {
+		return err
+	}
+
+	id := ID(b[0])
+	if id != Identity && !contains(c.offer, id) {
+		return ErrNegotiation
+	}
+
+	cr, err := NewReader(id, wireReader{c.Conn})
+	if err != nil {
+		return err
+	}
+
+	c.cr = cr
+	c.offer = nil
+	return nil
+}
+
+func (c *Conn) Read(b []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	if c.cr == nil {
+		if c.offer == nil {
+			return 0, net.ErrClosed
+		}
+
+		if err = c.negotiate(); err != nil {
+			return
+		}
+	}
+
+	n, err = c.cr.Read(b)
+	Totals.RawRead.Add(uint64(n))
+	return
+}
+
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.cw == nil {
+		return 0, net.ErrClosed
+	}
+
+	n, err = c.cw.Write(b)
+	Totals.RawWritten.Add(uint64(n))
+	return
+}
+
+// Flush sends everything written so far, instead of holding it in the compressor
+func (c *Conn) Flush() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.cw == nil {
+		return net.ErrClosed
+	}
+
+	return c.cw.Flush()
+}
+
+// Copy copies src to dst until EOF, flushing whenever a read returns, so nothing waits in the compressor for more.
+// For sources other than raw sockets, which cannot tell whether more is about to come.
+func Copy(dst *Conn, src io.Reader) (written int64, err error) {
+	buf := make([]byte, 32*1024)
+
+	for {
+		nr, er := src.Read(buf)
+
+		if nr > 0 {
+			nw, ew := dst.Write(buf[:nr])
+			written += int64(nw)
+
+			if ew == nil {
+				ew = dst.Flush()
+			}
+			if ew != nil {
+				return written, ew
+			}
+		}
+
+		if er == io.EOF {
+			return written, nil
+		}
+		if er != nil {
+			return written, er
+		}
+	}
+}
+
+// CloseWrite ends the compressed stream, so the peer reads EOF, and half-closes the connection if it supports it.
+// Reading goes on, writing fails with net.ErrClosed.
+func (c *Conn) CloseWrite() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.cw == nil {
+		return net.ErrClosed
+	}
+
+	err := c.cw.Close()
+	c.cw = nil
+
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok && err == nil {
+		err = cw.CloseWrite()
+	}
+	return err
+}
+
+// Close ends the compressed stream before closing the connection
+func (c *Conn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		c.writeLock.Lock()
+		if c.cw != nil {
+			c.cw.Close()
+			c.cw = nil
+		}
+		c.writeLock.Unlock()
+
+		// unblocks a pending Read before the reader is released
+		err = c.Conn.Close()
+
+		c.readLock.Lock()
+		if c.cr != nil {
+			c.cr.Close()
+			c.cr = nil
+		}
+		c.offer = nil
+		c.readLock.Unlock()
+	})
+	return
+}
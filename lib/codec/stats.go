@@ -0,0 +1,37 @@
+package codec
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Stats counts bytes through all Conns of the process. Raw bytes are those read and written by the user of a Conn,
+// wire bytes those compressed on the connection underneath.
+type Stats struct {
+	RawRead     atomic.Uint64
+	RawWritten  atomic.Uint64
+	WireRead    atomic.Uint64
+	WireWritten atomic.Uint64
+}
+
+var Totals Stats
+
+type wireReader struct {
+	io.Reader
+}
+
+func (r wireReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	Totals.WireRead.Add(uint64(n))
+	return
+}
+
+type wireWriter struct {
+	io.Writer
+}
+
+func (w wireWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+	Totals.WireWritten.Add(uint64(n))
+	return
+}
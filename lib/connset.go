@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ConnSet tracks connections being served, so shutdown can wait for them and close those left
+type ConnSet struct {
+	lock    sync.Mutex
+	conns   map[net.Conn]struct{}
+	closed  bool
+	removed chan struct{}
+}
+
+func NewConnSet() *ConnSet {
+	return &ConnSet{
+		conns:   map[net.Conn]struct{}{},
+		removed: make(chan struct{}, 1),
+	}
+}
+
+// Add tracks conn until Remove. It returns false once Close has been called.
+func (s *ConnSet) Add(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return false
+	}
+
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *ConnSet) Remove(conn net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+
+	select {
+	case s.removed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ConnSet) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.conns)
+}
+
+// Wait returns once all connections are removed, or with the error of ctx
+func (s *ConnSet) Wait(ctx context.Context) error {
+	for s.Len() > 0 {
+		select {
+		case <-s.removed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Close closes the connections left, and refuses those added afterwards. It returns the number closed.
+func (s *ConnSet) Close() int {
+	s.lock.Lock()
+	s.closed = true
+	conns := s.conns
+	s.conns = map[net.Conn]struct{}{}
+	s.lock.Unlock()
+
+	for conn := range conns {
+		conn.Close()
+	}
+
+	return len(conns)
+}
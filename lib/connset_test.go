@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"context"
+	"io"
+	"lib/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnSet(t *testing.T) {
+	s := NewConnSet()
+
+	a, b := net.Pipe()
+	c, d := net.Pipe()
+	defer b.Close()
+	defer d.Close()
+
+	assert.Equal(t, true, s.Add(a))
+	assert.Equal(t, true, s.Add(c))
+	assert.Equal(t, 2, s.Len())
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		s.Remove(a)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, s.Wait(ctx))
+	assert.Equal(t, 1, s.Len())
+
+	assert.Equal(t, 1, s.Close())
+	assert.Equal(t, false, s.Add(a))
+
+	_, err := c.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	assert.Equal(t, nil, s.Wait(context.Background()))
+}
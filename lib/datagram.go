@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const MaxDatagramSize = 65535
+
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// WriteDatagram frames b with a 2 byte length prefix, so that message boundaries survive an ordered byte stream
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(b)))
+
+	return WriteAll(w, header[:], b)
+}
+
+// ReadDatagram reads one datagram written by WriteDatagram.
+// Like a UDP socket read, the datagram is truncated if it is larger than b.
+func ReadDatagram(r io.Reader, b []byte) (n int, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	size := int(binary.BigEndian.Uint16(header[:]))
+	n = min(size, len(b))
+
+	if _, err = io.ReadFull(r, b[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	if size > n {
+		if _, err = io.CopyN(io.Discard, r, int64(size-n)); err != nil {
+			return 0, err
+		}
+	}
+
+	return
+}
@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"lib/assert"
+	"testing"
+)
+
+func TestDatagram(t *testing.T) {
+	var buf bytes.Buffer
+
+	WriteDatagram(&buf, []byte("hello"))
+	WriteDatagram(&buf, []byte{})
+	WriteDatagram(&buf, []byte("truncated"))
+
+	b := make([]byte, 5)
+	n, err := ReadDatagram(&buf, b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "hello", string(b[:n]))
+
+	n, err = ReadDatagram(&buf, b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, n)
+
+	n, err = ReadDatagram(&buf, b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "trunc", string(b[:n]))
+
+	_, err = ReadDatagram(&buf, b)
+	assert.Equal(t, io.EOF, err)
+
+	err = WriteDatagram(&buf, make([]byte, MaxDatagramSize+1))
+	assert.Equal(t, ErrDatagramTooLarge, err)
+}
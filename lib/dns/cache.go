@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"lib"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// answers are not kept longer than this, whatever their TTL
+	maxTtl = time.Hour * 24
+	// nor negative ones longer than this, RFC 2308 5
+	maxNegativeTtl = time.Hour * 3
+)
+
+type cacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+func keyOf(q dnsmessage.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name.String()), qtype: q.Type, class: q.Class}
+}
+
+type cacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// Cache keeps answers for as long as their TTL allows, and negative ones, NXDOMAIN or no data, for as long as the SOA
+// of the zone allows, as of RFC 2308
+type Cache struct {
+	lock sync.Mutex
+	lru  *lib.LRU[cacheKey, *cacheEntry]
+}
+
+// NewCache keeps the answers of size questions at most, the least recently used going first
+func NewCache(size int) *Cache {
+	return &Cache{lru: lib.NewLRU[cacheKey, *cacheEntry](size, min(size, 1024))}
+}
+
+// Ttl is how long res may be kept, false if it may not be
+func Ttl(res *dnsmessage.Message) (time.Duration, bool) {
+	if res.Truncated || len(res.Questions) != 1 {
+		return 0, false
+	}
+
+	switch res.RCode {
+	case dnsmessage.RCodeSuccess:
+		if len(res.Answers) == 0 {
+			break
+		}
+
+		ttl := res.Answers[0].Header.TTL
+		for _, rr := range res.Answers[1:] {
+			ttl = min(ttl, rr.Header.TTL)
+		}
+		return min(time.Duration(ttl)*time.Second, maxTtl), true
+	case dnsmessage.RCodeNameError:
+	default:
+		return 0, false
+	}
+
+	// negative, by the TTL of the SOA bounded by its MINIMUM. Without one it is not kept at all.
+	for _, rr := range res.Authorities {
+		if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+			return min(time.Duration(min(rr.Header.TTL, soa.MinTTL))*time.Second, maxNegativeTtl), true
+		}
+	}
+
+	return 0, false
+}
+
+// Get returns the answer kept for q, with TTLs lowered by the time it spent in the cache
+func (c *Cache) Get(q dnsmessage.Question, now time.Time) (*dnsmessage.Message, bool) {
+	key := keyOf(q)
+
+	c.lock.Lock()
+	e, ok := c.lru.Get(key)
+	if ok && !now.Before(e.expires) {
+		c.lru.Remove(key)
+		ok = false
+	}
+	c.lock.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+
+	ret := e.msg
+	ret.Answers = age(e.msg.Answers, elapsed)
+	ret.Authorities = age(e.msg.Authorities, elapsed)
+	ret.Additionals = age(e.msg.Additionals, elapsed)
+
+	return &ret, true
+}
+
+func age(rrs []dnsmessage.Resource, elapsed uint32) []dnsmessage.Resource {
+	ret := slices.Clone(rrs)
+
+	for i := range ret {
+		// the TTL of OPT carries flags
+		if h := &ret[i].Header; h.Type != dnsmessage.TypeOPT {
+			h.TTL -= min(h.TTL, elapsed)
+		}
+	}
+
+	return ret
+}
+
+// Put keeps res, received at now, unless Ttl tells otherwise
+func (c *Cache) Put(res *dnsmessage.Message, now time.Time) {
+	ttl, ok := Ttl(res)
+	if !ok || ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lru.Set(keyOf(res.Questions[0]), &cacheEntry{msg: *res, stored: now, expires: now.Add(ttl)})
+}
+
+// Len is the number of answers kept
+func (c *Cache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.lru.Len()
+}
@@ -0,0 +1,209 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Resolver answering DNS queries from a cache, or from the first of its upstreams that does. As NetResolver, it stands
+// in for net.DefaultResolver or the Resolver of a net.Dialer.
+
+var ErrQuery = errors.New("invalid dns query")
+var ErrUpstream = errors.New("dns upstream failed")
+
+// Stats count the queries of a Resolver
+type Stats struct {
+	// answered from the cache
+	Hits atomic.Uint64
+	// sent to upstreams
+	Misses atomic.Uint64
+	// failed exchanges with upstreams, each one tried counting
+	Failures atomic.Uint64
+}
+
+type Resolver struct {
+	upstreams []Upstream
+	cache     *Cache
+	Stats     Stats
+}
+
+// NewResolver tries upstreams in order. cache may be nil, or shared with other resolvers.
+func NewResolver(upstreams []Upstream, cache *Cache) *Resolver {
+	return &Resolver{upstreams: upstreams, cache: cache}
+}
+
+// Exchange answers query, a DNS message in wire format
+func (r *Resolver) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrQuery, err.Error())
+	}
+
+	if q.Response || len(q.Questions) != 1 {
+		return nil, ErrQuery
+	}
+
+	question := q.Questions[0]
+	now := time.Now()
+
+	if r.cache != nil {
+		if res, ok := r.cache.Get(question, now); ok {
+			r.Stats.Hits.Add(1)
+			res.ID = q.ID
+			return res.Pack()
+		}
+	}
+
+	r.Stats.Misses.Add(1)
+
+	err := fmt.Errorf("%w: no upstream", ErrUpstream)
+
+	for _, up := range r.upstreams {
+		var b []byte
+		if b, err = up.Exchange(ctx, query); err == nil {
+			var res dnsmessage.Message
+			if err = res.Unpack(b); err == nil {
+				err = answers(question, &res)
+			}
+
+			if err == nil {
+				if r.cache != nil {
+					r.cache.Put(&res, now)
+				}
+				return b, nil
+			}
+		}
+
+		r.Stats.Failures.Add(1)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, err
+}
+
+// answers tells why res does not answer question, if it does not. Failures of the server count as not answering,
+// so the next upstream is asked.
+func answers(question dnsmessage.Question, res *dnsmessage.Message) error {
+	if !res.Response || len(res.Questions) != 1 {
+		return fmt.Errorf("%w: not an answer", ErrUpstream)
+	}
+
+	q := res.Questions[0]
+	if q.Type != question.Type || q.Class != question.Class || !strings.EqualFold(q.Name.String(), question.Name.String()) {
+		return fmt.Errorf("%w: answer of another question", ErrUpstream)
+	}
+
+	switch res.RCode {
+	case dnsmessage.RCodeServerFailure, dnsmessage.RCodeRefused:
+		return fmt.Errorf("%w: %s", ErrUpstream, res.RCode.String())
+	}
+
+	return nil
+}
+
+// NetResolver resolves through r with the Go resolver. Names of the hosts file are still found there.
+func (r *Resolver) NetResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &conn{resolver: r, ctx: ctx}, nil
+		},
+	}
+}
+
+type resolverAddr struct{}
+
+func (resolverAddr) Network() string {
+	return "dns"
+}
+
+func (resolverAddr) String() string {
+	return "resolver"
+}
+
+// conn is what the Go resolver takes for a TCP connection to a DNS server: each query written is answered before
+// Write returns, and its answer read, both with the 2 byte length prefix. Not being a net.PacketConn is what makes
+// the Go resolver frame messages that way.
+type conn struct {
+	resolver *Resolver
+	ctx      context.Context
+	deadline time.Time
+
+	in  []byte
+	out bytes.Buffer
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	c.in = append(c.in, b...)
+
+	for len(c.in) >= 2 {
+		n := 2 + int(binary.BigEndian.Uint16(c.in))
+		if len(c.in) < n {
+			break
+		}
+
+		ctx, cancel := c.ctx, context.CancelFunc(func() {})
+		if !c.deadline.IsZero() {
+			ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		}
+
+		res, err := c.resolver.Exchange(ctx, c.in[2:n])
+		cancel()
+
+		if err != nil {
+			return 0, err
+		}
+
+		c.out.Write(binary.BigEndian.AppendUint16(nil, uint16(len(res))))
+		c.out.Write(res)
+		c.in = c.in[n:]
+	}
+
+	return len(b), nil
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.out.Read(b)
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return resolverAddr{}
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return resolverAddr{}
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *conn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
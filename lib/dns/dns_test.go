@@ -0,0 +1,202 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"lib"
+	"lib/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type upstreamFunc func(ctx context.Context, query []byte) ([]byte, error)
+
+func (f upstreamFunc) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return f(ctx, query)
+}
+
+// answer answers query like a server of the zone test., where example.test has an A record but no AAAA, and no
+// other name exists
+func answer(query []byte) *dnsmessage.Message {
+	var q dnsmessage.Message
+	if err := q.Unpack(query); err != nil {
+		panic(err)
+	}
+
+	question := q.Questions[0]
+	res := &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("admin.test."), MinTTL: 30},
+	}
+
+	switch {
+	case !strings.EqualFold(question.Name.String(), "example.test."):
+		res.RCode = dnsmessage.RCodeNameError
+		res.Authorities = append(res.Authorities, soa)
+	case question.Type == dnsmessage.TypeA:
+		res.Answers = append(res.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		})
+	default:
+		res.Authorities = append(res.Authorities, soa)
+	}
+
+	return res
+}
+
+func pack(t *testing.T, msg *dnsmessage.Message) []byte {
+	b, err := msg.Pack()
+	assert.Null(t, err)
+	return b
+}
+
+func query(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	return pack(t, &dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET}},
+	})
+}
+
+func TestResolver(t *testing.T) {
+	var calls atomic.Int32
+	zone := upstreamFunc(func(_ context.Context, q []byte) ([]byte, error) {
+		calls.Add(1)
+		return answer(q).Pack()
+	})
+
+	r := NewResolver([]Upstream{zone}, NewCache(16))
+	nr := r.NetResolver()
+
+	for range 2 {
+		ips, err := nr.LookupNetIP(context.Background(), "ip", "example.test.")
+		assert.Null(t, err)
+		assert.Equal(t, 1, len(ips))
+		assert.Equal(t, netip.MustParseAddr("192.0.2.1"), ips[0].Unmap())
+	}
+
+	// A and AAAA, the second time from the cache
+	assert.Equal(t, int32(2), calls.Load())
+	assert.Equal(t, uint64(2), r.Stats.Hits.Load())
+
+	for range 2 {
+		_, err := nr.LookupNetIP(context.Background(), "ip4", "missing.test.")
+		var dnsErr *net.DNSError
+		assert.Equal(t, true, errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+	}
+
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestResolver_Failover(t *testing.T) {
+	down := upstreamFunc(func(context.Context, []byte) ([]byte, error) {
+		return nil, errors.New("unreachable")
+	})
+	failing := upstreamFunc(func(_ context.Context, q []byte) ([]byte, error) {
+		res := answer(q)
+		res.RCode = dnsmessage.RCodeServerFailure
+		return res.Pack()
+	})
+	zone := upstreamFunc(func(_ context.Context, q []byte) ([]byte, error) {
+		return answer(q).Pack()
+	})
+
+	r := NewResolver([]Upstream{down, failing, zone}, nil)
+	b, err := r.Exchange(context.Background(), query(t, "example.test.", dnsmessage.TypeA))
+	assert.Null(t, err)
+
+	var res dnsmessage.Message
+	assert.Null(t, res.Unpack(b))
+	assert.Equal(t, uint16(1234), res.ID)
+	assert.Equal(t, 1, len(res.Answers))
+	assert.Equal(t, uint64(2), r.Stats.Failures.Load())
+
+	r = NewResolver([]Upstream{down, failing}, nil)
+	_, err = r.Exchange(context.Background(), query(t, "example.test.", dnsmessage.TypeA))
+	assert.Equal(t, true, errors.Is(err, ErrUpstream))
+
+	_, err = r.Exchange(context.Background(), []byte{1, 2, 3})
+	assert.Equal(t, true, errors.Is(err, ErrQuery))
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(16)
+	now := time.Now()
+
+	positive := answer(query(t, "example.test.", dnsmessage.TypeA))
+	ttl, ok := Ttl(positive)
+	assert.Equal(t, true, ok)
+	assert.Equal(t, time.Second*60, ttl)
+
+	// the SOA MINIMUM bounds negative answers, RFC 2308 5
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA} {
+		ttl, ok = Ttl(answer(query(t, "missing.test.", qtype)))
+		assert.Equal(t, true, ok)
+		assert.Equal(t, time.Second*30, ttl)
+	}
+
+	failure := answer(query(t, "example.test.", dnsmessage.TypeA))
+	failure.RCode = dnsmessage.RCodeServerFailure
+	_, ok = Ttl(failure)
+	assert.Equal(t, false, ok)
+
+	truncated := answer(query(t, "example.test.", dnsmessage.TypeA))
+	truncated.Truncated = true
+	_, ok = Ttl(truncated)
+	assert.Equal(t, false, ok)
+
+	c.Put(positive, now)
+	c.Put(failure, now)
+
+	// by the name in any case, its TTLs aged
+	res, ok := c.Get(dnsmessage.Question{Name: dnsmessage.MustNewName("EXAMPLE.test."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}, now.Add(time.Second*20))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, uint32(40), res.Answers[0].Header.TTL)
+	assert.Equal(t, uint32(60), positive.Answers[0].Header.TTL)
+
+	_, ok = c.Get(positive.Questions[0], now.Add(time.Second*60))
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestResolver_HttpClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+
+	// example.test is the address of server
+	var calls atomic.Int32
+	zone := upstreamFunc(func(_ context.Context, q []byte) ([]byte, error) {
+		calls.Add(1)
+		res := answer(q)
+		for i := range res.Answers {
+			res.Answers[i].Body = &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}}
+		}
+		return res.Pack()
+	})
+
+	var hc lib.HttpClient
+	hc.Init(5, 1, 1, NewResolver([]Upstream{zone}, NewCache(16)).NetResolver())
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	res, err := hc.Get("http://example.test:" + port + "/")
+	assert.Null(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, true, calls.Load() > 0)
+}
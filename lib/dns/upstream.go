@@ -0,0 +1,303 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// when the context has no deadline
+	exchangeTimeout = time.Second * 5
+	// idle connections kept to each TCP or TLS upstream
+	maxIdleConns = 2
+	// DNS messages are no longer over TCP, RFC 1035 4.2.2
+	maxMessageSize = 65535
+	// of a DNS header, the ID then the flags
+	headerSize = 12
+)
+
+// Dialer connects to upstreams, e.g. a net.Dialer, or one reaching them through a tunnel
+type Dialer interface {
+	DialContext(ctx context.Context, network string, addr string) (net.Conn, error)
+}
+
+// Upstream answers DNS queries in wire format
+type Upstream interface {
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+}
+
+// NewUpstream makes the upstream of rawUrl: udp://host[:53], tcp://host[:53], tls://host[:853] for DNS over TLS,
+// or https://host[:443]/path for DNS over HTTPS. A bare host[:port] is UDP. dialer resolves the host, which should
+// rather be an IP address unless dialer resolves without it.
+func NewUpstream(rawUrl string, dialer Dialer) (Upstream, error) {
+	if !strings.Contains(rawUrl, "://") {
+		rawUrl = "udp://" + rawUrl
+	}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: no host in %s", ErrUpstream, rawUrl)
+	}
+
+	addr := func(port string) string {
+		if u.Port() != "" {
+			port = u.Port()
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{addr: addr("53"), dialer: dialer, tcp: &streamUpstream{addr: addr("53"), dialer: dialer}}, nil
+	case "tcp":
+		return &streamUpstream{addr: addr("53"), dialer: dialer}, nil
+	case "tls":
+		return &streamUpstream{addr: addr("853"), dialer: dialer, tlsConfig: &tls.Config{
+			ServerName:         u.Hostname(),
+			ClientSessionCache: tls.NewLRUClientSessionCache(maxIdleConns),
+		}}, nil
+	case "https":
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+
+		return &httpsUpstream{url: u.String(), client: &http.Client{Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     time.Second * 90,
+			TLSHandshakeTimeout: exchangeTimeout,
+		}}}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unsupported scheme %s", ErrUpstream, u.Scheme)
+}
+
+// withDeadline closes conn to the context: its deadline bounds reads and writes, and cancellation interrupts them.
+// stop tells whether conn is still usable.
+func withDeadline(ctx context.Context, conn net.Conn) (stop func() bool) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(exchangeTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+// sameId tells whether res answers query, by the ID in their headers
+func sameId(query []byte, res []byte) bool {
+	return len(res) >= headerSize && bytes.Equal(query[:2], res[:2])
+}
+
+type udpUpstream struct {
+	addr   string
+	dialer Dialer
+	// truncated answers are asked again over it
+	tcp *streamUpstream
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := u.dialer.DialContext(ctx, "udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+	defer withDeadline(ctx, conn)()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, maxMessageSize)
+
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// late answers of earlier queries
+		if !sameId(query, buf[:n]) {
+			continue
+		}
+
+		// TC
+		if buf[2]&0x02 != 0 {
+			if res, err := u.tcp.Exchange(ctx, query); err == nil {
+				return res, nil
+			}
+		}
+
+		return buf[:n], nil
+	}
+}
+
+// streamUpstream speaks DNS over TCP, or TLS if tlsConfig is set, reusing connections as RFC 7766 allows
+type streamUpstream struct {
+	addr      string
+	dialer    Dialer
+	tlsConfig *tls.Config
+
+	lock sync.Mutex
+	idle []net.Conn
+}
+
+func (s *streamUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if conn := s.take(); conn != nil {
+		// the server may have closed it while idle
+		if res, err := s.roundTrip(ctx, conn, query); err == nil || ctx.Err() != nil {
+			return res, err
+		}
+	}
+
+	conn, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.roundTrip(ctx, conn, query)
+}
+
+func (s *streamUpstream) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil || s.tlsConfig == nil {
+		return conn, err
+	}
+
+	tlsConn := tls.Client(conn, s.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return tlsConn, nil
+}
+
+// roundTrip sends query on conn and reads the answer, keeping conn for later if all went well
+func (s *streamUpstream) roundTrip(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	stop := withDeadline(ctx, conn)
+
+	res, err := func() ([]byte, error) {
+		msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+		if _, err := conn.Write(append(msg, query...)); err != nil {
+			return nil, err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+
+		res := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, res); err != nil {
+			return nil, err
+		}
+
+		if !sameId(query, res) {
+			return nil, fmt.Errorf("%w: answer of another query", ErrUpstream)
+		}
+		return res, nil
+	}()
+
+	if !stop() || err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	s.put(conn)
+
+	return res, nil
+}
+
+func (s *streamUpstream) take() net.Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.idle) == 0 {
+		return nil
+	}
+
+	ret := s.idle[len(s.idle)-1]
+	s.idle = s.idle[:len(s.idle)-1]
+	return ret
+}
+
+func (s *streamUpstream) put(conn net.Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+
+	s.idle = append(s.idle, conn)
+}
+
+// httpsUpstream speaks DNS over HTTPS of RFC 8484
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, exchangeTimeout)
+		defer cancel()
+	}
+
+	// with ID 0 the same queries make the same requests, for HTTP caches on the way, RFC 8484 4.1
+	body := bytes.Clone(query)
+	body[0], body[1] = 0, 0
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: status %d", ErrUpstream, res.StatusCode)
+	}
+
+	ret, err := io.ReadAll(io.LimitReader(res.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ret) < headerSize || len(ret) > maxMessageSize {
+		return nil, fmt.Errorf("%w: answer of %d bytes", ErrUpstream, len(ret))
+	}
+
+	copy(ret, query[:2])
+	return ret, nil
+}
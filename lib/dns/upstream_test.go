@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"lib/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveTcp answers queries on l over TCP, counting connections
+func serveTcp(l net.Listener, accepted *atomic.Int32) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted.Add(1)
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+
+				q := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, q); err != nil {
+					return
+				}
+
+				res, _ := answer(q).Pack()
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(res))), res...))
+			}
+		}()
+	}
+}
+
+func exchange(t *testing.T, up Upstream) *dnsmessage.Message {
+	b, err := up.Exchange(context.Background(), query(t, "example.test.", dnsmessage.TypeA))
+	assert.Null(t, err)
+
+	var res dnsmessage.Message
+	assert.Null(t, res.Unpack(b))
+	assert.Equal(t, uint16(1234), res.ID)
+	return &res
+}
+
+func TestUpstream_Tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Null(t, err)
+	defer l.Close()
+
+	var accepted atomic.Int32
+	go serveTcp(l, &accepted)
+
+	up, err := NewUpstream("tcp://"+l.Addr().String(), &net.Dialer{})
+	assert.Null(t, err)
+
+	for range 3 {
+		assert.Equal(t, 1, len(exchange(t, up).Answers))
+	}
+
+	// the connection is reused
+	assert.Equal(t, int32(1), accepted.Load())
+}
+
+func TestUpstream_Udp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Null(t, err)
+	defer l.Close()
+
+	var accepted atomic.Int32
+	go serveTcp(l, &accepted)
+
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	assert.Null(t, err)
+	defer pc.Close()
+
+	var truncate atomic.Bool
+	go func() {
+		buf := make([]byte, maxMessageSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			res := answer(buf[:n])
+			if truncate.Load() {
+				res.Truncated = true
+				res.Answers = nil
+			}
+
+			b, _ := res.Pack()
+			// a stray answer first
+			pc.WriteTo(append([]byte{0, 0}, b[2:]...), addr)
+			pc.WriteTo(b, addr)
+		}
+	}()
+
+	// bare addresses are UDP
+	up, err := NewUpstream(l.Addr().String(), &net.Dialer{})
+	assert.Null(t, err)
+
+	assert.Equal(t, 1, len(exchange(t, up).Answers))
+	assert.Equal(t, int32(0), accepted.Load())
+
+	// asked again over TCP
+	truncate.Store(true)
+	assert.Equal(t, 1, len(exchange(t, up).Answers))
+	assert.Equal(t, int32(1), accepted.Load())
+}
+
+func TestUpstream_Https(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := io.ReadAll(r.Body)
+		if r.Method != "POST" || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" || q[0]|q[1] != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		res, _ := answer(q).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(res)
+	}))
+	defer server.Close()
+
+	up, err := NewUpstream(server.URL, &net.Dialer{})
+	assert.Null(t, err)
+	up.(*httpsUpstream).client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	assert.Equal(t, 1, len(exchange(t, up).Answers))
+
+	_, err = NewUpstream("ftp://127.0.0.1", &net.Dialer{})
+	assert.NotNull(t, err)
+}
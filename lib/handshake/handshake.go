@@ -0,0 +1,181 @@
+package handshake
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"lib/http1"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Tunnel streams open with a request in HTTP/1.1 form. The server replies once it has dialed the destination:
+//
+//	CONNECT example.com:443 HTTP/1.1
+//	Smp-Version: 2
+//
+//	HTTP/1.1 200 OK
+//	Smp-Version: 2
+//	Smp-Peer: 93.184.215.14:443
+//	Smp-Meta-Dial-Time: 12
+//
+// Failures carry a Proxy-Status instead of Smp-Peer. Requests without Smp-Version come from forwarders predating it,
+// which only understand a bare 200 OK. Version 2 adds MethodTls, older servers would relay it as MethodConnect.
+const Version = 2
+
+const (
+	MethodConnect = "CONNECT"
+	// relays datagrams in place of a stream
+	MethodUdp = "UDP"
+	// relays plaintext, the server speaks TLS with the destination. From Version 2.
+	MethodTls = "TLS"
+)
+
+const (
+	versionHeader = "Smp-Version"
+	peerHeader    = "Smp-Peer"
+	metaPrefix    = "Smp-Meta-"
+)
+
+// MaxReplySize bounds the head of a reply
+const MaxReplySize = 4096
+
+var ErrBadReply = errors.New("malformed or truncated tunnel reply")
+
+var okResponse = []byte("HTTP/1.1 200 OK\r\n\r\n")
+
+type Request struct {
+	Method string
+	// destination in host:port form
+	Addr    string
+	Version int
+}
+
+func (r Request) Bytes() []byte {
+	sb := strings.Builder{}
+	sb.WriteString(r.Method + " " + r.Addr + " HTTP/1.1\r\n")
+	if r.Version > 0 {
+		sb.WriteString(versionHeader + ": " + strconv.Itoa(r.Version) + "\r\n")
+	}
+	sb.WriteString("\r\n")
+	return []byte(sb.String())
+}
+
+// ReadRequest reads a tunnel request, leaving what follows it in r. Version is 0 for forwarders predating it.
+func ReadRequest(r *bufio.Reader) (ret Request, err error) {
+	req, err := http1.ReadRequest(r, http1.DefaultLimits)
+	if err != nil {
+		return
+	}
+
+	ret.Method, ret.Addr = req.Method, req.Url
+
+	if v := req.Headers.Get(versionHeader); v != "" {
+		if ret.Version, err = strconv.Atoi(v); err != nil || ret.Version < 0 {
+			err = &http1.Error{Err: http1.ErrMalformed, Line: 1}
+		}
+	}
+
+	return
+}
+
+type Reply struct {
+	// the lower of the versions of both sides
+	Version int
+	// address of the destination connected to, from Version 1
+	Peer string
+	// sent as Smp-Meta- headers, from Version 1
+	Meta http1.Headers
+	// why the destination could not be reached, nil on success
+	Status *http1.ProxyStatus
+}
+
+// Err returns Status as an error
+func (r Reply) Err() error {
+	if r.Status == nil {
+		return nil
+	}
+	return r.Status
+}
+
+func (r Reply) Bytes() []byte {
+	if r.Version == 0 {
+		if r.Status != nil {
+			return r.Status.Response()
+		}
+		return okResponse
+	}
+
+	sb := strings.Builder{}
+
+	if r.Status != nil {
+		sb.WriteString("HTTP/1.1 " + strconv.Itoa(r.Status.StatusCode) + " " + http.StatusText(r.Status.StatusCode) + "\r\n")
+		sb.WriteString("Proxy-Status: " + r.Status.Header() + "\r\n")
+	} else {
+		sb.WriteString("HTTP/1.1 200 OK\r\n")
+	}
+
+	sb.WriteString(versionHeader + ": " + strconv.Itoa(r.Version) + "\r\n")
+
+	if r.Peer != "" {
+		sb.WriteString(peerHeader + ": " + r.Peer + "\r\n")
+	}
+
+	for _, m := range r.Meta {
+		sb.WriteString(metaPrefix + m.Name + ": " + m.Value + "\r\n")
+	}
+
+	sb.WriteString("\r\n")
+	return []byte(sb.String())
+}
+
+// ReadReply reads a reply one byte at a time, so nothing following it is consumed.
+// Errors before the first byte are those of r, later ones are ErrBadReply.
+func ReadReply(r io.Reader) (ret Reply, err error) {
+	head := make([]byte, 0, 128)
+	b := make([]byte, 1)
+
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) == MaxReplySize {
+			return ret, ErrBadReply
+		}
+
+		if _, err = io.ReadFull(r, b); err != nil {
+			if len(head) > 0 {
+				err = fmt.Errorf("%w: %w", ErrBadReply, err)
+			}
+			return
+		}
+
+		head = append(head, b[0])
+	}
+
+	res, err := http1.ReadResponse(bufio.NewReader(bytes.NewReader(head)), http1.DefaultLimits)
+	if err != nil {
+		return ret, fmt.Errorf("%w: %w", ErrBadReply, err)
+	}
+
+	if v := res.Headers.Get(versionHeader); v != "" {
+		if ret.Version, err = strconv.Atoi(v); err != nil {
+			return ret, fmt.Errorf("%w: %w", ErrBadReply, err)
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		ret.Status = http1.ParseProxyStatus(res)
+	}
+
+	for _, h := range res.Headers {
+		switch {
+		case strings.EqualFold(h.Name, peerHeader):
+			ret.Peer = h.Value
+		case len(h.Name) > len(metaPrefix) && strings.EqualFold(h.Name[:len(metaPrefix)], metaPrefix):
+			ret.Meta = append(ret.Meta, http1.Header{Name: h.Name[len(metaPrefix):], Value: h.Value})
+		}
+	}
+
+	return
+}
@@ -0,0 +1,93 @@
+package handshake
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"lib/assert"
+	"lib/http1"
+	"testing"
+)
+
+func TestRequest_RoundTrip(t *testing.T) {
+	b := Request{Method: MethodConnect, Addr: "example.com:443", Version: Version}.Bytes()
+
+	r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), bytes.NewReader([]byte("early"))))
+	req, err := ReadRequest(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MethodConnect, req.Method)
+	assert.Equal(t, "example.com:443", req.Addr)
+	assert.Equal(t, Version, req.Version)
+
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "early", string(rest))
+
+	// forwarders predating versions
+	req, err = ReadRequest(bufio.NewReader(bytes.NewReader([]byte("UDP 1.1.1.1:53 HTTP/1.1\r\n\r\n"))))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MethodUdp, req.Method)
+	assert.Equal(t, 0, req.Version)
+}
+
+func TestReply_RoundTrip(t *testing.T) {
+	reply := Reply{
+		Version: Version,
+		Peer:    "93.184.215.14:443",
+		Meta:    http1.Headers{{Name: "Dial-Time", Value: "12"}},
+	}
+
+	r := io.MultiReader(bytes.NewReader(reply.Bytes()), bytes.NewReader([]byte("data")))
+	got, err := ReadReply(r)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, nil, got.Err())
+	assert.Equal(t, Version, got.Version)
+	assert.Equal(t, reply.Peer, got.Peer)
+	assert.Equal(t, 1, len(got.Meta))
+	assert.Equal(t, "12", got.Meta.Get("dial-time"))
+
+	// nothing past the reply is consumed
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "data", string(rest))
+}
+
+func TestReply_Failure(t *testing.T) {
+	status := &http1.ProxyStatus{Proxy: "p", StatusCode: 504, ErrorType: http1.ConnectionTimeout, Details: "i/o timeout"}
+
+	for _, version := range []int{0, Version} {
+		got, err := ReadReply(bytes.NewReader(Reply{Version: version, Status: status}.Bytes()))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, version, got.Version)
+		assert.Equal(t, "", got.Peer)
+
+		var s *http1.ProxyStatus
+		assert.Equal(t, true, errors.As(got.Err(), &s))
+		assert.Equal(t, 504, s.StatusCode)
+		assert.Equal(t, http1.ConnectionTimeout, s.ErrorType)
+		assert.Equal(t, "i/o timeout", s.Details)
+	}
+}
+
+func TestReply_Legacy(t *testing.T) {
+	b := Reply{}.Bytes()
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n\r\n", string(b))
+
+	got, err := ReadReply(bytes.NewReader(b))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 0, got.Version)
+	assert.Equal(t, nil, got.Err())
+}
+
+func TestReadReply_Errors(t *testing.T) {
+	_, err := ReadReply(bytes.NewReader(nil))
+	assert.Equal(t, io.EOF, err)
+
+	_, err = ReadReply(bytes.NewReader([]byte("HTTP/1.1 200")))
+	assert.Equal(t, true, errors.Is(err, ErrBadReply))
+
+	_, err = ReadReply(bytes.NewReader([]byte("garbage\r\n\r\n")))
+	assert.Equal(t, true, errors.Is(err, ErrBadReply))
+
+	_, err = ReadReply(bytes.NewReader(bytes.Repeat([]byte("a"), MaxReplySize+1)))
+	assert.Equal(t, true, errors.Is(err, ErrBadReply))
+}
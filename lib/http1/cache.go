@@ -0,0 +1,428 @@
+package http1
+
+import (
+	"lib"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// freshness of responses with a Last-Modified but no explicit lifetime is a tenth of their age, up to this
+	heuristicMaxLifetime = time.Hour * 24
+	// counted against the size limits on top of the body, for the headers and the bookkeeping
+	entryOverhead = 512
+)
+
+// heuristicStatus are the status codes cacheable by default, RFC 9110 15.1.
+// Others are stored only with an explicit lifetime.
+var heuristicStatus = map[int]bool{200: true, 203: true, 204: true, 300: true, 301: true, 308: true, 404: true, 405: true, 410: true, 414: true, 501: true}
+
+// CacheControl holds the directives of Cache-Control headers, by lower case name. Valueless ones map to "".
+type CacheControl map[string]string
+
+func ParseCacheControl(h Headers) CacheControl {
+	ret := CacheControl{}
+
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				ret[name] = strings.Trim(strings.TrimSpace(value), `"`)
+			}
+		}
+	}
+
+	return ret
+}
+
+func (cc CacheControl) Has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// Seconds returns the delta-seconds value of name, ok is false if it is missing or invalid
+func (cc CacheControl) Seconds(name string) (d time.Duration, ok bool) {
+	v, ok := cc[name]
+	if !ok {
+		return
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+
+	// overflows are as good as forever
+	return time.Duration(min(n, math.MaxInt64/int64(time.Second))) * time.Second, true
+}
+
+// CacheEntry is a stored response, its body framed by its headers as it was received, chunked or not
+type CacheEntry struct {
+	Response
+	Body []byte
+
+	// values of the request headers named by Vary, in order
+	vary []string
+	// when the request was sent, and its response received
+	requestTime  time.Time
+	responseTime time.Time
+	size         int64
+}
+
+func (e *CacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Headers.Get("Date")); err == nil {
+		return t
+	}
+	return e.responseTime
+}
+
+// Age is how old the response is at now, RFC 9111 4.2.3
+func (e *CacheEntry) Age(now time.Time) time.Duration {
+	apparentAge := max(0, e.responseTime.Sub(e.date()))
+
+	ageValue, _ := strconv.ParseInt(e.Headers.Get("Age"), 10, 64)
+	correctedAge := time.Duration(max(0, ageValue))*time.Second + e.responseTime.Sub(e.requestTime)
+
+	return max(apparentAge, correctedAge) + now.Sub(e.responseTime)
+}
+
+// Lifetime is how long the response stays fresh, from the explicit directives or else heuristically
+func (e *CacheEntry) Lifetime() time.Duration {
+	cc := ParseCacheControl(e.Headers)
+
+	if d, ok := cc.Seconds("s-maxage"); ok {
+		return d
+	}
+
+	if d, ok := cc.Seconds("max-age"); ok {
+		return d
+	}
+
+	if expires := e.Headers.Get("Expires"); expires != "" {
+		// invalid dates, e.g. "0", are in the past
+		if t, err := http.ParseTime(expires); err == nil {
+			return max(0, t.Sub(e.date()))
+		}
+		return 0
+	}
+
+	if !heuristicStatus[e.StatusCode] {
+		return 0
+	}
+
+	if t, err := http.ParseTime(e.Headers.Get("Last-Modified")); err == nil {
+		return min(max(0, e.date().Sub(t))/10, heuristicMaxLifetime)
+	}
+
+	return 0
+}
+
+// Fresh tells whether the entry can answer req at now without asking the origin
+func (e *CacheEntry) Fresh(req Request, now time.Time) bool {
+	resCc := ParseCacheControl(e.Headers)
+	reqCc := ParseCacheControl(req.Headers)
+
+	if resCc.Has("no-cache") || reqCc.Has("no-cache") {
+		return false
+	}
+
+	if len(reqCc) == 0 && req.Headers.HasToken("Pragma", "no-cache") {
+		return false
+	}
+
+	age, lifetime := e.Age(now), e.Lifetime()
+
+	if d, ok := reqCc.Seconds("max-age"); ok && age > d {
+		return false
+	}
+
+	if d, ok := reqCc.Seconds("min-fresh"); ok && lifetime-age < d {
+		return false
+	}
+
+	return age < lifetime
+}
+
+// HasValidators tells whether the origin can be asked if the entry is still valid
+func (e *CacheEntry) HasValidators() bool {
+	return e.Headers.Get("ETag") != "" || e.Headers.Get("Last-Modified") != ""
+}
+
+// Conditional returns a copy of headers, those of a request, made to ask the origin whether the entry is still valid
+func (e *CacheEntry) Conditional(headers Headers) Headers {
+	headers = slices.Clone(headers).Del("If-None-Match").Del("If-Modified-Since").Del("If-Match").Del("If-Unmodified-Since").Del("If-Range")
+
+	if etag := e.Headers.Get("ETag"); etag != "" {
+		headers = append(headers, Header{"If-None-Match", etag})
+	}
+
+	if lastModified := e.Headers.Get("Last-Modified"); lastModified != "" {
+		headers = append(headers, Header{"If-Modified-Since", lastModified})
+	}
+
+	return headers
+}
+
+// NotModified tells whether the conditionals of req match the entry, which then answers 304 Not Modified
+func (e *CacheEntry) NotModified(req Request) bool {
+	if e.StatusCode != 200 {
+		return false
+	}
+
+	if inm := req.Headers.Values("If-None-Match"); len(inm) > 0 {
+		etag := strings.TrimPrefix(e.Headers.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+
+		for _, v := range inm {
+			for _, t := range strings.Split(v, ",") {
+				// weak comparison, RFC 9110 13.1.2
+				if t = strings.TrimSpace(t); t == "*" || strings.TrimPrefix(t, "W/") == etag {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(req.Headers.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	lastModified, err := http.ParseTime(e.Headers.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ims)
+}
+
+// At returns the response to answer with at now, with its Age header. The headers are a copy.
+func (e *CacheEntry) At(now time.Time) Response {
+	ret := e.Response
+
+	age := strconv.FormatInt(int64(e.Age(now)/time.Second), 10)
+	ret.Headers = append(slices.Clone(e.Headers).Del("Age"), Header{"Age", age})
+
+	return ret
+}
+
+// NotModifiedAt returns a 304 Not Modified answering a conditional request at now, RFC 9110 15.4.5
+func (e *CacheEntry) NotModifiedAt(now time.Time) Response {
+	ret := e.At(now)
+	ret.StatusCode, ret.Reason = 304, "Not Modified"
+
+	headers := ret.Headers[:0]
+	for _, h := range ret.Headers {
+		switch strings.ToLower(h.Name) {
+		case "content-length", "transfer-encoding", "content-encoding", "content-type", "content-range", "trailer":
+			continue
+		}
+		headers = append(headers, h)
+	}
+	ret.Headers = headers
+
+	return ret
+}
+
+func (e *CacheEntry) matchVary(req Request) bool {
+	return slices.Equal(e.vary, varyValues(e.Headers, req.Headers))
+}
+
+// varyValues returns the values of the request headers named by the Vary of the response headers
+func varyValues(resHeaders Headers, reqHeaders Headers) (ret []string) {
+	for _, v := range resHeaders.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				ret = append(ret, strings.Join(reqHeaders.Values(name), ","))
+			}
+		}
+	}
+	return
+}
+
+// Cache is a shared HTTP cache, RFC 9111, for a proxy. It keeps one response per URL, the variant matching the last
+// request if it has a Vary. The least recently used responses are evicted to stay under its size.
+// Responses are looked up by key, the absolute URL of their request.
+type Cache struct {
+	maxBytes      int64
+	maxEntryBytes int64
+
+	lock  sync.Mutex
+	bytes int64
+	lru   *lib.LRU[string, *CacheEntry]
+}
+
+// NewCache keeps up to maxBytes of responses, none larger than maxEntryBytes
+func NewCache(maxBytes int64, maxEntryBytes int64) *Cache {
+	return &Cache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: min(maxEntryBytes, maxBytes),
+		// bound by the bytes instead
+		lru: lib.NewLRU[string, *CacheEntry](math.MaxInt, 0),
+	}
+}
+
+// MaxEntryBytes is the largest body stored
+func (c *Cache) MaxEntryBytes() int64 {
+	return c.maxEntryBytes
+}
+
+// Bytes is the size of the stored responses
+func (c *Cache) Bytes() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.bytes
+}
+
+// Lookup returns the entry stored for req, nil if none matches it
+func (c *Cache) Lookup(key string, req Request) *CacheEntry {
+	if !Cacheable(req) {
+		return nil
+	}
+
+	c.lock.Lock()
+	e, ok := c.lru.Get(key)
+	c.lock.Unlock()
+
+	if !ok || !e.matchVary(req) {
+		return nil
+	}
+
+	return e
+}
+
+// Cacheable tells whether responses to req may be stored or served from the cache
+func Cacheable(req Request) bool {
+	return req.Method == "GET" && !ParseCacheControl(req.Headers).Has("no-store")
+}
+
+// Storable tells whether res, answering req, may be stored. length is that of its body, -1 if unknown.
+func (c *Cache) Storable(req Request, res Response, length int64) bool {
+	if !Cacheable(req) || length > c.maxEntryBytes {
+		return false
+	}
+
+	cc := ParseCacheControl(res.Headers)
+
+	// private responses are not for a shared cache, nor are those setting cookies
+	if cc.Has("no-store") || cc.Has("private") || res.Headers.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	if req.Headers.Get("Authorization") != "" && !cc.Has("public") && !cc.Has("s-maxage") && !cc.Has("must-revalidate") {
+		return false
+	}
+
+	if res.Headers.HasToken("Vary", "*") {
+		return false
+	}
+
+	explicit := cc.Has("s-maxage") || cc.Has("max-age") || res.Headers.Get("Expires") != ""
+
+	if explicit {
+		return res.StatusCode >= 200 && res.StatusCode != 206 && res.StatusCode != 304
+	}
+
+	// useless without a way to tell it is still valid
+	return heuristicStatus[res.StatusCode] && (res.Headers.Get("ETag") != "" || res.Headers.Get("Last-Modified") != "")
+}
+
+// Store keeps res and its body, which is not copied, answering req sent at requestTime and received at responseTime.
+// It returns false if it may not be stored.
+func (c *Cache) Store(key string, req Request, res Response, body []byte, requestTime time.Time, responseTime time.Time) bool {
+	if !c.Storable(req, res, int64(len(body))) {
+		return false
+	}
+
+	e := &CacheEntry{
+		Response: Response{
+			Version:    res.Version,
+			StatusCode: res.StatusCode,
+			Reason:     res.Reason,
+			Headers:    slices.Clone(res.Headers),
+		},
+		Body:         body,
+		vary:         varyValues(res.Headers, req.Headers),
+		requestTime:  requestTime,
+		responseTime: responseTime,
+	}
+
+	c.set(key, e)
+	return true
+}
+
+// Update refreshes e with the headers of res, a 304 Not Modified answering its revalidation, RFC 9111 4.3.4.
+// It returns the updated entry.
+func (c *Cache) Update(key string, e *CacheEntry, res Response, requestTime time.Time, responseTime time.Time) *CacheEntry {
+	updated := *e
+	updated.requestTime, updated.responseTime = requestTime, responseTime
+
+	headers := slices.Clone(e.Headers)
+	for _, h := range res.Headers {
+		switch strings.ToLower(h.Name) {
+		// describe the body of the 304, which has none
+		case "content-length", "transfer-encoding":
+			continue
+		}
+		headers = headers.Del(h.Name)
+	}
+
+	for _, h := range res.Headers {
+		switch strings.ToLower(h.Name) {
+		case "content-length", "transfer-encoding":
+			continue
+		}
+		headers = append(headers, h)
+	}
+
+	updated.Headers = headers
+
+	if ParseCacheControl(headers).Has("no-store") {
+		c.Invalidate(key)
+		return &updated
+	}
+
+	c.set(key, &updated)
+	return &updated
+}
+
+// Invalidate drops what is stored for key, e.g. after an unsafe request to it, RFC 9111 4.4
+func (c *Cache) Invalidate(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if e, ok := c.lru.Remove(key); ok {
+		c.bytes -= e.size
+	}
+}
+
+func (c *Cache) set(key string, e *CacheEntry) {
+	e.size = int64(len(e.Body)) + entryOverhead
+	for _, h := range e.Headers {
+		e.size += int64(len(h.Name) + len(h.Value))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if old, ok := c.lru.Remove(key); ok {
+		c.bytes -= old.size
+	}
+
+	if e.size > c.maxBytes {
+		return
+	}
+
+	c.lru.Set(key, e)
+	c.bytes += e.size
+
+	for c.bytes > c.maxBytes {
+		_, old, _ := c.lru.RemoveOldest()
+		c.bytes -= old.size
+	}
+}
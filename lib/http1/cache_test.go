@@ -0,0 +1,176 @@
+package http1
+
+import (
+	"lib/assert"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func request(method string, headers ...string) Request {
+	ret := Request{Method: method, Url: "http://example.com/a", Version: "HTTP/1.1"}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ": ")
+		ret.Headers = append(ret.Headers, Header{name, value})
+	}
+	return ret
+}
+
+func response(status int, headers ...string) Response {
+	ret := Response{Version: "HTTP/1.1", StatusCode: status, Reason: "R"}
+	for _, h := range headers {
+		name, value, _ := strings.Cut(h, ": ")
+		ret.Headers = append(ret.Headers, Header{name, value})
+	}
+	return ret
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(1<<20, 1<<10)
+	now := time.Now()
+	date := "Date: " + now.UTC().Format(http.TimeFormat)
+
+	req := request("GET")
+	ok := c.Store("k", req, response(200, date, "Cache-Control: max-age=60", "Content-Length: 4"), []byte("body"), now, now)
+	assert.Equal(t, true, ok)
+
+	e := c.Lookup("k", req)
+	assert.NotNull(t, e)
+	assert.Equal(t, "body", string(e.Body))
+	assert.Equal(t, true, e.Fresh(req, now.Add(time.Second*30)))
+	assert.Equal(t, false, e.Fresh(req, now.Add(time.Second*61)))
+	assert.Equal(t, "30", e.At(now.Add(time.Second*30)).Headers.Get("Age"))
+
+	// the client asks for fresher
+	assert.Equal(t, false, e.Fresh(request("GET", "Cache-Control: max-age=10"), now.Add(time.Second*30)))
+	assert.Equal(t, false, e.Fresh(request("GET", "Pragma: no-cache"), now))
+
+	assert.Null(t, c.Lookup("other", req))
+	assert.Null(t, c.Lookup("k", request("HEAD")))
+
+	c.Invalidate("k")
+	assert.Null(t, c.Lookup("k", req))
+	assert.Equal(t, int64(0), c.Bytes())
+}
+
+func TestCache_Storable(t *testing.T) {
+	c := NewCache(1<<20, 1<<10)
+	get := request("GET")
+
+	for _, tc := range []struct {
+		req    Request
+		res    Response
+		length int64
+		ok     bool
+	}{
+		{get, response(200, "Cache-Control: max-age=60"), 10, true},
+		{get, response(200, "ETag: \"a\""), -1, true},
+		{get, response(404, "Last-Modified: Mon, 02 Jan 2006 15:04:05 GMT"), 0, true},
+		{get, response(302, "Expires: Mon, 02 Jan 2006 15:04:05 GMT"), 0, true},
+		// no lifetime and no validators
+		{get, response(200), 10, false},
+		// not cacheable by default
+		{get, response(302, "ETag: \"a\""), 0, false},
+		{get, response(206, "Cache-Control: max-age=60"), 10, false},
+		{get, response(200, "Cache-Control: max-age=60"), 2 << 10, false},
+		{get, response(200, "Cache-Control: private, max-age=60"), 10, false},
+		{get, response(200, "Cache-Control: no-store"), 10, false},
+		{get, response(200, "Cache-Control: max-age=60", "Set-Cookie: a=b"), 10, false},
+		{get, response(200, "Cache-Control: max-age=60", "Vary: *"), 10, false},
+		{request("POST"), response(200, "Cache-Control: max-age=60"), 10, false},
+		{request("GET", "Cache-Control: no-store"), response(200, "Cache-Control: max-age=60"), 10, false},
+		{request("GET", "Authorization: x"), response(200, "Cache-Control: max-age=60"), 10, false},
+		{request("GET", "Authorization: x"), response(200, "Cache-Control: public, max-age=60"), 10, true},
+	} {
+		assert.Equal(t, tc.ok, c.Storable(tc.req, tc.res, tc.length))
+	}
+}
+
+func TestCache_Lifetime(t *testing.T) {
+	now := time.Now().UTC()
+	at := func(d time.Duration) string {
+		return now.Add(d).Format(http.TimeFormat)
+	}
+
+	for _, tc := range []struct {
+		res      Response
+		lifetime time.Duration
+	}{
+		{response(200, "Cache-Control: max-age=60, s-maxage=120"), time.Second * 120},
+		{response(200, "Cache-Control: max-age=60", "Expires: "+at(time.Hour)), time.Second * 60},
+		{response(200, "Date: "+at(0), "Expires: "+at(time.Hour)), time.Hour},
+		{response(200, "Expires: 0"), 0},
+		{response(200, "Date: "+at(0), "Last-Modified: "+at(-time.Hour*10)), time.Hour},
+		{response(200, "Date: "+at(0), "Last-Modified: "+at(-time.Hour*1000)), time.Hour * 24},
+		{response(302, "Date: "+at(0), "Last-Modified: "+at(-time.Hour*10)), 0},
+	} {
+		e := &CacheEntry{Response: tc.res, requestTime: now, responseTime: now}
+		assert.Equal(t, tc.lifetime, e.Lifetime())
+	}
+
+	// delays and Age of upstream caches count
+	e := &CacheEntry{Response: response(200, "Age: 100"), requestTime: now, responseTime: now.Add(time.Second * 2)}
+	assert.Equal(t, time.Second*105, e.Age(now.Add(time.Second*5)))
+}
+
+func TestCache_Vary(t *testing.T) {
+	c := NewCache(1<<20, 1<<10)
+	now := time.Now()
+
+	gzip := request("GET", "Accept-Encoding: gzip")
+	c.Store("k", gzip, response(200, "Cache-Control: max-age=60", "Vary: Accept-Encoding"), nil, now, now)
+
+	assert.NotNull(t, c.Lookup("k", gzip))
+	assert.Null(t, c.Lookup("k", request("GET")))
+	assert.Null(t, c.Lookup("k", request("GET", "Accept-Encoding: br")))
+}
+
+func TestCache_Revalidate(t *testing.T) {
+	c := NewCache(1<<20, 1<<10)
+	now := time.Now()
+	req := request("GET", "If-None-Match: \"old\"")
+
+	c.Store("k", req, response(200, "ETag: \"a\"", "Cache-Control: max-age=0", "Content-Length: 4"), []byte("body"), now, now)
+	e := c.Lookup("k", req)
+	assert.Equal(t, false, e.Fresh(req, now))
+
+	headers := e.Conditional(req.Headers)
+	assert.Equal(t, 1, len(headers.Values("If-None-Match")))
+	assert.Equal(t, "\"a\"", headers.Get("If-None-Match"))
+
+	later := now.Add(time.Minute)
+	e = c.Update("k", e, response(304, "Cache-Control: max-age=60", "Content-Length: 0"), later, later)
+	assert.Equal(t, "4", e.Headers.Get("Content-Length"))
+	assert.Equal(t, "\"a\"", e.Headers.Get("ETag"))
+	assert.Equal(t, true, e.Fresh(req, later))
+	assert.Equal(t, true, c.Lookup("k", req).Fresh(req, later))
+
+	// conditionals of the client
+	assert.Equal(t, false, e.NotModified(req))
+	assert.Equal(t, true, e.NotModified(request("GET", "If-None-Match: \"b\", W/\"a\"")))
+
+	res := e.NotModifiedAt(later)
+	assert.Equal(t, 304, res.StatusCode)
+	assert.Equal(t, "", res.Headers.Get("Content-Length"))
+	assert.Equal(t, "\"a\"", res.Headers.Get("ETag"))
+}
+
+func TestCache_Evict(t *testing.T) {
+	c := NewCache(3*entryOverhead, entryOverhead)
+	now := time.Now()
+	req := request("GET")
+	res := response(200, "Cache-Control: max-age=60")
+	size := int64(entryOverhead + len("Cache-Control") + len("max-age=60"))
+
+	for _, k := range []string{"a", "b", "c"} {
+		assert.Equal(t, true, c.Store(k, req, res, nil, now, now))
+	}
+
+	assert.Equal(t, 2*size, c.Bytes())
+	assert.Null(t, c.Lookup("a", req))
+	assert.NotNull(t, c.Lookup("c", req))
+
+	// larger than an entry may be
+	assert.Equal(t, false, c.Store("d", req, res, make([]byte, entryOverhead+1), now, now))
+}
@@ -0,0 +1,337 @@
+package http1
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Header keeps the name as sent. Duplicate headers stay separate entries in their original order.
+type Header struct {
+	Name  string
+	Value string
+}
+
+type Headers []Header
+
+// Get returns the first value of name, which is case insensitive
+func (h Headers) Get(name string) string {
+	for _, v := range h {
+		if strings.EqualFold(v.Name, name) {
+			return v.Value
+		}
+	}
+	return ""
+}
+
+// Values returns every value of name in order
+func (h Headers) Values(name string) (ret []string) {
+	for _, v := range h {
+		if strings.EqualFold(v.Name, name) {
+			ret = append(ret, v.Value)
+		}
+	}
+	return
+}
+
+// HasToken checks the comma separated values of every name header for token, e.g. "close" in Connection
+func (h Headers) HasToken(name string, token string) bool {
+	for _, v := range h {
+		if !strings.EqualFold(v.Name, name) {
+			continue
+		}
+
+		for _, t := range strings.Split(v.Value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Del removes every name header, in place
+func (h Headers) Del(name string) Headers {
+	ret := h[:0]
+	for _, v := range h {
+		if !strings.EqualFold(v.Name, name) {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// Build writes the headers in wire format, without the empty line ending them
+func (h Headers) Build(sb *strings.Builder) {
+	for _, v := range h {
+		sb.WriteString(v.Name)
+		sb.WriteString(": ")
+		sb.WriteString(v.Value)
+		sb.WriteString("\r\n")
+	}
+}
+
+type Request struct {
+	Method  string
+	Url     string
+	Version string
+	Headers Headers
+}
+
+type Response struct {
+	Version    string
+	StatusCode int
+	Reason     string
+	Headers    Headers
+}
+
+// Limits bound what is read of a message before giving up on it
+type Limits struct {
+	// start line and headers together, including line breaks
+	MaxHeaderBytes int
+	MaxHeaders     int
+}
+
+var DefaultLimits = Limits{
+	MaxHeaderBytes: 64 * 1024,
+	MaxHeaders:     100,
+}
+
+var ErrMalformed = errors.New("malformed HTTP message")
+var ErrHeaderTooLarge = errors.New("HTTP header too large")
+var ErrTooManyHeaders = errors.New("too many HTTP headers")
+
+// Error rejects a message. Errors of the underlying reader are returned as they are.
+type Error struct {
+	Err error
+	// line of the head where parsing stopped, from 1
+	Line int
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error() + " at line " + strconv.Itoa(e.Line)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode is the status to reject a request with: 431 if it exceeds the limits, 400 otherwise
+func (e *Error) StatusCode() int {
+	if e.Err == ErrHeaderTooLarge || e.Err == ErrTooManyHeaders {
+		return 431
+	}
+	return 400
+}
+
+var badRequestResponse = []byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+var headerTooLargeResponse = []byte("HTTP/1.1 431 Request Header Fields Too Large\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+// Reject returns the response to a request that failed with err, or nil if err is not an Error,
+// e.g. the client went away
+func Reject(err error) []byte {
+	var e *Error
+	if !errors.As(err, &e) {
+		return nil
+	}
+
+	if e.StatusCode() == 431 {
+		return headerTooLargeResponse
+	}
+	return badRequestResponse
+}
+
+// readHead copies the start line and headers out of r, up to and including the empty line after them.
+// Lines end with CRLF or a bare LF. Empty lines before the start line are skipped, and obs-folds unfolded.
+func readHead(r *bufio.Reader, limits Limits) (head []byte, err error) {
+	// one allocation when the whole head is buffered already
+	head = make([]byte, 0, min(max(r.Buffered(), 512), limits.MaxHeaderBytes))
+
+	read, lines, lineStart := 0, 1, 0
+
+	for {
+		b, e := r.ReadSlice('\n')
+
+		if read += len(b); read > limits.MaxHeaderBytes {
+			return nil, &Error{ErrHeaderTooLarge, lines}
+		}
+
+		head = append(head, b...)
+
+		if e == bufio.ErrBufferFull {
+			continue
+		}
+
+		if e != nil {
+			if e == io.EOF && read > 0 {
+				e = io.ErrUnexpectedEOF
+			}
+			return nil, e
+		}
+
+		line := head[lineStart:]
+
+		if len(line) == 1 || (len(line) == 2 && line[0] == '\r') {
+			if lineStart == 0 {
+				head = head[:0]
+				continue
+			}
+
+			unfold(head, bytes.IndexByte(head, '\n')+1)
+			return head, nil
+		}
+
+		lineStart = len(head)
+		lines++
+	}
+}
+
+// nextLine returns the line of s starting at i without its line break, and where the next one starts
+func nextLine(s string, i int) (line string, next int) {
+	end := i + strings.IndexByte(s[i:], '\n')
+	next = end + 1
+
+	if end > i && s[end-1] == '\r' {
+		end--
+	}
+
+	return s[i:end], next
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validValue rejects control characters but tab, including a CR not followed by LF
+func validValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func isVersion(s string) bool {
+	return len(s) == 8 && strings.HasPrefix(s, "HTTP/") && s[5] >= '0' && s[5] <= '9' && s[6] == '.' && s[7] >= '0' && s[7] <= '9'
+}
+
+func trimSpace(s string) string {
+	return strings.Trim(s, " \t")
+}
+
+// unfold replaces the line break of each obs-fold continuation line with spaces, in place, so every value
+// stays a single slice of head. A continuation of the start line is left to fail as a malformed header.
+func unfold(head []byte, i int) {
+	for {
+		n := bytes.IndexByte(head[i:], '\n')
+		if n < 0 || i+n+1 >= len(head) {
+			return
+		}
+
+		i += n + 1
+		if c := head[i]; c != ' ' && c != '\t' {
+			continue
+		}
+
+		head[i-1] = ' '
+		if i >= 2 && head[i-2] == '\r' {
+			head[i-2] = ' '
+		}
+	}
+}
+
+// parseHeaders parses the header lines of s, which start at i. Names and values are not copied out of s.
+func parseHeaders(s string, i int, limits Limits) (Headers, error) {
+	// upper bound, less the empty line
+	headers := make(Headers, 0, min(strings.Count(s[i:], "\n")-1, limits.MaxHeaders))
+
+	for lineNo := 2; ; lineNo++ {
+		line, next := nextLine(s, i)
+		i = next
+
+		if line == "" {
+			break
+		}
+
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 || !isToken(line[:colon]) || !validValue(line[colon+1:]) {
+			return nil, &Error{ErrMalformed, lineNo}
+		}
+
+		if len(headers) == limits.MaxHeaders {
+			return nil, &Error{ErrTooManyHeaders, lineNo}
+		}
+
+		headers = append(headers, Header{line[:colon], trimSpace(line[colon+1:])})
+	}
+
+	return headers, nil
+}
+
+// view returns head as a string without copying. head must not change afterwards.
+func view(head []byte) string {
+	return unsafe.String(unsafe.SliceData(head), len(head))
+}
+
+// ReadRequest reads the request line and headers, leaving the body in r.
+// Fields of the request share a single copy of the head.
+func ReadRequest(r *bufio.Reader, limits Limits) (ret Request, err error) {
+	head, err := readHead(r, limits)
+	if err != nil {
+		return
+	}
+
+	s := view(head)
+	line, i := nextLine(s, 0)
+
+	method, rest, _ := strings.Cut(line, " ")
+	url, version, _ := strings.Cut(rest, " ")
+
+	if !isToken(method) || url == "" || strings.IndexByte(url, ' ') >= 0 || !isVersion(version) {
+		err = &Error{ErrMalformed, 1}
+		return
+	}
+
+	ret.Method, ret.Url, ret.Version = method, url, version
+	ret.Headers, err = parseHeaders(s, i, limits)
+	return
+}
+
+// ReadResponse reads the status line and headers, leaving the body in r
+func ReadResponse(r *bufio.Reader, limits Limits) (ret Response, err error) {
+	head, err := readHead(r, limits)
+	if err != nil {
+		return
+	}
+
+	s := view(head)
+	line, i := nextLine(s, 0)
+
+	version, rest, _ := strings.Cut(line, " ")
+	code, reason, _ := strings.Cut(rest, " ")
+
+	status, e := strconv.Atoi(code)
+	if !isVersion(version) || len(code) != 3 || e != nil || status < 100 {
+		err = &Error{ErrMalformed, 1}
+		return
+	}
+
+	ret.Version, ret.StatusCode, ret.Reason = version, status, reason
+	ret.Headers, err = parseHeaders(s, i, limits)
+	return
+}
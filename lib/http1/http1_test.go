@@ -0,0 +1,151 @@
+package http1
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"lib/assert"
+	"strings"
+	"testing"
+)
+
+func reader(s string) *bufio.Reader {
+	return bufio.NewReader(strings.NewReader(s))
+}
+
+func TestReadRequest(t *testing.T) {
+	r := reader("GET http://example.com/a?b HTTP/1.1\r\nHost:example.com\r\nAccept: \t*/* \r\nX-Dup: 1\r\nx-dup: 2\r\n\r\nbody")
+
+	req, err := ReadRequest(r, DefaultLimits)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "GET", req.Method)
+	assert.Equal(t, "http://example.com/a?b", req.Url)
+	assert.Equal(t, "HTTP/1.1", req.Version)
+	assert.Equal(t, 4, len(req.Headers))
+	assert.Equal(t, "example.com", req.Headers.Get("host"))
+	assert.Equal(t, "*/*", req.Headers.Get("Accept"))
+
+	dup := req.Headers.Values("X-DUP")
+	assert.Equal(t, 2, len(dup))
+	assert.Equal(t, "1", dup[0])
+	assert.Equal(t, "2", dup[1])
+
+	// duplicates keep the name as sent
+	assert.Equal(t, "x-dup", req.Headers[3].Name)
+
+	rest, _ := io.ReadAll(r)
+	assert.Equal(t, "body", string(rest))
+}
+
+func TestReadRequest_Lenient(t *testing.T) {
+	// bare LF, leading empty lines and obs-fold
+	r := reader("\r\n\nGET / HTTP/1.0\nX-Fold: a\r\n  b\r\n\tc\r\nHost: h\n\n")
+
+	req, err := ReadRequest(r, DefaultLimits)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "/", req.Url)
+	assert.Equal(t, 2, len(req.Headers))
+	assert.Equal(t, "h", req.Headers.Get("Host"))
+
+	folded := req.Headers.Get("X-Fold")
+	assert.Equal(t, "a", folded[:1])
+	assert.Equal(t, "c", folded[len(folded)-1:])
+	assert.Equal(t, "a b c", strings.Join(strings.Fields(folded), " "))
+}
+
+func TestReadRequest_Malformed(t *testing.T) {
+	for _, s := range []string{
+		"\r\n\r\nGET /\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost : h\r\n\r\n",
+		"GET / HTTP/1.1\r\n: h\r\n\r\n",
+		"GET / HTTP/1.1\r\n Host: h\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: a\rb\r\n\r\n",
+		"GET  / HTTP/1.1\r\n\r\n",
+		"GET / HTTP/1.1 \r\n\r\n",
+		"GET / FTP/1.1\r\n\r\n",
+	} {
+		_, err := ReadRequest(reader(s), DefaultLimits)
+
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Errorf("%q: got %v", s, err)
+			continue
+		}
+
+		assert.Equal(t, true, errors.Is(err, ErrMalformed))
+		assert.Equal(t, 400, e.StatusCode())
+		assert.Equal(t, string(badRequestResponse), string(Reject(err)))
+	}
+}
+
+func TestReadRequest_Limits(t *testing.T) {
+	limits := Limits{MaxHeaderBytes: 64, MaxHeaders: 2}
+
+	_, err := ReadRequest(reader("GET / HTTP/1.1\r\nA: 1\r\nB: 2\r\nC: 3\r\n\r\n"), limits)
+	assert.Equal(t, true, errors.Is(err, ErrTooManyHeaders))
+	assert.Equal(t, string(headerTooLargeResponse), string(Reject(err)))
+
+	// longer than the buffer of the reader too
+	_, err = ReadRequest(bufio.NewReaderSize(strings.NewReader("GET / HTTP/1.1\r\nA: "+strings.Repeat("a", 100)+"\r\n\r\n"), 16), limits)
+	assert.Equal(t, true, errors.Is(err, ErrHeaderTooLarge))
+	assert.Equal(t, string(headerTooLargeResponse), string(Reject(err)))
+
+	req, err := ReadRequest(bufio.NewReaderSize(strings.NewReader("GET / HTTP/1.1\r\nA: "+strings.Repeat("a", 20)+"\r\n\r\n"), 16), limits)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 20, len(req.Headers.Get("a")))
+}
+
+func TestReadRequest_Truncated(t *testing.T) {
+	for _, s := range []string{"", "G", "GET / HTTP/1.1\r\n", "GET / HTTP/1.1\r\nHost: h\r"} {
+		_, err := ReadRequest(reader(s), DefaultLimits)
+		assert.Equal(t, true, err == io.EOF || err == io.ErrUnexpectedEOF)
+		assert.Null(t, Reject(err))
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	res, err := ReadResponse(reader("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"), DefaultLimits)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "HTTP/1.1", res.Version)
+	assert.Equal(t, 404, res.StatusCode)
+	assert.Equal(t, "Not Found", res.Reason)
+	assert.Equal(t, "0", res.Headers.Get("content-length"))
+
+	res, err = ReadResponse(reader("HTTP/1.1 204\r\n\r\n"), DefaultLimits)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 204, res.StatusCode)
+
+	_, err = ReadResponse(reader("HTTP/1.1 20 OK\r\n\r\n"), DefaultLimits)
+	assert.Equal(t, true, errors.Is(err, ErrMalformed))
+}
+
+func TestHeaders(t *testing.T) {
+	h := Headers{{"Connection", "keep-alive, Upgrade"}, {"Upgrade", "websocket"}, {"connection", "close"}}
+
+	assert.Equal(t, true, h.HasToken("connection", "upgrade"))
+	assert.Equal(t, true, h.HasToken("Connection", "close"))
+	assert.Equal(t, false, h.HasToken("Upgrade", "close"))
+
+	h = h.Del("CONNECTION")
+	assert.Equal(t, 1, len(h))
+
+	sb := strings.Builder{}
+	h.Build(&sb)
+	assert.Equal(t, "Upgrade: websocket\r\n", sb.String())
+}
+
+func TestReadRequest_Allocs(t *testing.T) {
+	s := "GET / HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\nUser-Agent: test\r\n\r\n"
+	sr := strings.NewReader(s)
+	r := bufio.NewReader(sr)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		sr.Reset(s)
+		r.Reset(sr)
+		ReadRequest(r, DefaultLimits)
+	})
+
+	// the head and the headers, regardless of their number
+	assert.Equal(t, true, allocs <= 2)
+}
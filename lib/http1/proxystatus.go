@@ -0,0 +1,191 @@
+package http1
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Error types of https://www.rfc-editor.org/rfc/rfc9209 used by the proxies
+const (
+	DnsTimeout              = "dns_timeout"
+	DnsError                = "dns_error"
+	DestinationUnavailable  = "destination_unavailable"
+	DestinationIpProhibited = "destination_ip_prohibited"
+	DestinationIpUnroutable = "destination_ip_unroutable"
+	ConnectionRefused       = "connection_refused"
+	ConnectionTimeout       = "connection_timeout"
+	ConnectionLimitReached  = "connection_limit_reached"
+	HttpRequestError        = "http_request_error"
+	HttpRequestDenied       = "http_request_denied"
+	HttpProtocolError       = "http_protocol_error"
+	TlsProtocolError        = "tls_protocol_error"
+	TlsCertificateError     = "tls_certificate_error"
+)
+
+// ProxyStatus tells why a proxy failed to reach the destination, as the Proxy-Status header of RFC 9209
+type ProxyStatus struct {
+	// the proxy reporting the error, a token
+	Proxy      string
+	StatusCode int
+	ErrorType  string
+	Details    string
+}
+
+func (s *ProxyStatus) Error() string {
+	if s.Details == "" {
+		return s.Proxy + ": " + s.ErrorType
+	}
+	return s.Proxy + ": " + s.ErrorType + ": " + s.Details
+}
+
+// DialStatus classifies an error dialing the destination, or the TLS handshake with it: 504 for timeouts, 502 otherwise
+func DialStatus(proxy string, err error) *ProxyStatus {
+	ret := &ProxyStatus{
+		Proxy:      proxy,
+		StatusCode: http.StatusBadGateway,
+		ErrorType:  DestinationUnavailable,
+		Details:    err.Error(),
+	}
+
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var opErr *net.OpError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsTimeout:
+		ret.StatusCode, ret.ErrorType = http.StatusGatewayTimeout, DnsTimeout
+	case errors.As(err, &dnsErr):
+		ret.ErrorType = DnsError
+	case errors.Is(err, syscall.ECONNREFUSED):
+		ret.ErrorType = ConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		ret.ErrorType = DestinationIpUnroutable
+	case errors.As(err, &certErr):
+		ret.ErrorType = TlsCertificateError
+	case errors.As(err, &recordErr), errors.As(err, &opErr) && opErr.Op == "remote error":
+		// not TLS, or an alert of the destination
+		ret.ErrorType = TlsProtocolError
+	case errors.As(err, &netErr) && netErr.Timeout():
+		ret.StatusCode, ret.ErrorType = http.StatusGatewayTimeout, ConnectionTimeout
+	}
+
+	return ret
+}
+
+// quote makes an sf-string of s. Characters it cannot carry become '?'.
+func quote(s string) string {
+	sb := strings.Builder{}
+	sb.WriteByte('"')
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c < ' ' || c >= 0x7f:
+			sb.WriteByte('?')
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+
+	sb := strings.Builder{}
+	for i := 1; i < len(s)-1; i++ {
+		if s[i] == '\\' && i+1 < len(s)-1 {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+
+	return sb.String()
+}
+
+// splitUnquoted splits s on sep outside of sf-strings
+func splitUnquoted(s string, sep byte) (ret []string) {
+	quoted, from := false, 0
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quoted && c == '\\':
+			i++
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			ret = append(ret, s[from:i])
+			from = i + 1
+		}
+	}
+
+	return append(ret, s[from:])
+}
+
+// Header is the value of the Proxy-Status header
+func (s *ProxyStatus) Header() string {
+	ret := s.Proxy + "; error=" + s.ErrorType
+	if s.Details != "" {
+		ret += "; details=" + quote(s.Details)
+	}
+	return ret
+}
+
+// ParseProxyStatus reads the status a proxy rejected a request with. The first member of Proxy-Status is
+// the proxy closest to the destination. Without the header, the error type is left empty.
+func ParseProxyStatus(res Response) *ProxyStatus {
+	ret := &ProxyStatus{
+		StatusCode: res.StatusCode,
+		Details:    res.Reason,
+	}
+
+	value := res.Headers.Get("Proxy-Status")
+	if value == "" {
+		return ret
+	}
+
+	params := splitUnquoted(splitUnquoted(value, ',')[0], ';')
+	ret.Proxy = unquote(strings.TrimSpace(params[0]))
+
+	for _, p := range params[1:] {
+		k, v, _ := strings.Cut(p, "=")
+
+		switch strings.TrimSpace(k) {
+		case "error":
+			ret.ErrorType = strings.TrimSpace(v)
+		case "details":
+			ret.Details = unquote(strings.TrimSpace(v))
+		}
+	}
+
+	return ret
+}
+
+// Response answers the request with the status, and a short diagnostic body
+func (s *ProxyStatus) Response() []byte {
+	status := strconv.Itoa(s.StatusCode) + " " + http.StatusText(s.StatusCode)
+	body := status + "\n" + s.Error() + "\n"
+
+	sb := strings.Builder{}
+	sb.WriteString("HTTP/1.1 " + status + "\r\n")
+	sb.WriteString("Proxy-Status: " + s.Header() + "\r\n")
+	sb.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	sb.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\r\n")
+	sb.WriteString("Connection: close\r\n\r\n")
+	sb.WriteString(body)
+
+	return []byte(sb.String())
+}
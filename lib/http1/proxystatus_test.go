@@ -0,0 +1,109 @@
+package http1
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"lib/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyStatus_RoundTrip(t *testing.T) {
+	status := &ProxyStatus{
+		Proxy:      "smp-server",
+		StatusCode: 502,
+		ErrorType:  DnsError,
+		Details:    `lookup "a;b,c" \ failed` + "\n",
+	}
+
+	res, err := ReadResponse(reader(string(status.Response())), DefaultLimits)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 502, res.StatusCode)
+	assert.Equal(t, "Bad Gateway", res.Reason)
+
+	got := ParseProxyStatus(res)
+	assert.Equal(t, "smp-server", got.Proxy)
+	assert.Equal(t, 502, got.StatusCode)
+	assert.Equal(t, DnsError, got.ErrorType)
+	assert.Equal(t, `lookup "a;b,c" \ failed?`, got.Details)
+}
+
+func TestProxyStatus_Parse(t *testing.T) {
+	res := Response{
+		StatusCode: 504,
+		Reason:     "Gateway Timeout",
+		Headers:    Headers{{Name: "Proxy-Status", Value: `inner ; error=connection_timeout ;details="x, y", outer; error=http_protocol_error`}},
+	}
+
+	got := ParseProxyStatus(res)
+	assert.Equal(t, "inner", got.Proxy)
+	assert.Equal(t, ConnectionTimeout, got.ErrorType)
+	assert.Equal(t, "x, y", got.Details)
+
+	// without the header
+	res.Headers = nil
+	got = ParseProxyStatus(res)
+	assert.Equal(t, "", got.ErrorType)
+	assert.Equal(t, "Gateway Timeout", got.Details)
+}
+
+func TestDialStatus(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = net.Dial("tcp", addr)
+	status := DialStatus("p", err)
+	assert.Equal(t, 502, status.StatusCode)
+	assert.Equal(t, ConnectionRefused, status.ErrorType)
+
+	status = DialStatus("p", &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true})
+	assert.Equal(t, 502, status.StatusCode)
+	assert.Equal(t, DnsError, status.ErrorType)
+
+	status = DialStatus("p", &net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true})
+	assert.Equal(t, 504, status.StatusCode)
+	assert.Equal(t, DnsTimeout, status.ErrorType)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	d := net.Dialer{}
+	_, err = d.DialContext(ctx, "tcp", addr)
+	status = DialStatus("p", err)
+	assert.Equal(t, 504, status.StatusCode)
+	assert.Equal(t, ConnectionTimeout, status.ErrorType)
+}
+
+func TestDialStatus_Tls(t *testing.T) {
+	handshake := func(server func(net.Conn)) error {
+		client, conn := net.Pipe()
+		go func() {
+			server(conn)
+			conn.Close()
+		}()
+		defer client.Close()
+		return tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	}
+
+	// not TLS
+	err := handshake(func(conn net.Conn) {
+		// the client hello record
+		header := make([]byte, 5)
+		io.ReadFull(conn, header)
+		io.ReadFull(conn, make([]byte, int(header[3])<<8|int(header[4])))
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+	})
+	status := DialStatus("p", err)
+	assert.Equal(t, 502, status.StatusCode)
+	assert.Equal(t, TlsProtocolError, status.ErrorType)
+
+	status = DialStatus("p", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}})
+	assert.Equal(t, 502, status.StatusCode)
+	assert.Equal(t, TlsCertificateError, status.ErrorType)
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/gob"
 	"encoding/json"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -19,10 +20,20 @@ type HttpClient struct {
 	*http.Client
 }
 
-func (hc *HttpClient) Init(timeoutSec int, maxIdleConns int, connsPerHost int) {
+// Init makes the client. Hosts are resolved with resolver if given instead of net.DefaultResolver, e.g. one caching
+// answers from lib/dns.
+func (hc *HttpClient) Init(timeoutSec int, maxIdleConns int, connsPerHost int, resolver ...*net.Resolver) {
 	t := http.DefaultTransport.(*http.Transport).Clone()
 
-	// TODO add DNS cache
+	if resolver != nil {
+		dialer := &net.Dialer{
+			Timeout:   time.Second * 30,
+			KeepAlive: time.Second * 30,
+			Resolver:  resolver[0],
+		}
+		t.DialContext = dialer.DialContext
+	}
+
 	t.MaxIdleConns = maxIdleConns
 	t.MaxConnsPerHost = connsPerHost
 	t.MaxIdleConnsPerHost = connsPerHost
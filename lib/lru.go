@@ -11,6 +11,8 @@ type LRU[TKey comparable, T any] struct {
 	dict   map[TKey]*list.Element
 	list   *list.List
 	length int
+	// called with what Set evicts past the length
+	OnEvict func(key TKey, value T)
 }
 
 func NewLRU[TKey comparable, T any](len int, cap int) *LRU[TKey, T] {
@@ -46,7 +48,35 @@ func (l *LRU[TKey, T]) Set(key TKey, value T) {
 	l.dict[key] = node
 
 	if l.list.Len() > l.length {
-		nodeValue := l.list.Remove(l.list.Back()).(*lruValue[TKey, T])
-		delete(l.dict, nodeValue.key)
+		key, value, _ := l.RemoveOldest()
+		if l.OnEvict != nil {
+			l.OnEvict(key, value)
+		}
 	}
 }
+
+func (l *LRU[TKey, T]) Remove(key TKey) (ret T, ok bool) {
+	node, ok := l.dict[key]
+	if ok {
+		ret = l.list.Remove(node).(*lruValue[TKey, T]).value
+		delete(l.dict, key)
+	}
+
+	return
+}
+
+// RemoveOldest removes the least recently used entry, ok is false if there is none
+func (l *LRU[TKey, T]) RemoveOldest() (key TKey, value T, ok bool) {
+	node := l.list.Back()
+	if node == nil {
+		return
+	}
+
+	nodeValue := l.list.Remove(node).(*lruValue[TKey, T])
+	delete(l.dict, nodeValue.key)
+	return nodeValue.key, nodeValue.value, true
+}
+
+func (l *LRU[TKey, T]) Len() int {
+	return l.list.Len()
+}
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"lib/assert"
+	"strings"
 	"testing"
 )
 
@@ -29,3 +30,36 @@ func TestLRU(t *testing.T) {
 	_, ok = rt.Get("abc4")
 	assert.Equal(t, false, ok)
 }
+
+func TestLRU_Remove(t *testing.T) {
+	rt := NewLRU[string, int](2, 1)
+
+	var evicted []string
+	rt.OnEvict = func(key string, _ int) {
+		evicted = append(evicted, key)
+	}
+
+	rt.Set("a", 1)
+	rt.Set("b", 2)
+	rt.Set("c", 3)
+	assert.Equal(t, "a", strings.Join(evicted, ","))
+	assert.Equal(t, 2, rt.Len())
+
+	v, ok := rt.Remove("b")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 2, v)
+
+	_, ok = rt.Remove("b")
+	assert.Equal(t, false, ok)
+
+	key, v, ok := rt.RemoveOldest()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "c", key)
+	assert.Equal(t, 3, v)
+
+	_, _, ok = rt.RemoveOldest()
+	assert.Equal(t, false, ok)
+	assert.Equal(t, 0, rt.Len())
+	// removed, not evicted
+	assert.Equal(t, "a", strings.Join(evicted, ","))
+}
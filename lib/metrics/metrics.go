@@ -0,0 +1,324 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType of the Prometheus text format Registry.Write renders
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefBuckets suit latencies in seconds, from 5ms to 10s
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(sb *strings.Builder)
+}
+
+// Registry renders the metrics registered with it, in the order they are registered
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// Write renders all metrics in the Prometheus text format
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.lock.Unlock()
+
+	sb := strings.Builder{}
+	for _, m := range metrics {
+		m.write(&sb)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(sb *strings.Builder) {
+	sb.WriteString("# HELP " + d.name + " " + escape(d.help, false) + "\n")
+	sb.WriteString("# TYPE " + d.name + " " + d.kind + "\n")
+}
+
+// sample writes a line of name with the labels of the series, and extra labels after them
+func (d *desc) sample(sb *strings.Builder, suffix string, values []string, value string, extra ...string) {
+	sb.WriteString(d.name + suffix)
+
+	if len(values)+len(extra) > 0 {
+		sb.WriteByte('{')
+		for i, v := range values {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(d.labels[i] + `="` + escape(v, true) + `"`)
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			if len(values) > 0 || i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(extra[i] + `="` + escape(extra[i+1], true) + `"`)
+		}
+		sb.WriteByte('}')
+	}
+
+	sb.WriteString(" " + value + "\n")
+}
+
+func escape(s string, quote bool) string {
+	if !strings.ContainsAny(s, "\\\n\"") {
+		return s
+	}
+
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type entry[T any] struct {
+	values []string
+	value  *T
+}
+
+// series holds a value for each combination of label values
+type series[T any] struct {
+	values sync.Map
+	labels int
+	new    func() *T
+}
+
+func (s *series[T]) with(values []string) *T {
+	if len(values) != s.labels {
+		panic("metrics: expected " + strconv.Itoa(s.labels) + " label values, got " + strconv.Itoa(len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	if v, ok := s.values.Load(key); ok {
+		return v.(*entry[T]).value
+	}
+
+	v, _ := s.values.LoadOrStore(key, &entry[T]{values: slices.Clone(values), value: s.new()})
+	return v.(*entry[T]).value
+}
+
+// each visits the series sorted by label values, so the output is stable
+func (s *series[T]) each(fn func(values []string, value *T)) {
+	var entries []*entry[T]
+	s.values.Range(func(_, v any) bool {
+		entries = append(entries, v.(*entry[T]))
+		return true
+	})
+
+	sort.Slice(entries, func(i, j int) bool {
+		return slices.Compare(entries[i].values, entries[j].values) < 0
+	})
+
+	for _, e := range entries {
+		fn(e.values, e.value)
+	}
+}
+
+// CounterValue only goes up
+type CounterValue struct {
+	v atomic.Uint64
+}
+
+func (c *CounterValue) Inc() {
+	c.v.Add(1)
+}
+
+func (c *CounterValue) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *CounterValue) Get() uint64 {
+	return c.v.Load()
+}
+
+type Counter struct {
+	desc
+	series[CounterValue]
+}
+
+func NewCounter(r *Registry, name string, help string, labels ...string) *Counter {
+	ret := &Counter{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		series: series[CounterValue]{labels: len(labels), new: func() *CounterValue { return &CounterValue{} }},
+	}
+	r.register(ret)
+	return ret
+}
+
+// With returns the series of the label values, in the order the labels were declared
+func (c *Counter) With(values ...string) *CounterValue {
+	return c.with(values)
+}
+
+func (c *Counter) write(sb *strings.Builder) {
+	c.header(sb)
+	c.each(func(values []string, v *CounterValue) {
+		c.sample(sb, "", values, strconv.FormatUint(v.Get(), 10))
+	})
+}
+
+// GaugeValue goes up and down
+type GaugeValue struct {
+	bits atomic.Uint64
+}
+
+func (g *GaugeValue) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+func (g *GaugeValue) Add(v float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (g *GaugeValue) Inc() {
+	g.Add(1)
+}
+
+func (g *GaugeValue) Dec() {
+	g.Add(-1)
+}
+
+func (g *GaugeValue) Get() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+type Gauge struct {
+	desc
+	series[GaugeValue]
+}
+
+func NewGauge(r *Registry, name string, help string, labels ...string) *Gauge {
+	ret := &Gauge{
+		desc:   desc{name: name, help: help, kind: "gauge", labels: labels},
+		series: series[GaugeValue]{labels: len(labels), new: func() *GaugeValue { return &GaugeValue{} }},
+	}
+	r.register(ret)
+	return ret
+}
+
+// With returns the series of the label values, in the order the labels were declared
+func (g *Gauge) With(values ...string) *GaugeValue {
+	return g.with(values)
+}
+
+func (g *Gauge) write(sb *strings.Builder) {
+	g.header(sb)
+	g.each(func(values []string, v *GaugeValue) {
+		g.sample(sb, "", values, formatFloat(v.Get()))
+	})
+}
+
+// HistogramValue counts observations in buckets of their upper bounds
+type HistogramValue struct {
+	buckets []float64
+	// one more than buckets, for those above the last bound
+	counts []atomic.Uint64
+	sum    GaugeValue
+}
+
+func (h *HistogramValue) Observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.buckets, v)].Add(1)
+	h.sum.Add(v)
+}
+
+type Histogram struct {
+	desc
+	series[HistogramValue]
+}
+
+// NewHistogram counts observations in buckets, sorted upper bounds not including +Inf
+func NewHistogram(r *Registry, name string, help string, buckets []float64, labels ...string) *Histogram {
+	ret := &Histogram{
+		desc: desc{name: name, help: help, kind: "histogram", labels: labels},
+		series: series[HistogramValue]{labels: len(labels), new: func() *HistogramValue {
+			return &HistogramValue{buckets: buckets, counts: make([]atomic.Uint64, len(buckets)+1)}
+		}},
+	}
+	r.register(ret)
+	return ret
+}
+
+// With returns the series of the label values, in the order the labels were declared
+func (h *Histogram) With(values ...string) *HistogramValue {
+	return h.with(values)
+}
+
+func (h *Histogram) write(sb *strings.Builder) {
+	h.header(sb)
+	h.each(func(values []string, v *HistogramValue) {
+		count := uint64(0)
+		for i, b := range v.buckets {
+			count += v.counts[i].Load()
+			h.sample(sb, "_bucket", values, strconv.FormatUint(count, 10), "le", formatFloat(b))
+		}
+		count += v.counts[len(v.buckets)].Load()
+		h.sample(sb, "_bucket", values, strconv.FormatUint(count, 10), "le", "+Inf")
+		h.sample(sb, "_sum", values, formatFloat(v.sum.Get()))
+		h.sample(sb, "_count", values, strconv.FormatUint(count, 10))
+	})
+}
+
+// funcMetric reports what fn returns when rendered, for values kept elsewhere
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+func (f *funcMetric) write(sb *strings.Builder) {
+	f.header(sb)
+	f.sample(sb, "", nil, formatFloat(f.fn()))
+}
+
+func NewGaugeFunc(r *Registry, name string, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, kind: "gauge"}, fn: fn})
+}
+
+func NewCounterFunc(r *Registry, name string, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{name: name, help: help, kind: "counter"}, fn: fn})
+}
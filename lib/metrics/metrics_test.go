@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"lib/assert"
+	"strings"
+	"testing"
+)
+
+func render(r *Registry) string {
+	sb := strings.Builder{}
+	r.Write(&sb)
+	return sb.String()
+}
+
+func TestCounter(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounter(r, "conns_total", "Connections.", "protocol", "outcome")
+
+	c.With("socks", "ok").Inc()
+	c.With("http", "ok").Add(2)
+	c.With("http", "ok").Inc()
+	c.With("http", `a"b\c`).Inc()
+
+	assert.Equal(t, uint64(3), c.With("http", "ok").Get())
+	assert.Equal(t, `# HELP conns_total Connections.
+# TYPE conns_total counter
+conns_total{protocol="http",outcome="a\"b\\c"} 1
+conns_total{protocol="http",outcome="ok"} 3
+conns_total{protocol="socks",outcome="ok"} 1
+`, render(r))
+}
+
+func TestGauge(t *testing.T) {
+	r := NewRegistry()
+	g := NewGauge(r, "active", "Active.")
+
+	g.With().Inc()
+	g.With().Inc()
+	g.With().Dec()
+	g.With().Add(0.5)
+
+	NewGaugeFunc(r, "up", "Up.", func() float64 { return 1 })
+
+	assert.Equal(t, `# HELP active Active.
+# TYPE active gauge
+active 1.5
+# HELP up Up.
+# TYPE up gauge
+up 1
+`, render(r))
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	h := NewHistogram(r, "dial_seconds", "Dial.", []float64{0.1, 1}, "route")
+
+	h.With("direct").Observe(0.05)
+	h.With("direct").Observe(0.1)
+	h.With("direct").Observe(0.5)
+	h.With("direct").Observe(2)
+
+	assert.Equal(t, `# HELP dial_seconds Dial.
+# TYPE dial_seconds histogram
+dial_seconds_bucket{route="direct",le="0.1"} 2
+dial_seconds_bucket{route="direct",le="1"} 3
+dial_seconds_bucket{route="direct",le="+Inf"} 4
+dial_seconds_sum{route="direct"} 2.65
+dial_seconds_count{route="direct"} 4
+`, render(r))
+}
+
+func TestWith_LabelCount(t *testing.T) {
+	r := NewRegistry()
+	c := NewCounter(r, "c", "C.", "a")
+
+	defer func() {
+		assert.NotNull(t, recover())
+	}()
+	c.With("x", "y")
+}
+
+func TestRegisterRuntime(t *testing.T) {
+	r := NewRegistry()
+	RegisterRuntime(r)
+
+	out := render(r)
+	assert.Equal(t, true, strings.Contains(out, "\ngo_goroutines "))
+	assert.Equal(t, true, strings.Contains(out, "# TYPE go_gc_cycles_total counter\n"))
+}
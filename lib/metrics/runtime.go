@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+type runtimeMetrics struct{}
+
+// RegisterRuntime adds goroutine, memory and GC stats of the process, under the names of the Prometheus Go client
+func RegisterRuntime(r *Registry) {
+	r.register(runtimeMetrics{})
+}
+
+func (runtimeMetrics) write(sb *strings.Builder) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	gauge := func(name string, help string, v uint64) {
+		d := desc{name: name, help: help, kind: "gauge"}
+		d.header(sb)
+		d.sample(sb, "", nil, strconv.FormatUint(v, 10))
+	}
+
+	gauge("go_goroutines", "Number of goroutines that currently exist.", uint64(runtime.NumGoroutine()))
+	gauge("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and still in use.", stats.HeapAlloc)
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", stats.HeapInuse)
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", stats.Sys)
+
+	d := desc{name: "go_gc_cycles_total", help: "Number of completed GC cycles.", kind: "counter"}
+	d.header(sb)
+	d.sample(sb, "", nil, strconv.FormatUint(uint64(stats.NumGC), 10))
+}
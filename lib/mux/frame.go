@@ -0,0 +1,57 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Frame layout, big endian:
+//
+//	| type (1) | stream id (4) | length (4) | payload (length) |
+//
+// For frameWindow, length carries the window increment and there is no payload.
+// A frameClose on stream 0 is a go away: the sender accepts no new streams, while those open carry on.
+// Peers predating it ignore it, like any frame of an unknown stream.
+const headerSize = 9
+
+// goAwayId is never used by streams, clients open odd ids and servers even ones from 2
+const goAwayId = 0
+
+const (
+	frameOpen byte = iota
+	frameData
+	frameWindow
+	frameClose
+	frameReset
+)
+
+var ErrProtocol = errors.New("mux protocol error")
+var ErrFrameTooLarge = errors.New("mux frame too large")
+
+type frameHeader struct {
+	typ      byte
+	streamId uint32
+	length   uint32
+}
+
+func (h *frameHeader) encode(b []byte) {
+	b[0] = h.typ
+	binary.BigEndian.PutUint32(b[1:5], h.streamId)
+	binary.BigEndian.PutUint32(b[5:9], h.length)
+}
+
+func readHeader(r io.Reader, b []byte) (h frameHeader, err error) {
+	if _, err = io.ReadFull(r, b[:headerSize]); err != nil {
+		return
+	}
+
+	h.typ = b[0]
+	h.streamId = binary.BigEndian.Uint32(b[1:5])
+	h.length = binary.BigEndian.Uint32(b[5:9])
+
+	if h.typ > frameReset {
+		err = ErrProtocol
+	}
+	return
+}
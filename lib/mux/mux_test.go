@@ -0,0 +1,180 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"lib/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func newPair() (*Session, *Session) {
+	c, s := net.Pipe()
+	return Client(c), Server(s)
+}
+
+func TestMux_Echo(t *testing.T) {
+	client, server := newPair()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				io.Copy(stream, stream)
+				stream.CloseWrite()
+			}()
+		}
+	}()
+
+	// larger than the window, so the sender has to wait for window updates
+	data := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	for i := 0; i < 3; i++ {
+		stream, err := client.Open()
+		assert.Equal(t, nil, err)
+
+		go func() {
+			stream.Write(data)
+			stream.CloseWrite()
+		}()
+
+		got, err := io.ReadAll(stream)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, bytes.Equal(data, got))
+		stream.Close()
+	}
+
+	assert.Equal(t, 0, client.NumStreams())
+}
+
+func TestMux_Reset(t *testing.T) {
+	client, server := newPair()
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.Open()
+	remote, _ := server.Accept()
+
+	remote.Reset()
+
+	buf := make([]byte, 10)
+	_, err := stream.Read(buf)
+	assert.Equal(t, ErrStreamReset, err)
+
+	_, err = stream.Write(buf)
+	assert.Equal(t, ErrStreamReset, err)
+
+	// closing before the peer finishes delivers buffered data, then EOF
+	stream, _ = client.Open()
+	remote, _ = server.Accept()
+
+	remote.Write([]byte("bye"))
+	remote.Close()
+
+	got, err := io.ReadAll(stream)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "bye", string(got))
+}
+
+func TestMux_Deadline(t *testing.T) {
+	client, server := newPair()
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.Open()
+	stream.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+
+	buf := make([]byte, 10)
+	_, err := stream.Read(buf)
+	assert.True[bool](t, err != nil && err.(net.Error).Timeout())
+}
+
+func TestMux_SessionClose(t *testing.T) {
+	client, server := newPair()
+
+	stream, _ := client.Open()
+	server.Accept()
+	server.Close()
+
+	buf := make([]byte, 10)
+	_, err := stream.Read(buf)
+	assert.Equal(t, ErrSessionClosed, err)
+
+	<-client.Closed()
+	_, err = client.Open()
+	assert.Equal(t, ErrSessionClosed, err)
+}
+
+func TestMux_GoAway(t *testing.T) {
+	client, server := newPair()
+	defer client.Close()
+	defer server.Close()
+
+	stream, _ := client.Open()
+	remote, _ := server.Accept()
+
+	assert.Equal(t, nil, server.GoAway())
+
+	// streams already open carry on
+	remote.Write([]byte("still here"))
+	buf := make([]byte, 10)
+	n, err := stream.Read(buf)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "still here", string(buf[:n]))
+
+	assert.Equal(t, true, client.GoingAway())
+	assert.Equal(t, false, server.GoingAway())
+
+	_, err = client.Open()
+	assert.Equal(t, ErrGoAway, err)
+}
+
+func TestMux_OpenGoAwayId(t *testing.T) {
+	for _, newSession := range []func(net.Conn, ...Config) *Session{Client, Server} {
+		c, s := net.Pipe()
+		session := newSession(s)
+
+		b := make([]byte, headerSize)
+		(&frameHeader{typ: frameOpen, streamId: goAwayId}).encode(b)
+		c.Write(b)
+
+		select {
+		case <-session.Closed():
+			assert.Equal(t, ErrProtocol, session.Err())
+		case <-time.After(time.Second * 5):
+			t.Fatal("stream 0 accepted")
+		}
+		c.Close()
+	}
+}
+
+func TestMux_CloseIdle(t *testing.T) {
+	client, server := newPair()
+	defer server.Close()
+
+	a, _ := client.Open()
+	b, _ := client.Open()
+
+	client.CloseIdle()
+	assert.Equal(t, false, client.IsClosed())
+
+	a.Close()
+	assert.Equal(t, false, client.IsClosed())
+
+	b.Close()
+	assert.Equal(t, true, client.IsClosed())
+
+	// right away without streams
+	client, server = newPair()
+	defer server.Close()
+
+	client.CloseIdle()
+	assert.Equal(t, true, client.IsClosed())
+}
@@ -0,0 +1,333 @@
+/*
+Package mux multiplexes many ordered byte streams over one connection.
+
+Each stream has its own flow-control window, so one slow reader cannot stall the other streams sharing the connection.
+*/
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrSessionClosed = errors.New("mux session closed")
+var ErrStreamReset = errors.New("mux stream reset")
+var ErrStreamsExhausted = errors.New("mux stream ids exhausted")
+var ErrGoAway = errors.New("mux session going away")
+
+type Config struct {
+	// InitialWindow is the number of bytes a peer may send on a stream before receiving a window update
+	InitialWindow uint32
+	// MaxFrameSize is the maximum payload of a data frame
+	MaxFrameSize int
+	// AcceptBacklog is the number of opened streams waiting for Accept before new ones are reset
+	AcceptBacklog int
+}
+
+var DefaultConfig = Config{
+	InitialWindow: 256 * 1024,
+	MaxFrameSize:  16 * 1024,
+	AcceptBacklog: 256,
+}
+
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	lock    sync.Mutex
+	streams map[uint32]*Stream
+	nextId  uint32
+	// the session closes once it has no streams left
+	closeIdle bool
+
+	writeLock sync.Mutex
+	writeBuf  []byte
+	readBuf   []byte
+
+	accept chan *Stream
+	// the peer accepts no new streams
+	goingAway atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       atomic.Value
+}
+
+// Client creates a session for the dialing side of conn. Client streams use odd ids.
+func Client(conn net.Conn, config ...Config) *Session {
+	return newSession(conn, 1, config...)
+}
+
+// Server creates a session for the accepting side of conn. Server streams use even ids.
+func Server(conn net.Conn, config ...Config) *Session {
+	return newSession(conn, 2, config...)
+}
+
+func newSession(conn net.Conn, nextId uint32, config ...Config) *Session {
+	c := DefaultConfig
+	if len(config) > 0 {
+		c = config[0]
+	}
+
+	s := &Session{
+		conn:     conn,
+		config:   c,
+		streams:  map[uint32]*Stream{},
+		nextId:   nextId,
+		writeBuf: make([]byte, headerSize+c.MaxFrameSize),
+		readBuf:  make([]byte, c.MaxFrameSize),
+		accept:   make(chan *Stream, c.AcceptBacklog),
+		closed:   make(chan struct{}),
+	}
+
+	go s.recvLoop()
+	return s
+}
+
+// Open creates a new stream. The peer sees it from Accept.
+func (s *Session) Open() (*Stream, error) {
+	s.lock.Lock()
+
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, s.Err()
+	}
+
+	if s.goingAway.Load() {
+		s.lock.Unlock()
+		return nil, ErrGoAway
+	}
+
+	id := s.nextId
+	if id+2 < id {
+		s.lock.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+
+	s.nextId += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, 0, nil); err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.closed:
+		return nil, s.Err()
+	}
+}
+
+// GoAway tells the peer to open no more streams on the session. Streams already open are not affected.
+func (s *Session) GoAway() error {
+	return s.writeFrame(frameClose, goAwayId, 0, nil)
+}
+
+// GoingAway reports whether the peer has sent GoAway, after which Open fails with ErrGoAway
+func (s *Session) GoingAway() bool {
+	return s.goingAway.Load()
+}
+
+// NumStreams returns the number of streams not yet closed
+func (s *Session) NumStreams() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closed returns a channel closed when the session terminates
+func (s *Session) Closed() <-chan struct{} {
+	return s.closed
+}
+
+// Err returns the reason the session terminated
+func (s *Session) Err() error {
+	if err, ok := s.err.Load().(error); ok {
+		return err
+	}
+	return ErrSessionClosed
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// CloseIdle closes the session once its last stream is closed, right away if it has none
+func (s *Session) CloseIdle() {
+	s.lock.Lock()
+	s.closeIdle = true
+	idle := len(s.streams) == 0
+	s.lock.Unlock()
+
+	if idle {
+		s.Close()
+	}
+}
+
+// Close terminates the session and all of its streams
+func (s *Session) Close() error {
+	return s.closeWithError(ErrSessionClosed)
+}
+
+func (s *Session) closeWithError(err error) (ret error) {
+	s.closeOnce.Do(func() {
+		s.err.Store(err)
+		close(s.closed)
+		ret = s.conn.Close()
+
+		s.lock.Lock()
+		streams := s.streams
+		s.streams = map[uint32]*Stream{}
+		s.lock.Unlock()
+
+		for _, stream := range streams {
+			stream.notify()
+		}
+	})
+	return
+}
+
+func (s *Session) writeFrame(typ byte, id uint32, length uint32, payload []byte) error {
+	h := frameHeader{typ: typ, streamId: id, length: length}
+	if payload != nil {
+		h.length = uint32(len(payload))
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	if s.IsClosed() {
+		return s.Err()
+	}
+
+	// header and payload go out in a single write, so they end up in the same TLS record
+	h.encode(s.writeBuf)
+	n := copy(s.writeBuf[headerSize:], payload)
+
+	if _, err := s.conn.Write(s.writeBuf[:headerSize+n]); err != nil {
+		s.closeWithError(err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.lock.Lock()
+	delete(s.streams, id)
+	idle := s.closeIdle && len(s.streams) == 0
+	s.lock.Unlock()
+
+	if idle {
+		s.Close()
+	}
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+
+	for {
+		h, err := readHeader(s.conn, header)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrSessionClosed
+			}
+			s.closeWithError(err)
+			return
+		}
+
+		if err = s.handleFrame(h); err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(h frameHeader) error {
+	switch h.typ {
+	case frameOpen:
+		s.lock.Lock()
+		// the peer opens neither ids of this side nor the go away one
+		if _, ok := s.streams[h.streamId]; ok || h.streamId == goAwayId || h.streamId%2 == s.nextId%2 {
+			s.lock.Unlock()
+			return ErrProtocol
+		}
+
+		stream := newStream(s, h.streamId)
+		s.streams[h.streamId] = stream
+		s.lock.Unlock()
+
+		select {
+		case s.accept <- stream:
+		default:
+			stream.Reset()
+		}
+
+	case frameData:
+		if int(h.length) > s.config.MaxFrameSize {
+			return ErrFrameTooLarge
+		}
+
+		payload := s.readBuf[:h.length]
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			return err
+		}
+
+		// the stream may have been reset locally, in which case the payload is discarded
+		if stream := s.getStream(h.streamId); stream != nil {
+			return stream.receive(payload)
+		}
+
+	case frameWindow:
+		if stream := s.getStream(h.streamId); stream != nil {
+			stream.increaseWindow(h.length)
+		}
+
+	case frameClose:
+		if h.streamId == goAwayId {
+			s.goingAway.Store(true)
+			return nil
+		}
+
+		if stream := s.getStream(h.streamId); stream != nil {
+			stream.remoteClose()
+		}
+
+	case frameReset:
+		if stream := s.getStream(h.streamId); stream != nil {
+			stream.remoteReset()
+		}
+	}
+
+	return nil
+}
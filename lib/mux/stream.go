@@ -0,0 +1,334 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is one ordered byte stream of a session. It implements net.Conn.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	lock         sync.Mutex
+	recvBuf      bytes.Buffer
+	recvWindow   uint32 // bytes the peer may still send
+	consumed     uint32 // bytes read since the last window update
+	sendWindow   uint32 // bytes we may still send
+	localClosed  bool   // close frame sent
+	remoteClosed bool   // close frame received
+	reset        bool
+	closed       bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		recvWindow: session.config.InitialWindow,
+		sendWindow: session.config.InitialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func (st *Stream) Id() uint32 {
+	return st.id
+}
+
+func (st *Stream) notify() {
+	select {
+	case st.readReady <- struct{}{}:
+	default:
+	}
+
+	select {
+	case st.writeReady <- struct{}{}:
+	default:
+	}
+}
+
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+	case <-st.session.closed:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+
+	return nil
+}
+
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.lock.Lock()
+
+		if st.closed {
+			st.lock.Unlock()
+			return 0, net.ErrClosed
+		}
+
+		if st.recvBuf.Len() > 0 {
+			n, _ = st.recvBuf.Read(b)
+			st.consumed += uint32(n)
+
+			var update uint32
+			if !st.remoteClosed && st.consumed >= st.session.config.InitialWindow/2 {
+				update = st.consumed
+				st.consumed = 0
+				st.recvWindow += update
+			}
+			st.lock.Unlock()
+
+			if update > 0 {
+				st.session.writeFrame(frameWindow, st.id, update, nil)
+			}
+			return
+		}
+
+		if st.remoteClosed {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+
+		if st.reset {
+			st.lock.Unlock()
+			return 0, ErrStreamReset
+		}
+
+		if st.session.IsClosed() {
+			st.lock.Unlock()
+			return 0, st.session.Err()
+		}
+
+		deadline := st.readDeadline
+		st.lock.Unlock()
+
+		if err = st.wait(st.readReady, deadline); err != nil {
+			return
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		st.lock.Lock()
+
+		if st.closed {
+			st.lock.Unlock()
+			return n, net.ErrClosed
+		}
+
+		if st.reset {
+			st.lock.Unlock()
+			return n, ErrStreamReset
+		}
+
+		if st.localClosed {
+			st.lock.Unlock()
+			return n, io.ErrClosedPipe
+		}
+
+		if st.session.IsClosed() {
+			st.lock.Unlock()
+			return n, st.session.Err()
+		}
+
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.lock.Unlock()
+
+			if err = st.wait(st.writeReady, deadline); err != nil {
+				return
+			}
+			continue
+		}
+
+		w := min(len(b), st.session.config.MaxFrameSize, int(st.sendWindow))
+		st.sendWindow -= uint32(w)
+		st.lock.Unlock()
+
+		if err = st.session.writeFrame(frameData, st.id, 0, b[:w]); err != nil {
+			return
+		}
+
+		n += w
+		b = b[w:]
+	}
+
+	return
+}
+
+// CloseWrite tells the peer no more data will be sent. Reading is still possible.
+func (st *Stream) CloseWrite() error {
+	st.lock.Lock()
+	if st.localClosed || st.reset {
+		st.lock.Unlock()
+		return nil
+	}
+
+	st.localClosed = true
+	done := st.remoteClosed
+	st.lock.Unlock()
+
+	err := st.session.writeFrame(frameClose, st.id, 0, nil)
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+// Close closes both directions. If the peer is still sending, the stream is reset so that its writes fail instead of stalling on the window.
+func (st *Stream) Close() (err error) {
+	st.lock.Lock()
+	if st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+
+	sendClose := !st.localClosed && !st.reset
+	sendReset := !st.remoteClosed && !st.reset
+
+	st.closed = true
+	st.localClosed = true
+	st.reset = st.reset || sendReset
+	st.lock.Unlock()
+
+	if sendClose {
+		err = st.session.writeFrame(frameClose, st.id, 0, nil)
+	}
+
+	if sendReset {
+		err = st.session.writeFrame(frameReset, st.id, 0, nil)
+	}
+
+	st.session.removeStream(st.id)
+	st.notify()
+	return
+}
+
+// Reset aborts the stream in both directions
+func (st *Stream) Reset() error {
+	st.lock.Lock()
+	if st.reset || st.closed {
+		st.lock.Unlock()
+		return nil
+	}
+
+	st.reset = true
+	st.lock.Unlock()
+
+	err := st.session.writeFrame(frameReset, st.id, 0, nil)
+
+	st.session.removeStream(st.id)
+	st.notify()
+	return err
+}
+
+func (st *Stream) receive(payload []byte) error {
+	st.lock.Lock()
+
+	if uint32(len(payload)) > st.recvWindow {
+		st.lock.Unlock()
+		return ErrProtocol
+	}
+
+	st.recvWindow -= uint32(len(payload))
+
+	if !st.closed {
+		st.recvBuf.Write(payload)
+	}
+	st.lock.Unlock()
+
+	st.notify()
+	return nil
+}
+
+func (st *Stream) increaseWindow(n uint32) {
+	st.lock.Lock()
+	st.sendWindow += n
+	st.lock.Unlock()
+
+	st.notify()
+}
+
+func (st *Stream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.lock.Unlock()
+
+	if done {
+		st.session.removeStream(st.id)
+	}
+	st.notify()
+}
+
+func (st *Stream) remoteReset() {
+	st.lock.Lock()
+	st.reset = true
+	st.lock.Unlock()
+
+	st.session.removeStream(st.id)
+	st.notify()
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.writeDeadline = t
+	st.lock.Unlock()
+
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+
+	st.notify()
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+
+	st.notify()
+	return nil
+}
@@ -118,6 +118,10 @@ func (s *Socket) Close() error {
 	return s.conn.Close()
 }
 
+func (s *Socket) CloseWrite() error {
+	return CloseWrite(s.conn)
+}
+
 type NetworkAddress struct {
 	Scheme  string
 	Host    string
@@ -138,9 +142,9 @@ func UrlToAddress(addr string) (na NetworkAddress, err error) {
 
 	if port == "" {
 		switch u.Scheme {
-		case "http":
+		case "http", "ws":
 			port = "80"
-		case "https":
+		case "https", "wss", "quic":
 			port = "443"
 		}
 
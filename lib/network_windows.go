@@ -119,6 +119,10 @@ func (s *Socket) EnsureWrite(buf []byte) (n int, err error) {
 	}
 }
 
+func (s *Socket) CloseWrite() error {
+	return CloseWrite(s.conn)
+}
+
 type NetworkAddress struct {
 	Scheme  string
 	Host    string
@@ -139,9 +143,9 @@ func UrlToAddress(addr string) (na NetworkAddress, err error) {
 
 	if port == "" {
 		switch u.Scheme {
-		case "http":
+		case "http", "ws":
 			port = "80"
-		case "https":
+		case "https", "wss", "quic":
 			port = "443"
 		}
 
@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QuicNoError closes QUIC streams and connections on purpose
+const QuicNoError = 0
+
+// QuicStream is a bidirectional QUIC stream as a net.Conn, e.g. to carry one proxied connection
+type QuicStream struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func NewQuicStream(stream *quic.Stream, conn *quic.Conn) *QuicStream {
+	return &QuicStream{Stream: stream, conn: conn}
+}
+
+func (s *QuicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *QuicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// CloseWrite sends the FIN, the peer can still write
+func (s *QuicStream) CloseWrite() error {
+	return s.Stream.Close()
+}
+
+// Close stops reading too, unlike quic.Stream.Close which only closes the send side
+func (s *QuicStream) Close() error {
+	s.Stream.CancelRead(QuicNoError)
+	return s.Stream.Close()
+}
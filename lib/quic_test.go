@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"lib/assert"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicEcho listens on loopback, echoing every stream
+func quicEcho(t *testing.T) *quic.EarlyListener {
+	certPem, keyPem := testCa(t, false)
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	assert.Null(t, err)
+
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"test"},
+	}, &quic.Config{Allow0RTT: true})
+	assert.Null(t, err)
+
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+
+					s := NewQuicStream(stream, conn)
+					go func() {
+						io.Copy(s, s)
+						s.CloseWrite()
+					}()
+				}
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestQuicStream(t *testing.T) {
+	l := quicEcho(t)
+	defer l.Close()
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"test"},
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	for i := 0; i < 2; i++ {
+		conn, err := quic.DialAddrEarly(context.Background(), l.Addr().String(), tlsConfig, nil)
+		assert.Null(t, err)
+
+		stream, err := conn.OpenStreamSync(context.Background())
+		assert.Null(t, err)
+
+		s := NewQuicStream(stream, conn)
+		assert.Equal(t, l.Addr().String(), s.RemoteAddr().String())
+
+		go func() {
+			s.Write(data)
+			s.CloseWrite()
+		}()
+
+		got, err := io.ReadAll(s)
+		assert.Null(t, err)
+		assert.Equal(t, true, bytes.Equal(data, got))
+
+		// resumed the session of the first connection
+		<-conn.HandshakeComplete()
+		assert.Equal(t, i == 1, conn.ConnectionState().Used0RTT)
+
+		s.Close()
+		conn.CloseWithError(QuicNoError, "")
+	}
+}
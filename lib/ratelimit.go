@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket limits throughput to rate tokens per second, allowing bursts up to burst tokens.
+// Taking more tokens than available puts the bucket in debt, which callers wait out.
+type TokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate int64, burst int64) *TokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+
+	return &TokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Take removes n tokens and returns how long the caller should wait before using them
+func (b *TokenBucket) Take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// Wait takes n tokens, blocking until they are available
+func (b *TokenBucket) Wait(n int) {
+	if d := b.Take(n); d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,20 @@
+package lib
+
+import (
+	"lib/assert"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(1000, 2000)
+
+	assert.Equal(t, time.Duration(0), b.Take(2000))
+
+	d := b.Take(500)
+	assert.Equal(t, true, d > 400*time.Millisecond && d <= 500*time.Millisecond)
+
+	start := time.Now()
+	b.Wait(100)
+	assert.Equal(t, true, time.Since(start) >= 500*time.Millisecond)
+}
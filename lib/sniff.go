@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+var ErrMalformedClientHello = errors.New("malformed TLS client hello")
+
+const (
+	tlsRecordHandshake   = 0x16
+	tlsClientHello       = 0x01
+	tlsExtServerName     = 0x0000
+	tlsServerNameHost    = 0x00
+	tlsRecordHeaderBytes = 5
+)
+
+// SniffHost peeks at what a client sends first for the host it is after: the server name of a TLS client hello,
+// or the Host header of a HTTP request. Nothing is consumed from r, which should be large enough to hold a whole
+// TLS record. It returns "" if the protocol is neither, or does not name the host.
+func SniffHost(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+
+	if b[0] == tlsRecordHandshake {
+		return sniffTls(r)
+	}
+
+	// a method token, e.g. "GET "
+	for i := 0; i < 16; i++ {
+		b, err := r.Peek(i + 1)
+		if err != nil {
+			return "", err
+		}
+
+		if c := b[i]; c == ' ' && i > 0 {
+			return sniffHttp(r)
+		} else if c < 'A' || c > 'Z' {
+			break
+		}
+	}
+	return "", nil
+}
+
+func sniffTls(r *bufio.Reader) (string, error) {
+	header, err := r.Peek(tlsRecordHeaderBytes)
+	if err != nil {
+		return "", err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if tlsRecordHeaderBytes+length > r.Size() {
+		return "", ErrMalformedClientHello
+	}
+
+	record, err := r.Peek(tlsRecordHeaderBytes + length)
+	if err != nil {
+		return "", err
+	}
+
+	return ParseSni(record[tlsRecordHeaderBytes:])
+}
+
+// ParseSni returns the server name of a TLS client hello handshake message, "" if there is none.
+// Only what fits in the first record is looked at.
+func ParseSni(b []byte) (string, error) {
+	r := byteReader(b)
+
+	if t, ok := r.uint8(); !ok || t != tlsClientHello {
+		return "", ErrMalformedClientHello
+	}
+
+	// message length, version, random
+	if !r.skip(3 + 2 + 32) {
+		return "", ErrMalformedClientHello
+	}
+
+	// session id, cipher suites, compression methods
+	if _, ok := r.vector8(); !ok {
+		return "", ErrMalformedClientHello
+	}
+	if _, ok := r.vector16(); !ok {
+		return "", ErrMalformedClientHello
+	}
+	if _, ok := r.vector8(); !ok {
+		return "", ErrMalformedClientHello
+	}
+
+	if len(r) == 0 {
+		// no extensions
+		return "", nil
+	}
+
+	extensions, ok := r.vector16()
+	if !ok {
+		return "", ErrMalformedClientHello
+	}
+
+	for len(extensions) > 0 {
+		t, ok := extensions.uint16()
+		if !ok {
+			return "", ErrMalformedClientHello
+		}
+		data, ok := extensions.vector16()
+		if !ok {
+			return "", ErrMalformedClientHello
+		}
+
+		if t != tlsExtServerName {
+			continue
+		}
+
+		names, ok := data.vector16()
+		if !ok {
+			return "", ErrMalformedClientHello
+		}
+
+		for len(names) > 0 {
+			nameType, ok := names.uint8()
+			if !ok {
+				return "", ErrMalformedClientHello
+			}
+			name, ok := names.vector16()
+			if !ok {
+				return "", ErrMalformedClientHello
+			}
+
+			if nameType == tlsServerNameHost {
+				return string(name), nil
+			}
+		}
+		return "", nil
+	}
+
+	return "", nil
+}
+
+func sniffHttp(r *bufio.Reader) (string, error) {
+	for n := 1; ; n = r.Buffered() + 1 {
+		if n > r.Size() {
+			return "", nil
+		}
+
+		// more data only arrives by asking for more than is buffered
+		if _, err := r.Peek(n); err != nil {
+			return "", err
+		}
+
+		b, _ := r.Peek(r.Buffered())
+
+		end := bytes.Index(b, []byte("\r\n\r\n"))
+		if end < 0 {
+			end = bytes.Index(b, []byte("\n\n"))
+		}
+		if end < 0 {
+			continue
+		}
+
+		lines := strings.Split(string(b[:end]), "\n")
+		for _, line := range lines[1:] {
+			name, value, ok := strings.Cut(line, ":")
+			if !ok || !strings.EqualFold(strings.TrimSpace(name), "Host") {
+				continue
+			}
+
+			host := strings.TrimSpace(value)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return strings.Trim(host, "[]"), nil
+		}
+		return "", nil
+	}
+}
+
+// byteReader reads the fields of TLS structures
+type byteReader []byte
+
+func (r *byteReader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *byteReader) uint8() (byte, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *byteReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *byteReader) vector(n int) (byteReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r *byteReader) vector8() (byteReader, bool) {
+	n, ok := r.uint8()
+	if !ok {
+		return nil, false
+	}
+	return r.vector(int(n))
+}
+
+func (r *byteReader) vector16() (byteReader, bool) {
+	n, ok := r.uint16()
+	if !ok {
+		return nil, false
+	}
+	return r.vector(int(n))
+}
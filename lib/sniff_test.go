@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"bufio"
+	"crypto/tls"
+	"lib/assert"
+	"net"
+	"strings"
+	"testing"
+)
+
+// clientHello sniffs what a TLS client with config sends first
+func clientHello(t *testing.T, config *tls.Config) (string, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+
+	r := bufio.NewReaderSize(server, 16*1024+5)
+	host, err := SniffHost(r)
+
+	// nothing consumed
+	b, _ := r.Peek(1)
+	assert.Equal(t, byte(tlsRecordHandshake), b[0])
+	return host, err
+}
+
+func TestSniffHost_Tls(t *testing.T) {
+	host, err := clientHello(t, &tls.Config{ServerName: "example.com"})
+	assert.Null(t, err)
+	assert.Equal(t, "example.com", host)
+
+	host, err = clientHello(t, &tls.Config{InsecureSkipVerify: true})
+	assert.Null(t, err)
+	assert.Equal(t, "", host)
+}
+
+func TestSniffHost_Http(t *testing.T) {
+	cases := map[string]string{
+		"GET / HTTP/1.1\r\nUser-Agent: x\r\nhost: example.com:8080\r\n\r\n": "example.com",
+		"POST /a HTTP/1.1\nHost: [::1]:80\n\nbody":                          "::1",
+		"GET / HTTP/1.0\r\n\r\n":                                            "",
+		"SSH-2.0-OpenSSH_9.6\r\n":                                           "",
+		"\x00\x01binary":                                                    "",
+	}
+
+	for in, expected := range cases {
+		r := bufio.NewReader(strings.NewReader(in))
+		host, err := SniffHost(r)
+		assert.Null(t, err)
+		assert.Equal(t, expected, host)
+		assert.Equal(t, len(in), r.Buffered())
+	}
+}
+
+func TestParseSni_Malformed(t *testing.T) {
+	_, err := ParseSni([]byte{tlsClientHello, 0, 0, 10, 3, 3})
+	assert.Equal(t, ErrMalformedClientHello, err)
+}
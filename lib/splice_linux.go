@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	spliceMove     = 0x1 // SPLICE_F_MOVE
+	spliceNonblock = 0x2 // SPLICE_F_NONBLOCK
+	// bytes moved per call, the default capacity of a pipe
+	spliceChunk = 64 * 1024
+)
+
+// Splice copies src to dst until EOF, like io.Copy. Between plain TCP sockets the data moves through a pipe
+// with splice(2) and never enters user space, otherwise it falls back to io.Copy.
+// The watchdog, which may be nil, is touched whenever data moves.
+func Splice(dst, src *Socket, watchdog *Watchdog) (written int64, err error) {
+	_, dstTcp := dst.conn.(*net.TCPConn)
+	_, srcTcp := src.conn.(*net.TCPConn)
+	if !dstTcp || !srcTcp {
+		return io.Copy(dst.conn, watchdog.Reader(src.conn))
+	}
+
+	var p [2]int
+	if err := syscall.Pipe2(p[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return io.Copy(dst.conn, watchdog.Reader(src.conn))
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	for {
+		// socket to pipe, waiting in the poller while nothing is readable
+		var n int64
+		var e error
+		if err = src.sc.Read(func(fd uintptr) bool {
+			n, e = spliceRetry(int(fd), p[1], spliceChunk)
+			return e != syscall.EAGAIN
+		}); err != nil {
+			return
+		}
+
+		if e != nil {
+			return written, os.NewSyscallError("splice", e)
+		}
+		if n == 0 {
+			return written, nil
+		}
+
+		watchdog.Touch()
+
+		// pipe to socket, until the pipe is empty
+		for n > 0 {
+			var m int64
+			if err = dst.sc.Write(func(fd uintptr) bool {
+				m, e = spliceRetry(p[0], int(fd), int(n))
+				return e != syscall.EAGAIN
+			}); err != nil {
+				return
+			}
+
+			if e != nil {
+				return written, os.NewSyscallError("splice", e)
+			}
+
+			n -= m
+			written += m
+		}
+	}
+}
+
+func spliceRetry(rfd int, wfd int, n int) (int64, error) {
+	for {
+		ret, err := syscall.Splice(rfd, nil, wfd, nil, n, spliceMove|spliceNonblock)
+		if err != syscall.EINTR {
+			// int on 32-bit targets
+			return int64(ret), err
+		}
+	}
+}
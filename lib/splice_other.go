@@ -0,0 +1,11 @@
+//go:build !linux
+
+package lib
+
+import "io"
+
+// Splice copies src to dst until EOF, like io.Copy. splice(2) is only available on Linux.
+// The watchdog, which may be nil, is touched whenever data moves.
+func Splice(dst, src *Socket, watchdog *Watchdog) (written int64, err error) {
+	return io.Copy(dst.conn, watchdog.Reader(src.conn))
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"lib/assert"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// connPair returns both ends of a connection through a listener on network
+func connPair(t *testing.T, network string, addr string) (net.Conn, net.Conn) {
+	l, err := net.Listen(network, addr)
+	assert.Null(t, err)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial(network, l.Addr().String())
+	assert.Null(t, err)
+	return conn, <-accepted
+}
+
+func testSplice(t *testing.T, network string, addr func() string) {
+	client, in := connPair(t, network, addr())
+	out, server := connPair(t, network, addr())
+	defer client.Close()
+	defer in.Close()
+	defer out.Close()
+	defer server.Close()
+
+	src, err := NewSocket(in)
+	assert.Null(t, err)
+	dst, err := NewSocket(out)
+	assert.Null(t, err)
+
+	data := make([]byte, 1024*1024+7)
+	rand.Read(data)
+
+	go func() {
+		client.Write(data)
+		CloseWrite(client)
+	}()
+
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := io.ReadAll(server)
+		received <- b
+	}()
+
+	touched := make(chan error, 1)
+	watchdog := NewWatchdog(Timeouts{Idle: 1 << 62}, func(err error) { touched <- err })
+	defer watchdog.Stop()
+
+	n, err := Splice(dst, src, watchdog)
+	assert.Null(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, true, watchdog.last.Load() > 0)
+
+	assert.Null(t, dst.CloseWrite())
+	assert.Equal(t, true, bytes.Equal(data, <-received))
+}
+
+func TestSplice_Tcp(t *testing.T) {
+	testSplice(t, "tcp", func() string { return "127.0.0.1:0" })
+}
+
+func TestSplice_Fallback(t *testing.T) {
+	dir := t.TempDir()
+	i := 0
+	testSplice(t, "unix", func() string {
+		i++
+		return filepath.Join(dir, string(rune('a'+i)))
+	})
+}
@@ -1,6 +1,9 @@
 package lib
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+)
 
 type noCopy struct{}
 
@@ -104,3 +107,38 @@ func (p *Pool[T]) Put(item T) {
 	p.c.L.Unlock()
 	p.c.Signal()
 }
+
+// BufferPool recycles buffers of a fixed size, keeping count of those allocated and those in use
+type BufferPool struct {
+	pool      sync.Pool
+	allocated atomic.Int64
+	inUse     atomic.Int64
+}
+
+func NewBufferPool(size int) *BufferPool {
+	ret := &BufferPool{}
+	ret.pool.New = func() any {
+		ret.allocated.Add(1)
+		return make([]byte, size)
+	}
+	return ret
+}
+
+func (p *BufferPool) Get() []byte {
+	p.inUse.Add(1)
+	return p.pool.Get().([]byte)
+}
+
+func (p *BufferPool) Put(b []byte) {
+	p.inUse.Add(-1)
+	p.pool.Put(b)
+}
+
+// Allocated counts buffers allocated since the pool was created, including those the GC has since reclaimed
+func (p *BufferPool) Allocated() int64 {
+	return p.allocated.Load()
+}
+
+func (p *BufferPool) InUse() int64 {
+	return p.inUse.Load()
+}
@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// TlsFailureReason classifies a failed TLS handshake into a short label, e.g. for metrics
+func TlsFailureReason(err error) string {
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var alert tls.AlertError
+	var unknownCa x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return "eof"
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case errors.As(err, &unknownCa):
+		return "unknown_ca"
+	case errors.As(err, &invalid), errors.As(err, &hostname):
+		return "bad_certificate"
+	case errors.As(err, &alert):
+		return "remote_alert"
+	}
+
+	return "other"
+}
@@ -0,0 +1,22 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"lib/assert"
+	"testing"
+)
+
+func TestTlsFailureReason(t *testing.T) {
+	assert.Equal(t, "timeout", TlsFailureReason(context.DeadlineExceeded))
+	assert.Equal(t, "eof", TlsFailureReason(fmt.Errorf("read: %w", io.EOF)))
+	assert.Equal(t, "not_tls", TlsFailureReason(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}))
+	assert.Equal(t, "unknown_ca", TlsFailureReason(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}))
+	assert.Equal(t, "bad_certificate", TlsFailureReason(x509.CertificateInvalidError{Reason: x509.Expired}))
+	assert.Equal(t, "remote_alert", TlsFailureReason(fmt.Errorf("remote error: %w", tls.AlertError(42))))
+	assert.Equal(t, "other", TlsFailureReason(errors.New("tls: client didn't provide a certificate")))
+}
@@ -202,6 +202,14 @@ func WriteAll(w io.Writer, args ...[]byte) error {
 	return nil
 }
 
+// CloseWrite half-closes w if it supports it, so the peer reads EOF while its replies still come back
+func CloseWrite(w io.Writer) error {
+	if cw, ok := w.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
 func Retry(n int, f func() error) (err error) {
 	for i := 0; i < n; i++ {
 		err = f()
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrIdleTimeout = errors.New("connection idle for too long")
+var ErrLifetimeExceeded = errors.New("connection open for too long")
+
+// Timeouts bound how long a connection may go without traffic in either direction, and how long it may stay open
+// at all. Zero disables either.
+type Timeouts struct {
+	Idle     time.Duration
+	Lifetime time.Duration
+}
+
+// Watchdog calls expire once a connection has been idle longer than Timeouts.Idle, or open longer than
+// Timeouts.Lifetime. Copies in both directions Touch it as data flows.
+// A nil Watchdog, from Timeouts disabling both, does nothing.
+type Watchdog struct {
+	timeouts Timeouts
+	start    time.Time
+	// time of the last Touch, since start
+	last   atomic.Int64
+	expire func(error)
+
+	lock  sync.Mutex
+	timer *time.Timer
+	err   error
+}
+
+func NewWatchdog(timeouts Timeouts, expire func(error)) *Watchdog {
+	if timeouts.Idle <= 0 && timeouts.Lifetime <= 0 {
+		return nil
+	}
+
+	ret := &Watchdog{
+		timeouts: timeouts,
+		start:    time.Now(),
+		expire:   expire,
+	}
+
+	ret.lock.Lock()
+	ret.timer = time.AfterFunc(ret.next(0), ret.check)
+	ret.lock.Unlock()
+
+	return ret
+}
+
+// next returns how long until the connection may expire, now being the time since start
+func (w *Watchdog) next(now time.Duration) time.Duration {
+	ret := time.Duration(-1)
+
+	if w.timeouts.Idle > 0 {
+		ret = time.Duration(w.last.Load()) + w.timeouts.Idle - now
+	}
+
+	if w.timeouts.Lifetime > 0 {
+		if left := w.timeouts.Lifetime - now; ret < 0 || left < ret {
+			ret = left
+		}
+	}
+
+	return max(ret, 0)
+}
+
+func (w *Watchdog) check() {
+	now := time.Since(w.start)
+
+	var err error
+	switch {
+	case w.timeouts.Lifetime > 0 && now >= w.timeouts.Lifetime:
+		err = ErrLifetimeExceeded
+	case w.timeouts.Idle > 0 && now-time.Duration(w.last.Load()) >= w.timeouts.Idle:
+		err = ErrIdleTimeout
+	}
+
+	w.lock.Lock()
+	if w.timer == nil {
+		w.lock.Unlock()
+		return
+	}
+
+	if err == nil {
+		w.timer.Reset(w.next(now))
+		w.lock.Unlock()
+		return
+	}
+
+	w.timer = nil
+	w.err = err
+	w.lock.Unlock()
+
+	w.expire(err)
+}
+
+// Touch marks the connection active
+func (w *Watchdog) Touch() {
+	if w != nil {
+		w.last.Store(int64(time.Since(w.start)))
+	}
+}
+
+// Stop ends watching. It returns why the connection expired, or nil if it did not.
+func (w *Watchdog) Stop() error {
+	if w == nil {
+		return nil
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	return w.err
+}
+
+type touchReader struct {
+	io.Reader
+	watchdog *Watchdog
+}
+
+func (r touchReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	if n > 0 {
+		r.watchdog.Touch()
+	}
+	return
+}
+
+// Reader touches the watchdog whenever something is read from r
+func (w *Watchdog) Reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return touchReader{Reader: r, watchdog: w}
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"bytes"
+	"io"
+	"lib/assert"
+	"testing"
+	"time"
+)
+
+func TestWatchdog_Idle(t *testing.T) {
+	expired := make(chan error, 1)
+	w := NewWatchdog(Timeouts{Idle: time.Millisecond * 50}, func(err error) {
+		expired <- err
+	})
+
+	// kept alive by reads
+	r := w.Reader(bytes.NewReader(make([]byte, 10)))
+	b := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		time.Sleep(time.Millisecond * 20)
+		r.Read(b)
+	}
+
+	select {
+	case <-expired:
+		t.Fatal("expired while active")
+	default:
+	}
+
+	assert.Equal(t, ErrIdleTimeout, <-expired)
+	assert.Equal(t, ErrIdleTimeout, w.Stop())
+}
+
+func TestWatchdog_Lifetime(t *testing.T) {
+	expired := make(chan error, 1)
+	w := NewWatchdog(Timeouts{Idle: time.Second, Lifetime: time.Millisecond * 30}, func(err error) {
+		expired <- err
+	})
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			w.Touch()
+			time.Sleep(time.Millisecond * 5)
+		}
+	}()
+
+	assert.Equal(t, ErrLifetimeExceeded, <-expired)
+}
+
+func TestWatchdog_Stop(t *testing.T) {
+	w := NewWatchdog(Timeouts{Idle: time.Millisecond * 10}, func(err error) {
+		t.Fatal("expired after Stop")
+	})
+	assert.Equal(t, nil, w.Stop())
+	time.Sleep(time.Millisecond * 30)
+
+	// disabled
+	w = NewWatchdog(Timeouts{}, nil)
+	assert.Equal(t, true, w == nil)
+	w.Touch()
+	assert.Equal(t, nil, w.Stop())
+
+	r := bytes.NewReader(nil)
+	assert.Equal(t, io.Reader(r), w.Reader(r))
+}
@@ -0,0 +1,376 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lib/http1"
+	mrand "math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+)
+
+// WebSocket of RFC 6455, carrying a byte stream in binary messages, e.g. to pass a tunnel through middleboxes that
+// only let web traffic through. Message boundaries are not kept: every data frame adds to the stream.
+
+const (
+	opContinuation byte = 0
+	opText         byte = 1
+	opBinary       byte = 2
+	opClose        byte = 8
+	opPing         byte = 9
+	opPong         byte = 10
+)
+
+// keyGuid is appended to Sec-WebSocket-Key to make Sec-WebSocket-Accept
+const keyGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxControlPayload bounds the payload of control frames
+const maxControlPayload = 125
+
+// closeNormal is the status code of a close frame ending the stream on purpose
+const closeNormal = 1000
+
+var ErrHandshake = errors.New("websocket handshake failed")
+var ErrProtocol = errors.New("websocket protocol error")
+
+// AcceptKey derives the Sec-WebSocket-Accept of key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + keyGuid))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// IsUpgrade tells whether req asks to switch to WebSocket
+func IsUpgrade(req http1.Request) bool {
+	return req.Method == "GET" && req.Headers.HasToken("Connection", "upgrade") && req.Headers.HasToken("Upgrade", "websocket")
+}
+
+// Conn is the byte stream of a WebSocket connection. Writes send a binary frame each, masked on the client side.
+type Conn struct {
+	net.Conn
+	r        *bufio.Reader
+	client   bool
+	protocol string
+
+	readLock sync.Mutex
+	// of the data frame being read
+	remaining uint64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	// a close frame was received
+	eof bool
+
+	writeLock sync.Mutex
+	buf       []byte
+	closeSent bool
+}
+
+// Protocol is the subprotocol agreed on in the handshake, empty if none
+func (c *Conn) Protocol() string {
+	return c.protocol
+}
+
+// Client upgrades conn by asking for path on host, offering protocols as subprotocols in order of preference
+func Client(conn net.Conn, host string, path string, protocols []string) (*Conn, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	sb := strings.Builder{}
+	sb.WriteString("GET " + path + " HTTP/1.1\r\n")
+	headers := http1.Headers{
+		{Name: "Host", Value: host},
+		{Name: "Upgrade", Value: "websocket"},
+		{Name: "Connection", Value: "Upgrade"},
+		{Name: "Sec-WebSocket-Key", Value: key},
+		{Name: "Sec-WebSocket-Version", Value: "13"},
+	}
+	if len(protocols) > 0 {
+		headers = append(headers, http1.Header{Name: "Sec-WebSocket-Protocol", Value: strings.Join(protocols, ", ")})
+	}
+	headers.Build(&sb)
+	sb.WriteString("\r\n")
+
+	if _, err := io.WriteString(conn, sb.String()); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	res, err := http1.ReadResponse(r, http1.DefaultLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != 101 {
+		return nil, fmt.Errorf("%w: status %d", ErrHandshake, res.StatusCode)
+	}
+
+	if !res.Headers.HasToken("Upgrade", "websocket") || res.Headers.Get("Sec-WebSocket-Accept") != AcceptKey(key) {
+		return nil, fmt.Errorf("%w: invalid upgrade", ErrHandshake)
+	}
+
+	protocol := res.Headers.Get("Sec-WebSocket-Protocol")
+	if protocol != "" && !contains(protocols, protocol) {
+		return nil, fmt.Errorf("%w: subprotocol %s not offered", ErrHandshake, protocol)
+	}
+
+	return &Conn{Conn: conn, r: r, client: true, protocol: protocol}, nil
+}
+
+// Accept upgrades conn, which sent req and has its reads buffered by r, agreeing on the first subprotocol offered
+// that is one of protocols. It fails without writing anything if req is not a valid upgrade, or if none is offered
+// while protocols is not empty.
+func Accept(conn net.Conn, r *bufio.Reader, req http1.Request, protocols []string) (*Conn, error) {
+	key := req.Headers.Get("Sec-WebSocket-Key")
+	if !IsUpgrade(req) || key == "" || req.Headers.Get("Sec-WebSocket-Version") != "13" {
+		return nil, fmt.Errorf("%w: invalid upgrade", ErrHandshake)
+	}
+
+	protocol := ""
+	for _, v := range req.Headers.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); protocol == "" && contains(protocols, p) {
+				protocol = p
+			}
+		}
+	}
+
+	if protocol == "" && len(protocols) > 0 {
+		return nil, fmt.Errorf("%w: no subprotocol of %s offered", ErrHandshake, strings.Join(protocols, ", "))
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	headers := http1.Headers{
+		{Name: "Upgrade", Value: "websocket"},
+		{Name: "Connection", Value: "Upgrade"},
+		{Name: "Sec-WebSocket-Accept", Value: AcceptKey(key)},
+	}
+	if protocol != "" {
+		headers = append(headers, http1.Header{Name: "Sec-WebSocket-Protocol", Value: protocol})
+	}
+	headers.Build(&sb)
+	sb.WriteString("\r\n")
+
+	if _, err := io.WriteString(conn, sb.String()); err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: conn, r: r, protocol: protocol}, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readHeader reads the header of the next frame
+func (c *Conn) readHeader() (fin bool, op byte, length uint64, err error) {
+	var b [8]byte
+	if _, err = io.ReadFull(c.r, b[:2]); err != nil {
+		return
+	}
+
+	fin, op = b[0]&0x80 != 0, b[0]&0x0f
+	c.masked = b[1]&0x80 != 0
+
+	// extensions are never negotiated
+	if b[0]&0x70 != 0 || c.masked == c.client {
+		err = ErrProtocol
+		return
+	}
+
+	switch length = uint64(b[1] & 0x7f); length {
+	case 126:
+		if _, err = io.ReadFull(c.r, b[:2]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:2]))
+	case 127:
+		if _, err = io.ReadFull(c.r, b[:8]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(b[:8])
+	}
+
+	if c.masked {
+		if _, err = io.ReadFull(c.r, c.mask[:]); err != nil {
+			return
+		}
+	}
+	c.maskPos = 0
+
+	if op >= opClose && (!fin || length > maxControlPayload) {
+		err = ErrProtocol
+	}
+	return
+}
+
+func (c *Conn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+
+	for i := range b {
+		b[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+// Read returns the payload of data frames, answering pings and close frames on the way.
+// It returns io.EOF once the peer has closed.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	for c.remaining == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		_, op, length, err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+
+		switch op {
+		case opContinuation, opText, opBinary:
+			c.remaining = length
+			continue
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return 0, err
+		}
+		c.unmask(payload)
+
+		switch op {
+		case opPing:
+			// unanswered once closed for writing
+			if err := c.writeFrame(opPong, payload); err != nil && err != net.ErrClosed {
+				return 0, err
+			}
+		case opClose:
+			c.eof = true
+			c.sendClose(payload)
+			return 0, io.EOF
+		case opPong:
+		default:
+			return 0, ErrProtocol
+		}
+	}
+
+	if uint64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err := c.r.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= uint64(n)
+
+	if err == io.EOF && c.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Write sends b as a single binary frame
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame sends payload in a single write, so frames of concurrent writers do not interleave
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+
+	return c.writeFrameLocked(op, payload)
+}
+
+func (c *Conn) writeFrameLocked(op byte, payload []byte) error {
+	buf := append(c.buf[:0], 0x80|op)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = binary.BigEndian.AppendUint16(append(buf, maskBit|126), uint16(n))
+	default:
+		buf = binary.BigEndian.AppendUint64(append(buf, maskBit|127), uint64(n))
+	}
+
+	start := len(buf)
+	if c.client {
+		// only against proxies mistaking the stream for HTTP, it need not be secret
+		buf = binary.LittleEndian.AppendUint32(buf, mrand.Uint32())
+		mask := buf[start:]
+		start += 4
+
+		buf = append(buf, payload...)
+		for i := range buf[start:] {
+			buf[start+i] ^= mask[i&3]
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+
+	c.buf = buf
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// sendClose sends a close frame with payload, once
+func (c *Conn) sendClose(payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+
+	return c.writeFrameLocked(opClose, payload)
+}
+
+// CloseWrite sends a close frame, after which the peer is expected to close too
+func (c *Conn) CloseWrite() error {
+	return c.sendClose(binary.BigEndian.AppendUint16(nil, closeNormal))
+}
+
+// Close sends a close frame, unless a write is blocked, and closes the connection
+func (c *Conn) Close() error {
+	if c.writeLock.TryLock() {
+		if !c.closeSent {
+			c.closeSent = true
+			c.writeFrameLocked(opClose, binary.BigEndian.AppendUint16(nil, closeNormal))
+		}
+		c.writeLock.Unlock()
+	}
+	return c.Conn.Close()
+}
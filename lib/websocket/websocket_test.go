@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"lib/assert"
+	"lib/http1"
+	"net"
+	"testing"
+)
+
+// pair upgrades both ends of a pipe, the server speaking one of serverProtocols
+func pair(t *testing.T, clientProtocols []string, serverProtocols []string) (*Conn, *Conn, error) {
+	c, s := net.Pipe()
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	accepted := make(chan result, 1)
+
+	go func() {
+		r := bufio.NewReader(s)
+		req, err := http1.ReadRequest(r, http1.DefaultLimits)
+		if err != nil {
+			accepted <- result{nil, err}
+			return
+		}
+
+		conn, err := Accept(s, r, req, serverProtocols)
+		if err != nil {
+			s.Write([]byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"))
+		}
+		accepted <- result{conn, err}
+	}()
+
+	client, err := Client(c, "example.com", "/tunnel", clientProtocols)
+	server := <-accepted
+	assert.Equal(t, err == nil, server.err == nil)
+
+	return client, server.conn, err
+}
+
+func TestWebSocket(t *testing.T) {
+	client, server, err := pair(t, []string{"b", "a"}, []string{"a", "b"})
+	assert.Null(t, err)
+	assert.Equal(t, "b", client.Protocol())
+	assert.Equal(t, "b", server.Protocol())
+
+	// lengths of each size encoding
+	for _, n := range []int{0, 100, 1000, 70000} {
+		data := bytes.Repeat([]byte{byte(n)}, n)
+
+		go client.Write(data)
+		got := make([]byte, n)
+		_, err := io.ReadFull(server, got)
+		assert.Null(t, err)
+		assert.Equal(t, true, bytes.Equal(data, got))
+
+		go server.Write(data)
+		_, err = io.ReadFull(client, got)
+		assert.Null(t, err)
+		assert.Equal(t, true, bytes.Equal(data, got))
+	}
+
+	// the client closes, the server answers and reads no more
+	closed := make(chan error, 1)
+	go func() {
+		client.CloseWrite()
+		_, err := client.Read(make([]byte, 1))
+		closed <- err
+	}()
+
+	_, err = server.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, io.EOF, <-closed)
+}
+
+func TestWebSocket_Ping(t *testing.T) {
+	c, s := net.Pipe()
+	server := &Conn{Conn: s, r: bufio.NewReader(s)}
+
+	// a masked ping, then masked data, from a client
+	frames := []byte{0x89, 0x82, 1, 2, 3, 4, 'h' ^ 1, 'i' ^ 2, 0x82, 0x81, 5, 6, 7, 8, 'x' ^ 5}
+	go c.Write(frames)
+
+	read := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, 1)
+		io.ReadFull(server, b)
+		read <- b
+	}()
+
+	pong := make([]byte, 4)
+	_, err := io.ReadFull(c, pong)
+	assert.Null(t, err)
+	assert.Equal(t, "\x8a\x02hi", string(pong))
+	assert.Equal(t, "x", string(<-read))
+}
+
+func TestWebSocket_Unmasked(t *testing.T) {
+	c, s := net.Pipe()
+	server := &Conn{Conn: s, r: bufio.NewReader(s)}
+
+	go c.Write([]byte{0x82, 0x01, 'x'})
+	_, err := server.Read(make([]byte, 1))
+	assert.Equal(t, ErrProtocol, err)
+}
+
+func TestWebSocket_Handshake(t *testing.T) {
+	_, _, err := pair(t, []string{"c"}, []string{"a"})
+	assert.Equal(t, true, errors.Is(err, ErrHandshake))
+
+	// from RFC 6455 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
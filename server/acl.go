@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrDestinationDenied = errors.New("destination denied")
+var ErrInvalidAclRule = errors.New("invalid acl rule")
+
+// A rule matches if every criterion it sets matches. Within a criterion, any item may match.
+type AclRule struct {
+	// allow or deny
+	Action string `json:"action"`
+	// CIDR of resolved destination addresses, e.g. 10.0.0.0/8
+	Cidr []string `json:"cidr"`
+	// glob of the requested host name, e.g. *.internal
+	Host []string `json:"host"`
+	// destination port or port range, e.g. 443 or 8000-8999
+	Ports []string `json:"ports"`
+	// glob of the client certificate CN or SAN
+	Subject []string `json:"subject"`
+}
+
+// Rules are evaluated in order, and the first match decides. Default applies when nothing matches.
+type AclConfig struct {
+	Rules   []AclRule `json:"rules"`
+	Default string    `json:"default"`
+}
+
+// DefaultAclConfig keeps clients from reaching the server's own and neighbouring networks
+var DefaultAclConfig = AclConfig{
+	Rules: []AclRule{
+		{
+			Action: "deny",
+			Cidr: []string{
+				"0.0.0.0/8", "127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16",
+				"169.254.0.0/16", "100.64.0.0/10", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+				"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8", "64:ff9b::/96",
+			},
+		},
+	},
+	Default: "allow",
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+type aclRule struct {
+	allow    bool
+	nets     []netip.Prefix
+	hosts    []string
+	ports    []portRange
+	subjects []string
+}
+
+type Acl struct {
+	rules []aclRule
+	allow bool
+}
+
+func parseAction(action string) (bool, error) {
+	switch strings.ToLower(action) {
+	case "allow":
+		return true, nil
+	case "deny":
+		return false, nil
+	}
+
+	return false, ErrInvalidAclRule
+}
+
+func parsePortRange(s string) (ret portRange, err error) {
+	from, to, found := strings.Cut(s, "-")
+
+	f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+	if err != nil {
+		return
+	}
+
+	t := f
+	if found {
+		if t, err = strconv.ParseUint(strings.TrimSpace(to), 10, 16); err != nil {
+			return
+		}
+	}
+
+	if t < f {
+		err = ErrInvalidAclRule
+		return
+	}
+
+	return portRange{uint16(f), uint16(t)}, nil
+}
+
+func NewAcl(config AclConfig) (ret *Acl, err error) {
+	ret = &Acl{allow: true}
+
+	if config.Default != "" {
+		if ret.allow, err = parseAction(config.Default); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, r := range config.Rules {
+		rule := aclRule{}
+
+		if rule.allow, err = parseAction(r.Action); err != nil {
+			return nil, err
+		}
+
+		for _, c := range r.Cidr {
+			prefix, e := netip.ParsePrefix(c)
+			if e != nil {
+				return nil, e
+			}
+			rule.nets = append(rule.nets, prefix.Masked())
+		}
+
+		for _, h := range r.Host {
+			rule.hosts = append(rule.hosts, strings.ToLower(h))
+		}
+
+		for _, p := range r.Ports {
+			pr, e := parsePortRange(p)
+			if e != nil {
+				return nil, e
+			}
+			rule.ports = append(rule.ports, pr)
+		}
+
+		rule.subjects = r.Subject
+
+		ret.rules = append(ret.rules, rule)
+	}
+
+	return
+}
+
+func matchGlob(patterns []string, names ...string) bool {
+	for _, p := range patterns {
+		for _, n := range names {
+			if ok, _ := path.Match(p, n); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (r *aclRule) match(client *ClientIdentity, host string, ip netip.Addr, port uint16) bool {
+	if len(r.nets) > 0 {
+		found := false
+		for _, n := range r.nets {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.hosts) > 0 && !matchGlob(r.hosts, strings.ToLower(host)) {
+		return false
+	}
+
+	if len(r.ports) > 0 {
+		found := false
+		for _, p := range r.ports {
+			if port >= p.from && port <= p.to {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.subjects) > 0 && (client == nil || !matchGlob(r.subjects, client.Subjects...)) {
+		return false
+	}
+
+	return true
+}
+
+// Allowed checks a resolved destination address. host is the name requested by the client.
+// It returns the index of the deciding rule, or -1 for the default action.
+func (a *Acl) Allowed(client *ClientIdentity, host string, ip netip.Addr, port uint16) (bool, int) {
+	ip = ip.Unmap()
+
+	for i := range a.rules {
+		if a.rules[i].match(client, host, ip, port) {
+			return a.rules[i].allow, i
+		}
+	}
+
+	return a.allow, -1
+}
+
+// aclDialer resolves the destination first and dials the first resolved address allowed by the acl,
+// so the address checked is the address connected to
+type aclDialer struct {
+	proxy  *Proxy
+	client *ClientIdentity
+}
+
+func (d aclDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	resolver := d.proxy.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ErrDestinationDenied
+
+	for _, ip := range ips {
+		ip = ip.Unmap()
+
+		if ok, rule := d.proxy.acl.Allowed(d.client, host, ip, uint16(port)); !ok {
+			d.proxy.logger.Warn().
+				Value("client", d.client.Name).
+				Value("remote", d.client.Addr).
+				Value("url", addr).
+				Value("ip", ip.String()).
+				Value("rule", rule).
+				Msg("destination denied")
+			continue
+		}
+
+		conn, e := d.proxy.dialer.DialContext(ctx, network, netip.AddrPortFrom(ip, uint16(port)).String())
+		if e == nil {
+			return conn, nil
+		}
+		err = e
+	}
+
+	return nil, err
+}
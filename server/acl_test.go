@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"lib/assert"
+	"lib/structured_logger"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestAcl_Default(t *testing.T) {
+	acl, err := NewAcl(DefaultAclConfig)
+	assert.Null(t, err)
+
+	for _, tc := range []struct {
+		ip    string
+		allow bool
+	}{
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"0.0.0.0", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"172.32.0.1", true},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"224.0.0.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"ff02::1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b::7f00:1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:192.168.0.1", false},
+		{"8.8.8.8", true},
+		{"::ffff:8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+	} {
+		allow, _ := acl.Allowed(nil, "example.com", netip.MustParseAddr(tc.ip), 443)
+		assert.Equal(t, tc.allow, allow)
+	}
+}
+
+func TestAcl_Rules(t *testing.T) {
+	acl, err := NewAcl(AclConfig{
+		Rules: []AclRule{
+			{Action: "allow", Host: []string{"*.internal"}, Ports: []string{"443", "8000-8999"}, Subject: []string{"admin*"}},
+			{Action: "deny", Ports: []string{"25"}},
+			{Action: "allow", Cidr: []string{"10.0.0.0/8"}},
+		},
+		Default: "deny",
+	})
+	assert.Null(t, err)
+
+	admin := &ClientIdentity{Subjects: []string{"client", "admin-1"}}
+	user := &ClientIdentity{Subjects: []string{"client"}}
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	for _, tc := range []struct {
+		client *ClientIdentity
+		host   string
+		ip     netip.Addr
+		port   uint16
+		allow  bool
+		rule   int
+	}{
+		{admin, "db.INTERNAL", ip, 8080, true, 0},
+		{admin, "db.internal", ip, 443, true, 0},
+		{admin, "db.internal", ip, 9000, false, -1},
+		{user, "db.internal", ip, 443, false, -1},
+		{nil, "db.internal", ip, 443, false, -1},
+		{admin, "db.internal", netip.MustParseAddr("10.0.0.1"), 25, false, 1},
+		{user, "example.com", netip.MustParseAddr("10.0.0.1"), 443, true, 2},
+		{user, "example.com", netip.MustParseAddr("::ffff:10.0.0.1"), 443, true, 2},
+	} {
+		allow, rule := acl.Allowed(tc.client, tc.host, tc.ip, tc.port)
+		assert.Equal(t, tc.allow, allow)
+		assert.Equal(t, tc.rule, rule)
+	}
+
+	_, err = NewAcl(AclConfig{Default: "maybe"})
+	assert.Equal(t, ErrInvalidAclRule, err)
+
+	_, err = NewAcl(AclConfig{Rules: []AclRule{{Action: "allow", Cidr: []string{"10.0.0.0/33"}}}})
+	assert.NotNull(t, err)
+}
+
+func TestParsePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		from uint16
+		to   uint16
+		ok   bool
+	}{
+		{"443", 443, 443, true},
+		{"8000-8999", 8000, 8999, true},
+		{" 1 - 1024 ", 1, 1024, true},
+		{"0-65535", 0, 65535, true},
+		{"9000-8000", 0, 0, false},
+		{"65536", 0, 0, false},
+		{"80-", 0, 0, false},
+		{"-80", 0, 0, false},
+		{"http", 0, 0, false},
+	} {
+		r, err := parsePortRange(tc.s)
+		assert.Equal(t, tc.ok, err == nil)
+		if tc.ok {
+			assert.Equal(t, portRange{tc.from, tc.to}, r)
+		}
+	}
+}
+
+// The address checked is the one dialed, whatever the host name requested
+func TestAclDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Null(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+
+	proxy, err := NewProxy(ProxyConfig{}, &net.Dialer{}, structured_logger.NewLogger("error"))
+	assert.Null(t, err)
+
+	// localhost is a name no CIDR matches, until resolved
+	dialer := aclDialer{proxy: proxy, client: &ClientIdentity{Name: "client"}}
+	_, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	assert.Equal(t, true, errors.Is(err, ErrDestinationDenied))
+
+	_, err = dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("::ffff:127.0.0.1", port))
+	assert.Equal(t, true, errors.Is(err, ErrDestinationDenied))
+
+	proxy.acl, err = NewAcl(AclConfig{Rules: []AclRule{{Action: "allow", Cidr: []string{"127.0.0.1/32"}}}, Default: "deny"})
+	assert.Null(t, err)
+
+	conn, err := dialer.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	assert.Null(t, err)
+	assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+	conn.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"lib"
+	"net"
+	"net/netip"
+	"strconv"
+
+	fiber "github.com/gofiber/fiber/v2"
+)
+
+var ErrAdminToken = errors.New("ADMIN_TOKEN is required to serve the admin API beyond loopback")
+
+// isLoopback tells whether addr, in host:port form, only listens on loopback
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.Unmap().IsLoopback()
+}
+
+func bearerAuth(token string) fiber.Handler {
+	want := []byte("Bearer " + token)
+
+	return func(c *fiber.Ctx) error {
+		if subtle.ConstantTimeCompare([]byte(c.Get(fiber.HeaderAuthorization)), want) != 1 {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+			return fiber.ErrUnauthorized
+		}
+		return c.Next()
+	}
+}
+
+// AdminRoutes serve metrics, and let operators inspect and close the tunnel streams of proxy:
+//
+//	GET    /connections      streams being served, oldest first
+//	GET    /connections/:id  a single stream
+//	DELETE /connections/:id  closes a stream on both sides
+//	GET    /drain            whether new streams are refused
+//	POST   /drain            refuses new streams while those being served finish
+//	DELETE /drain            accepts new streams again
+//
+// With a token, all but /metrics require an Authorization: Bearer header carrying it. Without one, addr must be a
+// loopback address.
+func AdminRoutes(proxy *Proxy, addr string, token string, logger lib.Logger) func(*fiber.App) error {
+	connections := proxy.connections
+
+	find := func(c *fiber.Ctx) (*Connection, error) {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return nil, fiber.ErrBadRequest
+		}
+
+		entry, ok := connections.Get(id)
+		if !ok {
+			return nil, fiber.ErrNotFound
+		}
+		return entry, nil
+	}
+
+	drainStatus := func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"draining": connections.Draining(), "connections": connections.Len()})
+	}
+
+	return func(app *fiber.App) error {
+		if token == "" && !isLoopback(addr) {
+			return ErrAdminToken
+		}
+
+		app.Get("/metrics", ServeMetrics)
+
+		// after /metrics, so it stays open to scrapers
+		if token != "" {
+			app.Use(bearerAuth(token))
+		}
+
+		app.Get("/connections", func(c *fiber.Ctx) error {
+			list := connections.List()
+			ret := make([]ConnectionInfo, len(list))
+			for i, entry := range list {
+				ret[i] = entry.Info()
+			}
+			return c.JSON(ret)
+		})
+
+		app.Get("/connections/:id", func(c *fiber.Ctx) error {
+			entry, err := find(c)
+			if err != nil {
+				return err
+			}
+			return c.JSON(entry.Info())
+		})
+
+		app.Delete("/connections/:id", func(c *fiber.Ctx) error {
+			entry, err := find(c)
+			if err != nil {
+				return err
+			}
+
+			info := entry.Info()
+			logger.Warn().Value("client", info.Client).Value("remote", info.Remote).Value("url", info.Target).Msg("closing stream on admin request")
+			entry.Close()
+			return c.SendStatus(fiber.StatusNoContent)
+		})
+
+		app.Get("/drain", drainStatus)
+
+		app.Post("/drain", func(c *fiber.Ctx) error {
+			connections.Drain()
+			logger.Info().Msg("draining, new streams are refused")
+			return drainStatus(c)
+		})
+
+		app.Delete("/drain", func(c *fiber.Ctx) error {
+			connections.Resume()
+			logger.Info().Msg("accepting new streams")
+			return drainStatus(c)
+		})
+
+		return nil
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"lib"
+	"lib/assert"
+	"lib/structured_logger"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func adminApp(t *testing.T, addr string, token string) (*lib.Fiber, error) {
+	logger := structured_logger.NewLogger("error")
+
+	proxy, err := NewProxy(ProxyConfig{}, &net.Dialer{}, logger)
+	assert.Null(t, err)
+
+	return lib.NewFiber(AdminRoutes(proxy, addr, token, logger))
+}
+
+func adminStatus(t *testing.T, app *lib.Fiber, method string, target string, token string) int {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := app.Test(req)
+	assert.Null(t, err)
+	return res.StatusCode
+}
+
+func TestAdminRoutes_Loopback(t *testing.T) {
+	for _, addr := range []string{":9090", "0.0.0.0:9090", "[::]:9090", "192.0.2.1:9090", "admin.example.com:9090", "9090"} {
+		_, err := adminApp(t, addr, "")
+		assert.Equal(t, ErrAdminToken, err)
+	}
+
+	for _, addr := range []string{"127.0.0.1:9090", "127.0.0.2:9090", "[::1]:9090", "localhost:9090"} {
+		app, err := adminApp(t, addr, "")
+		assert.Null(t, err)
+		assert.Equal(t, 200, adminStatus(t, app, "POST", "/drain", ""))
+		assert.Equal(t, 200, adminStatus(t, app, "DELETE", "/drain", ""))
+	}
+}
+
+func TestAdminRoutes_Token(t *testing.T) {
+	app, err := adminApp(t, ":9090", "secret")
+	assert.Null(t, err)
+
+	assert.Equal(t, 200, adminStatus(t, app, "GET", "/metrics", ""))
+
+	for _, req := range [][2]string{{"GET", "/connections"}, {"DELETE", "/connections/1"}, {"POST", "/drain"}, {"DELETE", "/drain"}} {
+		assert.Equal(t, 401, adminStatus(t, app, req[0], req[1], ""))
+		assert.Equal(t, 401, adminStatus(t, app, req[0], req[1], "wrong"))
+	}
+
+	assert.Equal(t, 200, adminStatus(t, app, "GET", "/connections", "secret"))
+	assert.Equal(t, 404, adminStatus(t, app, "DELETE", "/connections/1", "secret"))
+	assert.Equal(t, 200, adminStatus(t, app, "POST", "/drain", "secret"))
+	assert.Equal(t, 200, adminStatus(t, app, "DELETE", "/drain", "secret"))
+}
@@ -1,9 +1,161 @@
 package main
 
+import (
+	"encoding/json"
+	"lib"
+	"os"
+	"path"
+	"time"
+)
+
 type Config struct {
 	LogLevel   string `env:"LOG_LEVEL" default:"INFO"`
 	ListenAddr string `env:"LISTEN_ADDR" default:":220"`
 	ServerKey  string `env:"SERVER_KEY"`
 	ServerCert string `env:"SERVER_CERT"`
 	RootCA     string `env:"ROOT_CA"`
+	ConfigPath string `env:"CONFIG_PATH"`
+	QuotaFile  string `env:"QUOTA_FILE"`
+	ClientCrl  string `env:"CLIENT_CRL"`
+	// file of revoked client certificate serials in hex, one per line
+	ClientDenyList string `env:"CLIENT_DENY_LIST"`
+	// admin listener serving /metrics and the connection API, disabled unless set. Only loopback addresses are
+	// allowed without ADMIN_TOKEN.
+	AdminAddr string `env:"ADMIN_ADDR"`
+	// bearer token the connection API requires, /metrics excepted
+	AdminToken string `env:"ADMIN_TOKEN"`
+	// seconds streams being served get to finish on shutdown, before they are closed
+	ShutdownGrace int `env:"SHUTDOWN_GRACE" default:"30"`
+	// seconds a stream may go without traffic in either direction, 0 disables it
+	IdleTimeout int `env:"IDLE_TIMEOUT" default:"300"`
+	// seconds a stream may stay open at all, 0 disables it
+	MaxLifetime int `env:"MAX_LIFETIME" default:"0"`
+	// seconds before keepalive probes start on idle TCP connections, 0 keeps the default of 15 and -1 disables them
+	TcpKeepAlive int `env:"TCP_KEEPALIVE" default:"30"`
+	// path tunnels are also served on over WebSocket, unless set in config.json. Disabled if empty.
+	WebSocketPath string `env:"WEBSOCKET_PATH"`
+	// UDP address tunnels are also served on over QUIC, e.g. :220. Disabled unless set.
+	QuicListenAddr string `env:"QUIC_LISTEN_ADDR"`
+}
+
+type TlsConfig struct {
+	Key  string `json:"key"`
+	Cert string `json:"cert"`
+	CA   string `json:"ca"`
+	// CRL issued by CA, in PEM or DER
+	Crl string `json:"crl"`
+	// file of revoked client certificate serials in hex, one per line
+	DenyList string `json:"denyList"`
+}
+
+type PathConfig struct {
+	Prefix string `json:"prefix"`
+	Root   string `json:"root"`
+	Addr   string `json:"addr"`
+}
+
+type RouteConfig struct {
+	Sni   string       `json:"sni"`
+	Paths []PathConfig `json:"paths"`
+}
+
+type ProxyConfig struct {
+	Sni string `json:"sni"`
+	// destinations clients may reach, DefaultAclConfig if omitted
+	Acl *AclConfig `json:"acl"`
+	// limits of clients not listed in Clients
+	Limits  ClientLimits            `json:"limits"`
+	Clients map[string]ClientLimits `json:"clients"`
+	// traffic counters persist in this file, QUOTA_FILE if omitted. They are never reset, removing the file while the
+	// server is stopped starts them over.
+	QuotaFile string `json:"quotaFile"`
+	// codecs streams and replies may be compressed with, e.g. ["zstd", "identity"]. DefaultCodecs if omitted.
+	// Streams the forwarder compresses with another codec are refused, identity is always accepted.
+	Codecs []string `json:"codecs"`
+	// path of the SNI tunnels are also served on inside a WebSocket upgrade, for forwarders behind networks that only
+	// let HTTPS through, e.g. /ws. WEBSOCKET_PATH if omitted, disabled if empty.
+	WebSocketPath string `json:"webSocketPath"`
+	// from IDLE_TIMEOUT and MAX_LIFETIME
+	Timeouts lib.Timeouts `json:"-"`
+}
+
+type GatewayConfig struct {
+	Tls    []TlsConfig   `json:"tls"`
+	Routes []RouteConfig `json:"routes"`
+	Proxy  ProxyConfig   `json:"proxy"`
+}
+
+// LoadGatewayConfig reads config.json under CONFIG_PATH. Relative file names are resolved against CONFIG_PATH.
+// Without CONFIG_PATH, a single proxy-only gateway is built from SERVER_CERT / SERVER_KEY / ROOT_CA.
+func LoadGatewayConfig(config *Config) (ret GatewayConfig, err error) {
+	timeouts := lib.Timeouts{
+		Idle:     time.Second * time.Duration(config.IdleTimeout),
+		Lifetime: time.Second * time.Duration(config.MaxLifetime),
+	}
+
+	if config.ConfigPath == "" {
+		ret.Tls = []TlsConfig{
+			{
+				Key:      config.ServerKey,
+				Cert:     config.ServerCert,
+				CA:       config.RootCA,
+				Crl:      config.ClientCrl,
+				DenyList: config.ClientDenyList,
+			},
+		}
+		ret.Proxy.QuotaFile = config.QuotaFile
+		ret.Proxy.Timeouts = timeouts
+		ret.Proxy.WebSocketPath = config.WebSocketPath
+		return
+	}
+
+	b, err := os.ReadFile(path.Join(config.ConfigPath, "config.json"))
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(b, &ret); err != nil {
+		return
+	}
+
+	for i := range ret.Tls {
+		t := &ret.Tls[i]
+		t.Key = resolvePath(config.ConfigPath, t.Key)
+		t.Cert = resolvePath(config.ConfigPath, t.Cert)
+		t.CA = resolvePath(config.ConfigPath, t.CA)
+		t.Crl = resolvePath(config.ConfigPath, t.Crl)
+		t.DenyList = resolvePath(config.ConfigPath, t.DenyList)
+	}
+
+	ret.Proxy.Timeouts = timeouts
+
+	if ret.Proxy.QuotaFile == "" {
+		ret.Proxy.QuotaFile = config.QuotaFile
+	}
+	ret.Proxy.QuotaFile = resolvePath(config.ConfigPath, ret.Proxy.QuotaFile)
+
+	if ret.Proxy.WebSocketPath == "" {
+		ret.Proxy.WebSocketPath = config.WebSocketPath
+	}
+
+	for i := range ret.Routes {
+		for j := range ret.Routes[i].Paths {
+			p := &ret.Routes[i].Paths[j]
+			p.Root = resolvePath(config.ConfigPath, p.Root)
+
+			if p.Prefix == "" {
+				p.Prefix = "/"
+			}
+		}
+	}
+
+	return
+}
+
+func resolvePath(dir string, file string) string {
+	if file == "" || path.IsAbs(file) {
+		return file
+	}
+
+	return path.Join(dir, file)
 }
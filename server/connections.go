@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"lib"
+	"lib/handshake"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrDraining = errors.New("server is draining")
+
+// Connection is a tunnel stream being served
+type Connection struct {
+	Id     uint64
+	Client *ClientIdentity
+	Start  time.Time
+
+	// bytes read from and written to the forwarder, as sent over the tunnel
+	up   atomic.Int64
+	down atomic.Int64
+
+	lock    sync.Mutex
+	request handshake.Request
+	// tunnel side of the stream, and the destination once dialed
+	conn   net.Conn
+	remote net.Conn
+	closed bool
+}
+
+// ConnectionInfo is a snapshot of a Connection for the admin API
+type ConnectionInfo struct {
+	Id       uint64    `json:"id"`
+	Client   string    `json:"client"`
+	Subjects []string  `json:"subjects"`
+	Remote   string    `json:"remote"`
+	Method   string    `json:"method,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Start    time.Time `json:"start"`
+	Up       int64     `json:"up"`
+	Down     int64     `json:"down"`
+}
+
+func (c *Connection) Info() ConnectionInfo {
+	c.lock.Lock()
+	req := c.request
+	c.lock.Unlock()
+
+	return ConnectionInfo{
+		Id:       c.Id,
+		Client:   c.Client.Name,
+		Subjects: c.Client.Subjects,
+		Remote:   c.Client.Addr,
+		Method:   req.Method,
+		Target:   req.Addr,
+		Start:    c.Start,
+		Up:       c.up.Load(),
+		Down:     c.down.Load(),
+	}
+}
+
+// SetRequest records the destination once the forwarder has asked for it
+func (c *Connection) SetRequest(req handshake.Request) {
+	c.lock.Lock()
+	c.request = req
+	c.lock.Unlock()
+}
+
+// SetRemote keeps the destination, so Close reaches both sides of the stream
+func (c *Connection) SetRemote(remote net.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		remote.Close()
+		return
+	}
+	c.remote = remote
+}
+
+// Close cuts the stream on both sides
+func (c *Connection) Close() {
+	c.lock.Lock()
+	c.closed = true
+	conn, remote := c.conn, c.remote
+	c.lock.Unlock()
+
+	conn.Close()
+	if remote != nil {
+		remote.Close()
+	}
+}
+
+// countedConn counts the bytes of the tunnel side of a Connection
+type countedConn struct {
+	net.Conn
+	entry *Connection
+}
+
+func (c *countedConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	c.entry.up.Add(int64(n))
+	return
+}
+
+func (c *countedConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.entry.down.Add(int64(n))
+	return
+}
+
+// CloseWrite passes the half-close of the stream on, hidden otherwise by the embedded net.Conn
+func (c *countedConn) CloseWrite() error {
+	return lib.CloseWrite(c.Conn)
+}
+
+// Connections registers the streams being served, so they can be listed and closed through the admin API
+type Connections struct {
+	lock     sync.Mutex
+	conns    map[uint64]*Connection
+	next     uint64
+	draining atomic.Bool
+	removed  chan struct{}
+}
+
+func NewConnections() *Connections {
+	return &Connections{
+		conns:   map[uint64]*Connection{},
+		removed: make(chan struct{}, 1),
+	}
+}
+
+// Add registers a stream of client, unless draining. Bytes are counted on the conn returned.
+func (c *Connections) Add(conn net.Conn, client *ClientIdentity) (*Connection, net.Conn, error) {
+	if c.draining.Load() {
+		return nil, nil, ErrDraining
+	}
+
+	entry := &Connection{
+		Client: client,
+		Start:  time.Now(),
+	}
+	entry.conn = &countedConn{Conn: conn, entry: entry}
+
+	c.lock.Lock()
+	c.next++
+	entry.Id = c.next
+	c.conns[entry.Id] = entry
+	c.lock.Unlock()
+
+	return entry, entry.conn, nil
+}
+
+func (c *Connections) Remove(entry *Connection) {
+	c.lock.Lock()
+	delete(c.conns, entry.Id)
+	c.lock.Unlock()
+
+	select {
+	case c.removed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Connections) Get(id uint64) (*Connection, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ret, ok := c.conns[id]
+	return ret, ok
+}
+
+// List returns the streams in the order they started
+func (c *Connections) List() []*Connection {
+	c.lock.Lock()
+	ret := make([]*Connection, 0, len(c.conns))
+	for _, entry := range c.conns {
+		ret = append(ret, entry)
+	}
+	c.lock.Unlock()
+
+	slices.SortFunc(ret, func(a, b *Connection) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return ret
+}
+
+func (c *Connections) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.conns)
+}
+
+// Wait returns once all streams are removed, or with the error of ctx
+func (c *Connections) Wait(ctx context.Context) error {
+	for c.Len() > 0 {
+		select {
+		case <-c.removed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// CloseAll closes the streams being served, and returns how many there were
+func (c *Connections) CloseAll() int {
+	list := c.List()
+	for _, entry := range list {
+		entry.Close()
+	}
+	return len(list)
+}
+
+// Drain refuses new streams while those being served finish, until Resume is called
+func (c *Connections) Drain() {
+	c.draining.Store(true)
+}
+
+func (c *Connections) Resume() {
+	c.draining.Store(false)
+}
+
+func (c *Connections) Draining() bool {
+	return c.draining.Load()
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"lib"
+	"lib/http1"
+	"lib/websocket"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var notFoundResponse = []byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+var badRequestResponse = []byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+
+type routePath struct {
+	prefix  string
+	handler http.Handler
+}
+
+type Gateway struct {
+	store atomic.Pointer[TlsStore]
+	tls   []TlsConfig
+	// client identity of each multiplexed tunnel connection, QUIC connection, or connection of a single stream
+	tunnels    sync.Map
+	routes     map[string][]routePath
+	proxySni   string
+	tlsConfig  *tls.Config
+	httpConfig *tls.Config
+	listener   *connListener
+	server     *http.Server
+	proxy      *Proxy
+	logger     lib.Logger
+
+	// tunnels over WebSocket are served on it, disabled if empty
+	webSocketPath string
+}
+
+func NewGateway(config GatewayConfig, dialer *net.Dialer, logger lib.Logger) (ret *Gateway, err error) {
+	store, err := NewTlsStore(config.Tls)
+	if err != nil {
+		return
+	}
+
+	proxy, err := NewProxy(config.Proxy, dialer, logger)
+	if err != nil {
+		return
+	}
+
+	ret = &Gateway{
+		tls:      config.Tls,
+		routes:   map[string][]routePath{},
+		proxySni: config.Proxy.Sni,
+		proxy:    proxy,
+		logger:   logger,
+		listener: newConnListener(),
+
+		webSocketPath: config.Proxy.WebSocketPath,
+	}
+	ret.store.Store(store)
+
+	for _, r := range config.Routes {
+		paths := make([]routePath, 0, len(r.Paths))
+
+		for _, p := range r.Paths {
+			var handler http.Handler
+
+			if p.Addr != "" {
+				u, e := url.Parse(p.Addr)
+				if e != nil {
+					return nil, e
+				}
+
+				handler = httputil.NewSingleHostReverseProxy(u)
+			} else {
+				handler = http.StripPrefix(strings.TrimSuffix(p.Prefix, "/"), http.FileServer(http.Dir(p.Root)))
+			}
+
+			paths = append(paths, routePath{prefix: p.Prefix, handler: handler})
+		}
+
+		ret.routes[r.Sni] = paths
+	}
+
+	ret.httpConfig = &tls.Config{
+		GetCertificate: ret.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+
+	ret.tlsConfig = &tls.Config{
+		GetConfigForClient: ret.getConfigForClient,
+	}
+
+	ret.server = &http.Server{
+		Handler:           ret,
+		ReadHeaderTimeout: time.Second * 30,
+	}
+
+	return
+}
+
+// isProxy returns true if the SNI should be served by the brotli tunnel.
+// Unknown SNI falls through to the tunnel, as clients connecting to an IP address send none. The handshake then
+// fails unless a key pair requiring client certificates matches, see TlsStore.GetProxyConfig.
+func (g *Gateway) isProxy(sni string) bool {
+	if sni == g.proxySni {
+		return true
+	}
+
+	_, ok := g.routes[sni]
+	return !ok
+}
+
+func (g *Gateway) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if g.isProxy(hello.ServerName) {
+		return g.store.Load().GetProxyConfig(hello)
+	}
+
+	return g.httpConfig, nil
+}
+
+func (g *Gateway) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return g.store.Load().GetCertificate(hello)
+}
+
+// TlsChanged reports whether certificate, CA, CRL or deny list files changed since the last load
+func (g *Gateway) TlsChanged() bool {
+	return g.store.Load().Changed()
+}
+
+// ReloadTls loads certificates again and swaps them in for new handshakes.
+// Live tunnels stay up, unless the client certificate has been revoked.
+func (g *Gateway) ReloadTls() error {
+	store, err := NewTlsStore(g.tls)
+	if err != nil {
+		return err
+	}
+
+	g.store.Store(store)
+
+	g.tunnels.Range(func(key, value any) bool {
+		client := value.(*ClientIdentity)
+
+		if store.Revoked(client.chain) {
+			g.logger.Warn().Value("client", client.Name).Value("remote", client.Addr).Msg("closing tunnel of revoked certificate")
+			key.(io.Closer).Close()
+		}
+		return true
+	})
+
+	return nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var paths []routePath
+	if r.TLS != nil {
+		paths = g.routes[r.TLS.ServerName]
+	}
+
+	var match *routePath
+	for i, p := range paths {
+		if strings.HasPrefix(r.URL.Path, p.prefix) && (match == nil || len(p.prefix) > len(match.prefix)) {
+			match = &paths[i]
+		}
+	}
+
+	if match == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	match.handler.ServeHTTP(w, r)
+}
+
+func (g *Gateway) HandleConnection(conn net.Conn) {
+	tlsConn := tls.Server(conn, g.tlsConfig)
+
+	// TODO: make it configurable
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+
+	if err != nil {
+		tlsFailures.With(tlsFailureReason(err)).Inc()
+		g.logger.Debug().Value("remote", conn.RemoteAddr().String()).Value("error", err.Error()).Msg("tls handshake failed")
+		tlsConn.Close()
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+
+	if !g.isProxy(state.ServerName) {
+		if !g.listener.push(tlsConn) {
+			tlsConn.Close()
+		}
+		return
+	}
+
+	client := NewClientIdentity(state, conn.RemoteAddr())
+
+	switch state.NegotiatedProtocol {
+	case TunnelProtocol, LegacyTunnelProtocol:
+		g.serveSession(tlsConn, tlsConn, client, state.NegotiatedProtocol)
+	case "http/1.1":
+		g.serveWebSocket(tlsConn, client)
+	default:
+		// one stream per connection, closed too if the certificate is revoked
+		g.tunnels.Store(tlsConn, client)
+		g.proxy.HandleProxy(tlsConn, client, state.NegotiatedProtocol)
+		g.tunnels.Delete(tlsConn)
+	}
+}
+
+// serveSession serves the multiplexed tunnel carried by conn, on the TLS connection tlsConn
+func (g *Gateway) serveSession(tlsConn *tls.Conn, conn net.Conn, client *ClientIdentity, protocol string) {
+	g.tunnels.Store(tlsConn, client)
+	tunnelsActive.With(protocol).Inc()
+	g.proxy.HandleSession(conn, client, protocol)
+	tunnelsActive.With(protocol).Dec()
+	g.tunnels.Delete(tlsConn)
+}
+
+// serveWebSocket serves a tunnel inside a WebSocket upgrade to webSocketPath, which to middleboxes looks like
+// ordinary web traffic. The subprotocol stands in for ALPN. Any other request is not found.
+func (g *Gateway) serveWebSocket(tlsConn *tls.Conn, client *ClientIdentity) {
+	r := bufio.NewReader(tlsConn)
+
+	tlsConn.SetReadDeadline(time.Now().Add(time.Second * 10))
+	req, err := http1.ReadRequest(r, http1.DefaultLimits)
+	tlsConn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		if res := http1.Reject(err); res != nil {
+			tlsConn.Write(res)
+		}
+		tlsConn.Close()
+		return
+	}
+
+	path, _, _ := strings.Cut(req.Url, "?")
+	if g.webSocketPath == "" || path != g.webSocketPath || !websocket.IsUpgrade(req) {
+		tlsConn.Write(notFoundResponse)
+		tlsConn.Close()
+		return
+	}
+
+	conn, err := websocket.Accept(tlsConn, r, req, []string{TunnelProtocol, LegacyTunnelProtocol})
+	if err != nil {
+		g.logger.Debug().Value("remote", client.Addr).Value("error", err.Error()).Msg("websocket upgrade failed")
+		tlsConn.Write(badRequestResponse)
+		tlsConn.Close()
+		return
+	}
+
+	g.logger.Debug().Value("remote", client.Addr).Value("protocol", conn.Protocol()).Msg("tunnel over websocket")
+	g.serveSession(tlsConn, conn, client, conn.Protocol())
+}
+
+// ServeHttp serves the http routes until Close is called
+func (g *Gateway) ServeHttp() error {
+	err := g.server.Serve(g.listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (g *Gateway) Close() error {
+	return g.server.Close()
+}
+
+// Shutdown drains the proxy once the listener has stopped. New streams are refused, forwarders are told to go elsewhere,
+// and streams being served get grace to finish before they are closed along with the tunnels.
+func (g *Gateway) Shutdown(grace time.Duration) {
+	connections := g.proxy.connections
+	connections.Drain()
+
+	sessions := g.proxy.GoAway()
+	g.logger.Info().Value("sessions", sessions).Value("streams", connections.Len()).Value("grace", grace.String()).Msg("draining tunnels")
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	if err := connections.Wait(ctx); err != nil {
+		g.logger.Warn().Value("streams", connections.CloseAll()).Msg("closed streams left after grace period")
+	} else {
+		g.logger.Info().Msg("all streams finished")
+	}
+
+	n := 0
+	g.tunnels.Range(func(key, value any) bool {
+		key.(io.Closer).Close()
+		n++
+		return true
+	})
+
+	g.logger.Info().Value("tunnels", n).Msg("closed tunnels")
+}
+
+// connListener hands over connections accepted and handshaked by the gateway to http.Server
+type connListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"lib/assert"
+	"lib/structured_logger"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes the certificate and key of c to dir, for a TlsConfig
+func writeKeyPair(t *testing.T, dir string, name string, c *testIssuer) TlsConfig {
+	key, err := x509.MarshalECPrivateKey(c.key)
+	assert.Null(t, err)
+
+	ret := TlsConfig{Cert: path.Join(dir, name+".pem"), Key: path.Join(dir, name+".key")}
+	assert.Null(t, os.WriteFile(ret.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600))
+	assert.Null(t, os.WriteFile(ret.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600))
+	return ret
+}
+
+func (c *testIssuer) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+type testPki struct {
+	dir    string
+	issuer *testIssuer
+	ca     TlsConfig
+	web    TlsConfig
+	tunnel TlsConfig
+	client *testIssuer
+}
+
+func newTestPki(t *testing.T) *testPki {
+	dir := t.TempDir()
+	ca := issue(t, nil, "ca", 1, true)
+
+	return &testPki{
+		dir:    dir,
+		issuer: ca,
+		ca:     writeKeyPair(t, dir, "ca", ca),
+		web:    writeKeyPair(t, dir, "web", issue(t, nil, "web", 2, false, "web.example")),
+		tunnel: writeKeyPair(t, dir, "tunnel", issue(t, nil, "tunnel", 3, false, "proxy.example", "127.0.0.1")),
+		client: issue(t, ca, "client", 4, false),
+	}
+}
+
+func newTestGateway(t *testing.T, tlsConfig ...TlsConfig) *Gateway {
+	g, err := NewGateway(GatewayConfig{
+		Tls:    tlsConfig,
+		Routes: []RouteConfig{{Sni: "web.example"}},
+		Proxy:  ProxyConfig{Sni: "proxy.example"},
+	}, &net.Dialer{}, structured_logger.NewLogger("error"))
+	assert.Null(t, err)
+
+	return g
+}
+
+// dialGateway connects to g over TCP on loopback, returning the server side connection and its handshake error
+func dialGateway(t *testing.T, g *Gateway, serverName string, cert *testIssuer) (*tls.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Null(t, err)
+	defer l.Close()
+
+	type result struct {
+		conn *tls.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			done <- result{nil, err}
+			return
+		}
+
+		tlsConn := tls.Server(conn, g.tlsConfig)
+		done <- result{tlsConn, tlsConn.Handshake()}
+	}()
+
+	config := &tls.Config{ServerName: serverName, InsecureSkipVerify: true, NextProtos: []string{TunnelProtocol, "http/1.1"}}
+	if cert != nil {
+		config.Certificates = []tls.Certificate{cert.tlsCertificate()}
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Null(t, err)
+
+	client := tls.Client(conn, config)
+	t.Cleanup(func() {
+		client.Close()
+	})
+	client.Handshake()
+
+	ret := <-done
+	if ret.conn != nil {
+		t.Cleanup(func() {
+			ret.conn.Close()
+		})
+	}
+	return ret.conn, ret.err
+}
+
+func TestGateway_UnknownSni(t *testing.T) {
+	pki := newTestPki(t)
+	tunnel := pki.tunnel
+	tunnel.CA = pki.ca.Cert
+
+	// the first key pair has no CA, and must not stand in for names matching none
+	g := newTestGateway(t, pki.web, tunnel)
+
+	_, err := dialGateway(t, g, "anything.else", pki.client)
+	assert.Equal(t, true, errors.Is(err, ErrNoTunnelCertificate))
+
+	_, err = dialGateway(t, g, "proxy.example", nil)
+	assert.NotNull(t, err)
+
+	conn, err := dialGateway(t, g, "proxy.example", pki.client)
+	assert.Null(t, err)
+	assert.Equal(t, 1, len(conn.ConnectionState().VerifiedChains))
+
+	// no SNI, by the IP SAN
+	_, err = dialGateway(t, g, "", pki.client)
+	assert.Null(t, err)
+
+	// routes are served to web clients as before
+	_, err = dialGateway(t, g, "web.example", nil)
+	assert.Null(t, err)
+
+	// a tunnel key pair without a CA lets no one in
+	g = newTestGateway(t, pki.web, pki.tunnel)
+
+	for _, sni := range []string{"proxy.example", ""} {
+		_, err = dialGateway(t, g, sni, pki.client)
+		assert.Equal(t, true, errors.Is(err, ErrNoClientCA))
+	}
+}
+
+func TestGateway_ReloadTls(t *testing.T) {
+	pki := newTestPki(t)
+	tunnel := pki.tunnel
+	tunnel.CA = pki.ca.Cert
+	tunnel.Crl = path.Join(pki.dir, "crl.pem")
+
+	crl := func(serials ...int64) {
+		b, err := os.ReadFile(writeCrl(t, pki.issuer, serials...))
+		assert.Null(t, err)
+		assert.Null(t, os.WriteFile(tunnel.Crl, b, 0600))
+	}
+	crl()
+
+	g := newTestGateway(t, tunnel)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Null(t, err)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go g.HandleConnection(conn)
+		}
+	}()
+
+	// no ALPN, a legacy connection carrying a single stream
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:         "proxy.example",
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{pki.client.tlsCertificate()},
+	})
+	assert.Null(t, err)
+	defer conn.Close()
+
+	for deadline := time.Now().Add(time.Second * 5); g.proxy.connections.Len() == 0 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, 1, g.proxy.connections.Len())
+
+	// another certificate revoked
+	crl(5)
+	assert.Null(t, g.ReloadTls())
+
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 200))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, true, errors.Is(err, os.ErrDeadlineExceeded))
+
+	crl(5, pki.client.cert.SerialNumber.Int64())
+	assert.Null(t, g.ReloadTls())
+
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, false, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.NotNull(t, err)
+}
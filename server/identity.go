@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// ClientIdentity describes who is on the other end of a tunnel, from its client certificate
+type ClientIdentity struct {
+	// Name is the certificate CN, or its first SAN if the CN is empty
+	Name string
+	// Subjects are all names the certificate was issued for, CN first
+	Subjects []string
+	Addr     string
+	// verified chain of the certificate, checked again for revocation when certificates reload
+	chain []*x509.Certificate
+}
+
+func NewClientIdentity(state tls.ConnectionState, addr net.Addr) *ClientIdentity {
+	ret := &ClientIdentity{
+		Addr: addr.String(),
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		return ret
+	}
+
+	cert := state.PeerCertificates[0]
+
+	if len(state.VerifiedChains) > 0 {
+		ret.chain = state.VerifiedChains[0]
+	}
+
+	if cert.Subject.CommonName != "" {
+		ret.Subjects = append(ret.Subjects, cert.Subject.CommonName)
+	}
+
+	ret.Subjects = append(ret.Subjects, cert.DNSNames...)
+	ret.Subjects = append(ret.Subjects, cert.EmailAddresses...)
+
+	for _, u := range cert.URIs {
+		ret.Subjects = append(ret.Subjects, u.String())
+	}
+
+	if len(ret.Subjects) > 0 {
+		ret.Name = ret.Subjects[0]
+	}
+
+	return ret
+}
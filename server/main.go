@@ -2,12 +2,11 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"lib"
 	"lib/journald_logger"
 	"net"
 	"os"
+	"os/signal"
 	"syscall"
 	"time"
 )
@@ -20,7 +19,10 @@ func main() {
 	go logger.Start()
 	defer logger.Close(true)
 
+	keepAlive := time.Second * time.Duration(config.TcpKeepAlive)
+
 	lc := net.ListenConfig{
+		KeepAlive: keepAlive,
 		Control: func(network, address string, c syscall.RawConn) error {
 			return c.Control(func(fd uintptr) {
 				// 23 - TCP_FASTOPEN
@@ -30,25 +32,12 @@ func main() {
 		},
 	}
 
-	certs := lib.Must(tls.LoadX509KeyPair(config.ServerCert, config.ServerKey))
-
-	tlsConfig := tls.Config{
-		Certificates: []tls.Certificate{certs},
-		ClientAuth:   tls.NoClientCert,
-		MinVersion:   tls.VersionTLS13,
-	}
-
-	if config.RootCA != "" {
-		certPool := x509.NewCertPool()
-		certPool.AppendCertsFromPEM(lib.Must(os.ReadFile(config.RootCA)))
-
-		tlsConfig.ClientCAs = certPool
-		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
-	}
+	gatewayConfig := lib.Must(LoadGatewayConfig(config))
 
 	tl := lib.Must(lc.Listen(lib.AppScope.Context, "tcp", config.ListenAddr))
 
 	dialer := net.Dialer{
+		KeepAlive: keepAlive,
 		Control: func(network, address string, c syscall.RawConn) error {
 			return c.Control(func(fd uintptr) {
 				// 30 - TCP_FASTOPEN_CONNECT
@@ -57,17 +46,59 @@ func main() {
 		},
 	}
 
+	gateway := lib.Must(NewGateway(gatewayConfig, &dialer, logger))
+
+	lib.AppScope.GoWithClose(func() {
+		gateway.ServeHttp()
+	}, func() bool {
+		gateway.Close()
+		return false
+	})
+
+	lib.AppScope.Go(func() {
+		WatchTls(lib.AppScope.Context, gateway, logger)
+	})
+
+	lib.AppScope.Go(func() {
+		SaveAccounts(lib.AppScope.Context, gateway.proxy.accounts, logger)
+	})
+
 	lib.AppScope.GoWithClose(func() {
-		StartListener(lib.AppScope.Context, tl, &tlsConfig, &dialer)
+		StartListener(lib.AppScope.Context, tl, gateway)
 	}, func() bool {
 		tl.(*net.TCPListener).SetDeadline(time.Now())
 		return false
 	})
 
+	if config.QuicListenAddr != "" {
+		pc := lib.Must(net.ListenPacket("udp", config.QuicListenAddr))
+
+		lib.AppScope.Go(func() {
+			if err := gateway.ServeQuic(lib.AppScope.Context, pc); err != nil {
+				logger.Err().Value("error", err.Error()).Msg("quic listener stopped")
+			}
+		})
+	}
+
+	lib.AppScope.Go(func() {
+		<-lib.AppScope.Context.Done()
+		gateway.Shutdown(time.Second * time.Duration(config.ShutdownGrace))
+	})
+
+	if config.AdminAddr != "" {
+		admin := lib.Must(lib.NewFiber(AdminRoutes(gateway.proxy, config.AdminAddr, config.AdminToken, logger)))
+
+		lib.AppScope.Go(func() {
+			if err := admin.Start(lib.AppScope.Context, config.AdminAddr, time.Second*5); err != nil {
+				logger.Err().Value("error", err.Error()).Msg("admin listener stopped")
+			}
+		})
+	}
+
 	lib.AppScope.Done(false)
 }
 
-func StartListener(ctx context.Context, listener net.Listener, tlsConfig *tls.Config, dialer *net.Dialer) error {
+func StartListener(ctx context.Context, listener net.Listener, gateway *Gateway) error {
 	for !lib.IsDone(ctx) {
 		conn, err := listener.Accept()
 
@@ -78,8 +109,59 @@ func StartListener(ctx context.Context, listener net.Listener, tlsConfig *tls.Co
 
 			return err
 		}
-		go HandleProxy(conn, tlsConfig, dialer)
+		go gateway.HandleConnection(conn)
 	}
 
+	listener.Close()
+	gateway.logger.Info().Value("addr", listener.Addr().String()).Msg("stopped accepting connections")
 	return nil
 }
+
+// SaveAccounts persists client traffic counters periodically, and once more on exit
+func SaveAccounts(ctx context.Context, accounts *Accounts, logger lib.Logger) {
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := accounts.Save(); err != nil {
+				logger.Err().Value("error", err.Error()).Msg("failed to save client accounts")
+			}
+		case <-ctx.Done():
+			if err := accounts.Close(); err != nil {
+				logger.Err().Value("error", err.Error()).Msg("failed to save client accounts")
+			}
+			return
+		}
+	}
+}
+
+// WatchTls reloads certificates on SIGHUP, or when their files change
+func WatchTls(ctx context.Context, gateway *Gateway, logger lib.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			if !gateway.TlsChanged() {
+				continue
+			}
+		case <-ctx.Done():
+			return
+		}
+
+		if err := gateway.ReloadTls(); err != nil {
+			logger.Err().Value("error", err.Error()).Msg("failed to reload certificates")
+			continue
+		}
+
+		logger.Info().Msg("reloaded certificates")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"lib"
+	"lib/codec"
+	"lib/http1"
+	"lib/metrics"
+
+	fiber "github.com/gofiber/fiber/v2"
+)
+
+var registry = metrics.NewRegistry()
+
+var (
+	tunnelsActive = metrics.NewGauge(registry, "smp_server_tunnels_active",
+		"Multiplexed tunnel connections of forwarders.", "protocol")
+	streamsActive = metrics.NewGauge(registry, "smp_server_streams_active",
+		"Tunnel streams being served.")
+	streamsTotal = metrics.NewCounter(registry, "smp_server_streams_total",
+		"Tunnel streams by outcome: ok or the Proxy-Status error type.", "outcome")
+	dialSeconds = metrics.NewHistogram(registry, "smp_server_dial_seconds",
+		"Time to reach destinations.", metrics.DefBuckets, "network")
+	tlsFailures = metrics.NewCounter(registry, "smp_server_tls_handshake_failures_total",
+		"Failed TLS handshakes by reason.", "reason")
+)
+
+var bufPool = lib.NewBufferPool(32 * 1024)
+
+func init() {
+	metrics.NewCounterFunc(registry, "smp_server_tunnel_received_wire_bytes_total",
+		"Bytes received from forwarders, before decompression.", func() float64 { return float64(codec.Totals.WireRead.Load()) })
+	metrics.NewCounterFunc(registry, "smp_server_tunnel_received_bytes_total",
+		"Bytes received from forwarders, after decompression.", func() float64 { return float64(codec.Totals.RawRead.Load()) })
+	metrics.NewCounterFunc(registry, "smp_server_tunnel_sent_bytes_total",
+		"Bytes sent to forwarders, before compression.", func() float64 { return float64(codec.Totals.RawWritten.Load()) })
+	metrics.NewCounterFunc(registry, "smp_server_tunnel_sent_wire_bytes_total",
+		"Bytes sent to forwarders, after compression.", func() float64 { return float64(codec.Totals.WireWritten.Load()) })
+
+	metrics.NewCounterFunc(registry, "smp_server_buffers_allocated_total",
+		"Copy buffers allocated by the pool.", func() float64 { return float64(bufPool.Allocated()) })
+	metrics.NewGaugeFunc(registry, "smp_server_buffers_in_use",
+		"Copy buffers taken from the pool.", func() float64 { return float64(bufPool.InUse()) })
+
+	metrics.RegisterRuntime(registry)
+}
+
+// countStream counts a stream by the outcome of reaching its destination
+func countStream(status *http1.ProxyStatus) {
+	outcome := "ok"
+	if status != nil {
+		outcome = status.ErrorType
+	}
+
+	streamsTotal.With(outcome).Inc()
+}
+
+// tlsFailureReason tells revoked client certificates apart from other failures
+func tlsFailureReason(err error) string {
+	if errors.Is(err, ErrCertificateRevoked) {
+		return "revoked"
+	}
+	if errors.Is(err, ErrNoTunnelCertificate) || errors.Is(err, ErrNoClientCA) {
+		return "server_name"
+	}
+	return lib.TlsFailureReason(err)
+}
+
+// ServeMetrics renders the registry in the Prometheus text format
+func ServeMetrics(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, metrics.ContentType)
+	return registry.Write(c)
+}
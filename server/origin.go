@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"lib"
+	"lib/codec"
+	"net"
+	"time"
+)
+
+// originSessions resumes TLS sessions with destinations of handshake.MethodTls requests
+var originSessions = tls.NewLRUClientSessionCache(1024)
+
+// CopyToCodec copies src to dst flushing every read, and passes the half-close on
+func CopyToCodec(dst *codec.Conn, src io.Reader, signal chan error) {
+	if _, err := codec.Copy(dst, src); err != nil {
+		signal <- err
+		return
+	}
+
+	if err := dst.CloseWrite(); err != nil {
+		signal <- err
+		return
+	}
+
+	close(signal)
+}
+
+// SpliceTls relays a handshake.MethodTls request, of a forwarder that terminated the TLS of its client:
+// the plaintext travels through the tunnel, where it compresses, and TLS is spoken with the destination here.
+// The certificate of the destination is verified against the system roots. It returns why timeouts cut the stream.
+func SpliceTls(conn *codec.Conn, addr string, dialer ContextDialer, timeouts lib.Timeouts, reply func(net.Conn, error) error, b []byte) error {
+	defer conn.Close()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		reply(nil, err)
+		return nil
+	}
+
+	dialContext, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	remote, err := dialer.DialContext(dialContext, "tcp", addr)
+	if err != nil {
+		reply(nil, err)
+		return nil
+	}
+
+	defer remote.Close()
+
+	origin := tls.Client(remote, &tls.Config{
+		ServerName: host,
+		// the forwarder only offers its client HTTP/1.1
+		NextProtos:         []string{"http/1.1"},
+		ClientSessionCache: originSessions,
+	})
+
+	if err := origin.HandshakeContext(dialContext); err != nil {
+		reply(nil, err)
+		return nil
+	}
+
+	if err := reply(remote, nil); err != nil {
+		return nil
+	}
+
+	watchdog := lib.NewWatchdog(timeouts, func(error) {
+		conn.Conn.Close()
+		remote.Close()
+	})
+
+	// buffered, so the copy still running after return does not block forever on its signal
+	upstream := make(chan error, 1)
+	downstream := make(chan error, 1)
+
+	signals := []chan error{upstream, downstream}
+
+	go Copy(origin, watchdog.Reader(conn), upstream, b)
+	go CopyToCodec(conn, watchdog.Reader(origin), downstream)
+
+	for len(signals) > 0 {
+		i, _, failed := Select(signals)
+
+		if failed {
+			break
+		}
+
+		signals = append(signals[:i], signals[i+1:]...)
+	}
+
+	return watchdog.Stop()
+}
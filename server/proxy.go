@@ -3,129 +3,39 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
 	"errors"
 	"io"
 	"lib"
+	"lib/codec"
+	"lib/handshake"
+	"lib/http1"
+	"lib/mux"
 	"net"
+	"net/http"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/andybalholm/brotli"
 )
 
-type HttpRequest struct {
-	Method  string
-	Url     string
-	Version string
-	Headers map[string]string
-}
-
-type HttpResponse struct {
-	StatusCode int
-	Reason     string
-	Version    string
-	Headers    map[string]string
+// buffered takes what r has read ahead
+func buffered(r *bufio.Reader) []byte {
+	b, _ := r.Peek(r.Buffered())
+	ret := append([]byte{}, b...)
+	r.Discard(len(b))
+	return ret
 }
 
-var MaxHeadersSupported = 100
-var ErrHttpMalformedHeader = errors.New("malformed HTTP Header")
-var ErrExceedingHeaderCount = errors.New("exceeding max number of HTTP headers")
-
-func parseHttp(r *bufio.Reader, parseStartLine func(string) error) (headers map[string]string, err error) {
-	var b []byte
-
-	startLine := true
-	headers = map[string]string{}
-
-	for {
-		b, err = r.ReadSlice('\n')
-		if err != nil {
-			return
-		}
-
-		l := len(b)
-
-		if b[l-2] != '\r' {
-			err = ErrHttpMalformedHeader
-			return
-		}
-
-		b = b[:l-2]
-
-		bs := string(b)
-
-		if startLine {
-			if err = parseStartLine(bs); err != nil {
-				return
-			}
-
-			startLine = false
-			continue
-		}
-
-		if len(b) == 0 {
-			// HTTP header parse complete
-			break
-		}
-
-		s := strings.Split(bs, ": ")
-		if len(s) != 2 {
-			err = ErrHttpMalformedHeader
-			return
-		}
-		headers[strings.ToLower(s[0])] = s[1]
-
-		if len(headers) > MaxHeadersSupported {
-			err = ErrExceedingHeaderCount
-			return
-		}
-	}
-	return
-}
-
-func ParseHttpRequest(r io.Reader) (ret HttpRequest, remainingBytes []byte, err error) {
-	ret = HttpRequest{}
-
-	bufReader := bufio.NewReader(r)
-	ret.Headers, err = parseHttp(bufReader, func(s string) error {
-		ss := strings.Split(s, " ")
-		if len(ss) != 3 {
-			return ErrHttpMalformedHeader
-		}
-
-		ret.Method = ss[0]
-		ret.Url = ss[1]
-		ret.Version = ss[2]
-
-		if len(ret.Method) == 0 || len(ret.Url) == 0 || !strings.HasPrefix(ret.Version, "HTTP/") {
-			return ErrHttpMalformedHeader
-		}
-		return nil
-	})
-
-	l, n, buffered := 0, 0, bufReader.Buffered()
-	remainingBytes = make([]byte, buffered)
+// ProxyName identifies the server in the Proxy-Status of error replies
+const ProxyName = "smp-server"
 
-	for {
-		if l >= buffered {
-			break
-		}
+// TunnelProtocol is negotiated with ALPN by forwarders that multiplex streams over the connection,
+// and negotiate codecs for each stream
+const TunnelProtocol = "smp/2"
 
-		n, err = bufReader.Read(remainingBytes[l:])
-		if err != nil {
-			return
-		}
-		l += n
-
-	}
-
-	return
-}
-
-var okResponse []byte = []byte("HTTP/1.1 200 OK\r\n\r\n")
+// LegacyTunnelProtocol multiplexes streams compressed with brotli
+const LegacyTunnelProtocol = "smp/1"
 
 func Copy(dst io.Writer, src io.Reader, signal chan error, initialData ...[]byte) {
 	for _, d := range initialData {
@@ -144,29 +54,18 @@ func Copy(dst io.Writer, src io.Reader, signal chan error, initialData ...[]byte
 		return
 	}
 
-	close(signal)
-}
-
-var bufPool = sync.Pool{
-	New: func() any {
-		return make([]byte, 32*1024)
-	},
-}
-
-var cwp = sync.Pool{
-	New: func() any {
-		return brotli.NewWriter(nil)
-	},
-}
+	// the other direction may still be sending
+	if err := lib.CloseWrite(dst); err != nil {
+		signal <- err
+		return
+	}
 
-var crp = sync.Pool{
-	New: func() any {
-		return brotli.NewReader(nil)
-	},
+	close(signal)
 }
 
-func CopyFromRaw(dst *brotli.Writer, src *lib.Socket, signal chan error) {
-	buf := bufPool.Get().([]byte)
+// CopyFromRaw compresses what src reads into dst, flushing whenever src has nothing more to read right away
+func CopyFromRaw(dst *codec.Conn, src *lib.Socket, watchdog *lib.Watchdog, signal chan error) {
+	buf := bufPool.Get()
 	blockRead := false
 	writtenSinceFlush := 0
 
@@ -181,6 +80,7 @@ func CopyFromRaw(dst *brotli.Writer, src *lib.Socket, signal chan error) {
 		}
 
 		if nr > 0 {
+			watchdog.Touch()
 			nw, ew := dst.Write(buf[0:nr])
 
 			if nw < 0 || nr < nw {
@@ -214,6 +114,11 @@ func CopyFromRaw(dst *brotli.Writer, src *lib.Socket, signal chan error) {
 				return
 			}
 
+			if err := dst.CloseWrite(); err != nil {
+				signal <- err
+				return
+			}
+
 			close(signal)
 			return
 		}
@@ -250,86 +155,291 @@ func Select[T any](chans []chan T) (index int, value T, ok bool) {
 	return
 }
 
-func Splice(conn net.Conn, cr *brotli.Reader, cw *brotli.Writer, addr string, dialer *net.Dialer, startCopy chan error, b []byte) {
-	defer func() {
-		defer recover()
-		cw.Close()
-		conn.Close()
-		cwp.Put(cw)
-		crp.Put(cr)
-	}()
+type ContextDialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// Splice dials addr, and relays conn to it once reply has told the forwarder the outcome of the dial.
+// Either side closing its write half is passed on to the other, the stream ends once both have, or on the first error.
+// It returns why timeouts cut the stream, if they did.
+func Splice(conn *codec.Conn, addr string, dialer ContextDialer, timeouts lib.Timeouts, reply func(net.Conn, error) error, b []byte) error {
+	defer conn.Close()
 
 	// TODO: make it configurable
-	// TODO: check if the connection is alive
 	dialContext, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	remote, err := dialer.DialContext(dialContext, "tcp", addr)
 	cancel()
 
 	if err != nil {
-		return
+		reply(nil, err)
+		return nil
 	}
 
 	defer remote.Close()
 	raw, err := lib.NewSocket(remote.(*net.TCPConn))
 	if err != nil {
-		return
+		reply(nil, err)
+		return nil
+	}
+
+	if err := reply(remote, nil); err != nil {
+		return nil
 	}
 
-	upstream := make(chan error)
-	downstream := make(chan error)
+	watchdog := lib.NewWatchdog(timeouts, func(error) {
+		// unblocks both copies, without waiting on the locks of conn
+		conn.Conn.Close()
+		remote.Close()
+	})
+
+	// buffered, so the copy still running after return does not block forever on its signal
+	upstream := make(chan error, 1)
+	downstream := make(chan error, 1)
 
 	signals := []chan error{upstream, downstream}
 
-	go Copy(remote, cr, upstream, b)
+	go Copy(remote, watchdog.Reader(conn), upstream, b)
+	go CopyFromRaw(conn, raw, watchdog, downstream)
 
-	if _, ok := <-startCopy; ok {
-		return
+	for len(signals) > 0 {
+		i, _, failed := Select(signals)
+
+		if failed {
+			break
+		}
+
+		signals = append(signals[:i], signals[i+1:]...)
 	}
 
-	go CopyFromRaw(cw, raw, downstream)
+	return watchdog.Stop()
+}
 
-	for len(signals) > 0 {
-		i, _, ok := Select(signals)
+// Proxy serves tunnel requests, dialing destinations allowed by the acl
+type Proxy struct {
+	dialer *net.Dialer
+	// codecs the proxy compresses replies with, if the client offers them
+	codecs      []codec.ID
+	timeouts    lib.Timeouts
+	acl         *Acl
+	accounts    *Accounts
+	connections *Connections
+	// mux sessions of forwarders, told to go away on shutdown
+	sessions sync.Map
+	logger   lib.Logger
+}
 
-		if ok {
-			signals = append(signals[:i], signals[i+1:]...)
-			continue
+func NewProxy(config ProxyConfig, dialer *net.Dialer, logger lib.Logger) (*Proxy, error) {
+	aclConfig := DefaultAclConfig
+	if config.Acl != nil {
+		aclConfig = *config.Acl
+	}
+
+	acl, err := NewAcl(aclConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, err := NewAccounts(config, config.QuotaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	codecs := DefaultCodecs
+	if config.Codecs != nil {
+		if codecs, err = codec.ParseList(strings.Join(config.Codecs, ",")); err != nil {
+			return nil, err
 		}
+	}
+
+	return &Proxy{
+		dialer:      dialer,
+		codecs:      codecs,
+		timeouts:    config.Timeouts,
+		acl:         acl,
+		accounts:    accounts,
+		connections: NewConnections(),
+		logger:      logger,
+	}, nil
+}
+
+// DefaultCodecs are all codecs a forwarder may ask for
+var DefaultCodecs = []codec.ID{codec.Brotli, codec.Zstd, codec.Identity, codec.Brotli | codec.Adaptive, codec.Zstd | codec.Adaptive}
 
+// HandleProxy serves a single tunnel request. Streams of TunnelProtocol start with codec negotiation, others are brotli.
+func (p *Proxy) HandleProxy(tlsConn net.Conn, client *ClientIdentity, protocol string) {
+	streamsActive.With().Inc()
+	defer streamsActive.With().Dec()
+
+	entry, counted, err := p.connections.Add(tlsConn, client)
+	if err != nil {
+		p.refuse(tlsConn, protocol, err)
 		return
 	}
-}
+	defer p.connections.Remove(entry)
+
+	account := p.accounts.Get(client)
+	if err := account.Acquire(); err != nil {
+		p.logger.Warn().Value("client", client.Name).Value("remote", client.Addr).Value("error", err.Error()).Msg("stream refused")
+		p.refuse(counted, protocol, err)
+		return
+	}
+
+	tlsConn = account.Wrap(counted)
 
-func HandleProxy(conn net.Conn, config *tls.Config, dialer *net.Dialer) {
-	tlsConn := tls.Server(conn, config)
+	var conn *codec.Conn
 
-	cr := crp.Get().(*brotli.Reader)
-	if cr.Reset(tlsConn) != nil {
+	if protocol == TunnelProtocol {
+		conn, err = codec.Server(tlsConn, p.codecs)
+	} else {
+		conn, err = codec.Legacy(tlsConn)
+	}
+
+	if err != nil {
 		tlsConn.Close()
-		crp.Put(cr)
 		return
 	}
 
-	req, b, err := ParseHttpRequest(cr)
+	br := bufio.NewReader(conn)
+	req, err := handshake.ReadRequest(br)
 
 	if err != nil {
-		tlsConn.Close()
-		crp.Put(cr)
+		countStream(&http1.ProxyStatus{ErrorType: http1.HttpRequestError})
+
+		if res := http1.Reject(err); res != nil {
+			conn.Write(res)
+			conn.Flush()
+		}
+		conn.Close()
 		return
 	}
 
-	cw := cwp.Get().(*brotli.Writer)
-	cw.Reset(tlsConn)
+	b := buffered(br)
+	entry.SetRequest(req)
+
+	dialer := aclDialer{proxy: p, client: client}
+	start := time.Now()
+
+	reply := func(remote net.Conn, err error) error {
+		if err != nil {
+			countStream(dialStatus(err))
+			p.logger.Info().Value("client", client.Name).Value("url", req.Addr).Value("error", err.Error()).Msg("failed to connect to peer")
+		} else {
+			entry.SetRemote(remote)
+			countStream(nil)
+			dialSeconds.With(remote.RemoteAddr().Network()).Observe(time.Since(start).Seconds())
+		}
+		return p.reply(conn, req.Version, remote, time.Since(start), err)
+	}
+
+	switch req.Method {
+	case handshake.MethodUdp:
+		err = SpliceUdp(conn, req.Addr, dialer, p.timeouts, reply, b)
+	case handshake.MethodTls:
+		err = SpliceTls(conn, req.Addr, dialer, p.timeouts, reply, b)
+	default:
+		err = Splice(conn, req.Addr, dialer, p.timeouts, reply, b)
+	}
 
-	startCopy := make(chan error, 1)
+	if err != nil {
+		p.logger.Info().Value("client", client.Name).Value("url", req.Addr).Value("error", err.Error()).Msg("closed stream")
+	}
+}
 
-	go Splice(tlsConn, cr, cw, req.Url, dialer, startCopy, b)
-	if _, err := cw.Write(okResponse); err != nil {
-		cw.Close()
-		cwp.Put(cw)
-		startCopy <- err
+// dialStatus tells the forwarder why the destination could not be reached
+func dialStatus(err error) *http1.ProxyStatus {
+	if errors.Is(err, ErrDestinationDenied) {
+		return &http1.ProxyStatus{
+			Proxy:      ProxyName,
+			StatusCode: http.StatusForbidden,
+			ErrorType:  http1.DestinationIpProhibited,
+			Details:    err.Error(),
+		}
 	}
 
-	close(startCopy)
+	return http1.DialStatus(ProxyName, err)
+}
+
+// reply tells the forwarder the outcome of the dial, in the handshake version it asked for. It is flushed right away,
+// forwarders wait for it before failing over to another server. Legacy streams of forwarders predating versions
+// only understand success, and are closed on failure.
+func (p *Proxy) reply(conn *codec.Conn, version int, remote net.Conn, dialTime time.Duration, err error) error {
+	ret := handshake.Reply{Version: min(version, handshake.Version)}
 
+	if err != nil {
+		if !conn.Negotiated() && version == 0 {
+			return err
+		}
+		ret.Status = dialStatus(err)
+	} else if ret.Version > 0 {
+		ret.Peer = remote.RemoteAddr().String()
+		ret.Meta = http1.Headers{{Name: "Dial-Time", Value: strconv.FormatInt(dialTime.Milliseconds(), 10)}}
+	}
+
+	if _, e := conn.Write(ret.Bytes()); e != nil {
+		return e
+	}
+
+	if e := conn.Flush(); e != nil {
+		return e
+	}
+
+	return err
+}
+
+// refuse tells forwarders negotiating codecs that the stream is over the limits of the client, or that the server
+// is draining, so they may try another server
+func (p *Proxy) refuse(tlsConn net.Conn, protocol string, err error) {
+	defer tlsConn.Close()
+
+	if protocol != TunnelProtocol {
+		return
+	}
+
+	conn, e := codec.Server(tlsConn, p.codecs)
+	if e != nil {
+		return
+	}
+	defer conn.Close()
+
+	status := &http1.ProxyStatus{
+		Proxy:      ProxyName,
+		StatusCode: http.StatusServiceUnavailable,
+		ErrorType:  http1.ConnectionLimitReached,
+		Details:    err.Error(),
+	}
+	countStream(status)
+
+	conn.Write(status.Response())
+	conn.Flush()
+}
+
+// GoAway tells forwarders to open new streams elsewhere, and returns the number of sessions told.
+// Forwarders predating it ignore it, and find new streams refused while draining.
+func (p *Proxy) GoAway() int {
+	n := 0
+	p.sessions.Range(func(key, value any) bool {
+		if key.(*mux.Session).GoAway() == nil {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// HandleSession serves each stream of a multiplexed tunnel connection as a separate proxy request
+func (p *Proxy) HandleSession(conn net.Conn, client *ClientIdentity, protocol string) {
+	session := mux.Server(conn)
+	defer session.Close()
+
+	p.sessions.Store(session, client)
+	defer p.sessions.Delete(session)
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+
+		go p.HandleProxy(stream, client, protocol)
+	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"lib"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicProtocol labels tunnels over QUIC in metrics
+const quicProtocol = "quic"
+
+// quicConfig of tunnels over QUIC: resumed sessions may open streams in 0-RTT, and each stream is one proxied connection
+var quicConfig = &quic.Config{
+	Allow0RTT:          true,
+	MaxIncomingStreams: 4096,
+	MaxIdleTimeout:     time.Minute,
+}
+
+// quicTunnel closes a QUIC connection kept in Gateway.tunnels, with all its streams
+type quicTunnel struct {
+	*quic.Conn
+}
+
+func (t quicTunnel) Close() error {
+	return t.CloseWithError(lib.QuicNoError, "")
+}
+
+// ServeQuic serves tunnels over QUIC on conn until ctx is done. Clients authenticate with the certificates of the
+// TLS tunnel, and only the multiplexed tunnel protocol is spoken, one stream per proxied connection.
+func (g *Gateway) ServeQuic(ctx context.Context, conn net.PacketConn) error {
+	// tunnels outlive the listener, to drain on shutdown
+	transport := &quic.Transport{Conn: conn}
+	listener, err := transport.ListenEarly(&tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			// web routes are not served over QUIC
+			return g.store.Load().GetProxyConfig(hello)
+		},
+	}, quicConfig)
+	if err != nil {
+		return err
+	}
+
+	defer listener.Close()
+
+	for {
+		qc, err := listener.Accept(ctx)
+		if err != nil {
+			if lib.IsDone(ctx) {
+				g.logger.Info().Value("addr", conn.LocalAddr().String()).Msg("stopped accepting quic connections")
+				return nil
+			}
+			return err
+		}
+
+		go g.handleQuic(qc)
+	}
+}
+
+func (g *Gateway) handleQuic(conn *quic.Conn) {
+	// without 0-RTT the client certificate is only verified once the handshake completes
+	if !conn.ConnectionState().Used0RTT {
+		select {
+		case <-conn.HandshakeComplete():
+		case <-conn.Context().Done():
+			g.logger.Debug().Value("remote", conn.RemoteAddr().String()).Value("error", context.Cause(conn.Context()).Error()).Msg("quic handshake failed")
+			return
+		}
+	}
+
+	client := NewClientIdentity(conn.ConnectionState().TLS, conn.RemoteAddr())
+	tunnel := quicTunnel{conn}
+
+	g.tunnels.Store(tunnel, client)
+	tunnelsActive.With(quicProtocol).Inc()
+	defer func() {
+		tunnelsActive.With(quicProtocol).Dec()
+		g.tunnels.Delete(tunnel)
+	}()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go g.proxy.HandleProxy(lib.NewQuicStream(stream, conn), client, TunnelProtocol)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"lib"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrTooManyStreams = errors.New("too many concurrent streams")
+var ErrQuotaExceeded = errors.New("traffic quota exceeded")
+
+// Zero means unlimited. Bytes are counted, and rates applied, on the tunnel side of streams: compressed, as they go
+// over the wire.
+type ClientLimits struct {
+	MaxStreams int `json:"maxStreams"`
+	// bandwidth cap in each direction, bytes per second
+	Rate  int64 `json:"rate"`
+	Burst int64 `json:"burst"`
+	// total bytes up and down, over the lifetime of the quota file, or of the process without one. There is no
+	// reset period.
+	MaxBytes int64 `json:"maxBytes"`
+}
+
+const quotaFileSize = 1 << 20
+const quotaJournalSize = 16384
+const quotaCapacity = 4096
+
+// journal keys are prefixed, as clients without a certificate have an empty name
+const quotaKeyPrefix = "client:"
+
+// ClientAccount tracks the traffic of all tunnels of one client identity
+type ClientAccount struct {
+	Name     string
+	limits   ClientLimits
+	up       atomic.Int64
+	down     atomic.Int64
+	streams  atomic.Int32
+	upRate   *lib.TokenBucket
+	downRate *lib.TokenBucket
+}
+
+func (c *ClientAccount) Up() int64 {
+	return c.up.Load()
+}
+
+func (c *ClientAccount) Down() int64 {
+	return c.down.Load()
+}
+
+func (c *ClientAccount) Streams() int {
+	return int(c.streams.Load())
+}
+
+// Acquire reserves a stream. The stream is released when the conn returned by Wrap is closed.
+func (c *ClientAccount) Acquire() error {
+	if c.remaining() == 0 {
+		return ErrQuotaExceeded
+	}
+
+	if n := c.streams.Add(1); c.limits.MaxStreams > 0 && int(n) > c.limits.MaxStreams {
+		c.streams.Add(-1)
+		return ErrTooManyStreams
+	}
+
+	return nil
+}
+
+// remaining is the number of bytes the client may still transfer, -1 if unlimited
+func (c *ClientAccount) remaining() int64 {
+	if c.limits.MaxBytes <= 0 {
+		return -1
+	}
+
+	return max(c.limits.MaxBytes-c.Up()-c.Down(), 0)
+}
+
+func (c *ClientAccount) Wrap(conn net.Conn) net.Conn {
+	return &meteredConn{Conn: conn, account: c}
+}
+
+// meteredConn counts and rate limits the tunnel side of a stream, and cuts it once the quota is used up
+type meteredConn struct {
+	net.Conn
+	account   *ClientAccount
+	closeOnce sync.Once
+}
+
+func (c *meteredConn) Read(b []byte) (n int, err error) {
+	rem := c.account.remaining()
+	if rem == 0 {
+		c.Close()
+		return 0, ErrQuotaExceeded
+	}
+
+	if rem > 0 && int64(len(b)) > rem {
+		b = b[:rem]
+	}
+
+	n, err = c.Conn.Read(b)
+
+	if n > 0 {
+		c.account.up.Add(int64(n))
+
+		if c.account.upRate != nil {
+			c.account.upRate.Wait(n)
+		}
+	}
+
+	return
+}
+
+func (c *meteredConn) Write(b []byte) (n int, err error) {
+	over := false
+	if rem := c.account.remaining(); rem >= 0 && int64(len(b)) > rem {
+		b, over = b[:rem], true
+	}
+
+	if len(b) > 0 {
+		if c.account.downRate != nil {
+			c.account.downRate.Wait(len(b))
+		}
+
+		n, err = c.Conn.Write(b)
+		c.account.down.Add(int64(n))
+	}
+
+	if over && err == nil {
+		c.Close()
+		err = ErrQuotaExceeded
+	}
+
+	return
+}
+
+func (c *meteredConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.account.streams.Add(-1)
+	})
+
+	return c.Conn.Close()
+}
+
+func (c *meteredConn) CloseWrite() error {
+	return lib.CloseWrite(c.Conn)
+}
+
+// Accounts keeps per client accounts, persisting traffic counters to a journal on a mmap file
+type Accounts struct {
+	lock     sync.Mutex
+	limits   ClientLimits
+	clients  map[string]ClientLimits
+	accounts map[string]*ClientAccount
+	file     *lib.MmapFile
+	journal  lib.Journal
+}
+
+// NewAccounts loads traffic counters from file, or keeps them in memory only if file is empty
+func NewAccounts(config ProxyConfig, file string) (ret *Accounts, err error) {
+	ret = &Accounts{
+		limits:   config.Limits,
+		clients:  config.Clients,
+		accounts: map[string]*ClientAccount{},
+	}
+
+	if file == "" {
+		return
+	}
+
+	ret.file = &lib.MmapFile{}
+	if err = ret.file.Init(quotaFileSize, file); err != nil {
+		return nil, err
+	}
+
+	headerSize := ret.journal.Init(ret.file.Data, quotaJournalSize, quotaCapacity)
+	ret.journal.SetData(ret.file.Data[headerSize:])
+
+	iter := ret.journal.Iter()
+	for {
+		ok, key, value := iter.Next()
+		if !ok {
+			break
+		}
+
+		if len(value) != 16 || !strings.HasPrefix(key, quotaKeyPrefix) {
+			continue
+		}
+
+		account := ret.newAccount(strings.Clone(key[len(quotaKeyPrefix):]))
+		account.up.Store(int64(binary.LittleEndian.Uint64(value)))
+		account.down.Store(int64(binary.LittleEndian.Uint64(value[8:])))
+		ret.accounts[account.Name] = account
+	}
+
+	return
+}
+
+func (a *Accounts) newAccount(name string) *ClientAccount {
+	limits, ok := a.clients[name]
+	if !ok {
+		limits = a.limits
+	}
+
+	ret := &ClientAccount{
+		Name:   name,
+		limits: limits,
+	}
+
+	if limits.Rate > 0 {
+		ret.upRate = lib.NewTokenBucket(limits.Rate, limits.Burst)
+		ret.downRate = lib.NewTokenBucket(limits.Rate, limits.Burst)
+	}
+
+	return ret
+}
+
+// Get returns the account of the client, creating it on first use. Clients without a certificate share one account.
+func (a *Accounts) Get(client *ClientIdentity) *ClientAccount {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ret, ok := a.accounts[client.Name]
+	if !ok {
+		ret = a.newAccount(client.Name)
+		a.accounts[client.Name] = ret
+	}
+
+	return ret
+}
+
+func (a *Accounts) List() []*ClientAccount {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	ret := make([]*ClientAccount, 0, len(a.accounts))
+	for _, v := range a.accounts {
+		ret = append(ret, v)
+	}
+
+	return ret
+}
+
+// Save writes traffic counters to the journal
+func (a *Accounts) Save() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.save()
+}
+
+func (a *Accounts) save() error {
+	if a.file == nil {
+		return nil
+	}
+
+	value := make([]byte, 16)
+
+	for name, account := range a.accounts {
+		binary.LittleEndian.PutUint64(value, uint64(account.Up()))
+		binary.LittleEndian.PutUint64(value[8:], uint64(account.Down()))
+
+		if err := a.journal.Set(quotaKeyPrefix+name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (a *Accounts) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.save()
+
+	if e := a.file.Close(); err == nil {
+		err = e
+	}
+	a.file = nil
+
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"lib/assert"
+	"net"
+	"path"
+	"testing"
+)
+
+func TestClientAccount_MaxBytes(t *testing.T) {
+	accounts, err := NewAccounts(ProxyConfig{Limits: ClientLimits{MaxBytes: 10}}, "")
+	assert.Null(t, err)
+
+	account := accounts.Get(&ClientIdentity{Name: "client"})
+	assert.Null(t, account.Acquire())
+
+	tunnel, remote := net.Pipe()
+	defer remote.Close()
+	conn := account.Wrap(tunnel)
+
+	go remote.Write([]byte("upload"))
+
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	assert.Null(t, err)
+	assert.Equal(t, "upload", string(buf[:n]))
+
+	read := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(remote)
+		read <- string(b)
+	}()
+
+	// cut in the middle of a write, the stream closed
+	n, err = conn.Write([]byte("download"))
+	assert.Equal(t, ErrQuotaExceeded, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, "down", <-read)
+
+	assert.Equal(t, int64(6), account.Up())
+	assert.Equal(t, int64(4), account.Down())
+	assert.Equal(t, 0, account.Streams())
+
+	_, err = conn.Read(buf)
+	assert.Equal(t, ErrQuotaExceeded, err)
+	assert.Equal(t, ErrQuotaExceeded, account.Acquire())
+
+	// other clients have their own quota
+	assert.Null(t, accounts.Get(&ClientIdentity{Name: "other"}).Acquire())
+}
+
+func TestClientAccount_MaxStreams(t *testing.T) {
+	accounts, err := NewAccounts(ProxyConfig{
+		Limits:  ClientLimits{MaxStreams: 1},
+		Clients: map[string]ClientLimits{"vip": {}},
+	}, "")
+	assert.Null(t, err)
+
+	account := accounts.Get(&ClientIdentity{Name: "client"})
+	assert.Null(t, account.Acquire())
+	assert.Equal(t, ErrTooManyStreams, account.Acquire())
+
+	tunnel, remote := net.Pipe()
+	defer remote.Close()
+	account.Wrap(tunnel).Close()
+	assert.Null(t, account.Acquire())
+
+	vip := accounts.Get(&ClientIdentity{Name: "vip"})
+	for range 3 {
+		assert.Null(t, vip.Acquire())
+	}
+}
+
+func TestAccounts_Journal(t *testing.T) {
+	file := path.Join(t.TempDir(), "quota")
+
+	accounts, err := NewAccounts(ProxyConfig{}, file)
+	assert.Null(t, err)
+
+	// clients without a certificate have an empty name
+	anonymous := accounts.Get(&ClientIdentity{})
+	anonymous.up.Add(100)
+	anonymous.down.Add(200)
+
+	client := accounts.Get(&ClientIdentity{Name: "client"})
+	client.up.Add(1 << 40)
+
+	assert.Null(t, accounts.Save())
+	client.down.Add(5)
+	assert.Null(t, accounts.Close())
+
+	accounts, err = NewAccounts(ProxyConfig{}, file)
+	assert.Null(t, err)
+	defer accounts.Close()
+
+	assert.Equal(t, 2, len(accounts.List()))
+
+	anonymous = accounts.Get(&ClientIdentity{})
+	assert.Equal(t, int64(100), anonymous.Up())
+	assert.Equal(t, int64(200), anonymous.Down())
+
+	client = accounts.Get(&ClientIdentity{Name: "client"})
+	assert.Equal(t, int64(1<<40), client.Up())
+	assert.Equal(t, int64(5), client.Down())
+}
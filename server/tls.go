@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var ErrNoCertificate = errors.New("no certificate configured")
+var ErrCertificateRevoked = errors.New("certificate revoked")
+var ErrCrlSignature = errors.New("crl is not signed by the CA")
+var ErrInvalidSerial = errors.New("invalid certificate serial in deny list")
+var ErrNoTunnelCertificate = errors.New("no tunnel certificate for the server name")
+var ErrNoClientCA = errors.New("no client CA for the tunnel certificate")
+
+// TlsStore is immutable once loaded. Reloading builds a new store to swap in.
+type TlsStore struct {
+	certs        []*tls.Certificate
+	proxyConfigs []*tls.Config
+	// revoked client certificates by revocationKey
+	revoked  map[string]struct{}
+	modTimes map[string]time.Time
+}
+
+// revocationKey identifies a certificate by its issuer and serial, as serials are only unique to a CA
+func revocationKey(issuer []byte, serial *big.Int) string {
+	return string(issuer) + "/" + serial.Text(16)
+}
+
+func parseSerial(s string) (*big.Int, bool) {
+	s = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	s = strings.TrimPrefix(s, "0x")
+	return new(big.Int).SetString(s, 16)
+}
+
+func parseCerts(b []byte) (ret []*x509.Certificate) {
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			ret = append(ret, cert)
+		}
+	}
+}
+
+// loadCrl adds the certificates revoked by the CRL file, after checking it is signed by one of cas
+func loadCrl(file string, cas []*x509.Certificate, revoked map[string]struct{}) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	if block, _ := pem.Decode(b); block != nil {
+		b = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(b)
+	if err != nil {
+		return err
+	}
+
+	signed := false
+	for _, ca := range cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+
+	if !signed {
+		return ErrCrlSignature
+	}
+
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[revocationKey(crl.RawIssuer, entry.SerialNumber)] = struct{}{}
+	}
+
+	return nil
+}
+
+// loadDenyList adds the serials of the deny list file, of certificates issued by any of cas
+func loadDenyList(file string, cas []*x509.Certificate, revoked map[string]struct{}) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		serial, ok := parseSerial(line)
+		if !ok {
+			return ErrInvalidSerial
+		}
+
+		for _, ca := range cas {
+			revoked[revocationKey(ca.RawSubject, serial)] = struct{}{}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// NewTlsStore loads all key pairs from config. Key pairs with a CA require clients of the tunnel to present a certificate signed by it,
+// and not revoked by the CRL or deny list.
+func NewTlsStore(config []TlsConfig) (ret *TlsStore, err error) {
+	ret = &TlsStore{
+		revoked:  map[string]struct{}{},
+		modTimes: map[string]time.Time{},
+	}
+
+	for _, c := range config {
+		for _, f := range []string{c.Cert, c.Key, c.CA, c.Crl, c.DenyList} {
+			if f == "" {
+				continue
+			}
+
+			stat, e := os.Stat(f)
+			if e != nil {
+				return nil, e
+			}
+			ret.modTimes[f] = stat.ModTime()
+		}
+
+		cert, e := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if e != nil {
+			return nil, e
+		}
+
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, err
+			}
+		}
+
+		proxyConfig := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.NoClientCert,
+			MinVersion:   tls.VersionTLS13,
+			// HTTP/1.1 upgrades to a tunnel over WebSocket
+			NextProtos: []string{TunnelProtocol, LegacyTunnelProtocol, "http/1.1"},
+		}
+
+		if c.CA != "" {
+			caPem, e := os.ReadFile(c.CA)
+			if e != nil {
+				return nil, e
+			}
+
+			certPool := x509.NewCertPool()
+			certPool.AppendCertsFromPEM(caPem)
+
+			proxyConfig.ClientCAs = certPool
+			proxyConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			proxyConfig.VerifyConnection = ret.verifyConnection
+
+			cas := parseCerts(caPem)
+
+			if c.Crl != "" {
+				if err = loadCrl(c.Crl, cas, ret.revoked); err != nil {
+					return nil, err
+				}
+			}
+
+			if c.DenyList != "" {
+				if err = loadDenyList(c.DenyList, cas, ret.revoked); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		ret.certs = append(ret.certs, &cert)
+		ret.proxyConfigs = append(ret.proxyConfigs, proxyConfig)
+	}
+
+	if len(ret.certs) == 0 {
+		return nil, ErrNoCertificate
+	}
+
+	return
+}
+
+// Revoked checks the client certificate of chain against what its issuer revoked
+func (s *TlsStore) Revoked(chain []*x509.Certificate) bool {
+	if len(chain) == 0 {
+		return false
+	}
+
+	_, ok := s.revoked[revocationKey(chain[0].RawIssuer, chain[0].SerialNumber)]
+	return ok
+}
+
+// verifyConnection runs on resumed sessions too, unlike VerifyPeerCertificate
+func (s *TlsStore) verifyConnection(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		if s.Revoked(chain) {
+			return ErrCertificateRevoked
+		}
+	}
+
+	return nil
+}
+
+// Changed reports whether any file the store was loaded from has been modified since
+func (s *TlsStore) Changed() bool {
+	for f, t := range s.modTimes {
+		stat, err := os.Stat(f)
+		if err != nil || !stat.ModTime().Equal(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match finds the key pair for the SNI in hello, or -1.
+// Clients connecting to an IP address send no SNI, in which case the local address is matched against IP SANs.
+func (s *TlsStore) match(hello *tls.ClientHelloInfo) int {
+	if hello.ServerName != "" {
+		for i, cert := range s.certs {
+			if hello.SupportsCertificate(cert) == nil {
+				return i
+			}
+		}
+
+		return -1
+	}
+
+	if hello.Conn == nil {
+		return -1
+	}
+
+	var ip net.IP
+	switch addr := hello.Conn.LocalAddr().(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return -1
+	}
+
+	for i, cert := range s.certs {
+		for _, san := range cert.Leaf.IPAddresses {
+			if san.Equal(ip) {
+				return i
+			}
+		}
+	}
+
+	return -1
+}
+
+// GetCertificate serves the first key pair to web clients whose SNI matches none
+func (s *TlsStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.certs[max(s.match(hello), 0)], nil
+}
+
+// GetProxyConfig refuses tunnel handshakes unless a key pair matches, and it verifies client certificates
+func (s *TlsStore) GetProxyConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	i := s.match(hello)
+	if i < 0 {
+		return nil, ErrNoTunnelCertificate
+	}
+
+	if s.proxyConfigs[i].ClientAuth != tls.RequireAndVerifyClientCert {
+		return nil, ErrNoClientCA
+	}
+
+	return s.proxyConfigs[i], nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"lib/assert"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue makes a certificate of serial signed by issuer, or self-signed if issuer is nil. sans are DNS names or IP
+// addresses.
+func issue(t *testing.T, issuer *testIssuer, name string, serial int64, isCa bool, sans ...string) *testIssuer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Null(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCa,
+	}
+	if isCa {
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	assert.Null(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Null(t, err)
+
+	return &testIssuer{cert: cert, key: key}
+}
+
+// writeCrl writes the CRL of issuer revoking serials
+func writeCrl(t *testing.T, issuer *testIssuer, serials ...int64) string {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, s := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, issuer.cert, issuer.key)
+	assert.Null(t, err)
+
+	file := path.Join(t.TempDir(), "crl.pem")
+	assert.Null(t, os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0600))
+	return file
+}
+
+func TestTlsStore_Revoked(t *testing.T) {
+	a := issue(t, nil, "ca a", 7, true)
+	b := issue(t, nil, "ca b", 7, true)
+	leafA := issue(t, a, "client a", 42, false)
+	leafB := issue(t, b, "client b", 42, false)
+
+	store := &TlsStore{revoked: map[string]struct{}{}}
+	cas := []*x509.Certificate{a.cert, b.cert}
+
+	// 7 is the serial of both CAs too
+	assert.Null(t, loadCrl(writeCrl(t, a, 42, 7), cas, store.revoked))
+
+	assert.Equal(t, true, store.Revoked([]*x509.Certificate{leafA.cert, a.cert}))
+	// the same serial from another CA
+	assert.Equal(t, false, store.Revoked([]*x509.Certificate{leafB.cert, b.cert}))
+	assert.Equal(t, false, store.Revoked(nil))
+
+	// a CRL of a CA that is not configured
+	other := issue(t, nil, "ca other", 1, true)
+	assert.Equal(t, ErrCrlSignature, loadCrl(writeCrl(t, other, 42), cas, store.revoked))
+}
+
+func TestTlsStore_DenyList(t *testing.T) {
+	a := issue(t, nil, "ca a", 1, true)
+	b := issue(t, nil, "ca b", 2, true)
+	leafA := issue(t, a, "client a", 0x2a, false)
+	leafB := issue(t, b, "client b", 0x2a, false)
+
+	file := path.Join(t.TempDir(), "deny.txt")
+	assert.Null(t, os.WriteFile(file, []byte("# revoked\n00:2A # client b\n"), 0600))
+
+	store := &TlsStore{revoked: map[string]struct{}{}}
+	assert.Null(t, loadDenyList(file, []*x509.Certificate{b.cert}, store.revoked))
+
+	assert.Equal(t, true, store.Revoked([]*x509.Certificate{leafB.cert, b.cert}))
+	assert.Equal(t, false, store.Revoked([]*x509.Certificate{leafA.cert, a.cert}))
+
+	assert.Null(t, os.WriteFile(file, []byte("not hex\n"), 0600))
+	assert.Equal(t, ErrInvalidSerial, loadDenyList(file, []*x509.Certificate{b.cert}, store.revoked))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"lib"
+	"lib/codec"
+	"net"
+	"time"
+)
+
+func CopyToUdp(dst net.Conn, src io.Reader, signal chan error) {
+	buf := make([]byte, lib.MaxDatagramSize)
+
+	for {
+		n, err := lib.ReadDatagram(src, buf)
+		if err != nil {
+			if err != io.EOF {
+				signal <- err
+				return
+			}
+
+			close(signal)
+			return
+		}
+
+		if _, err := dst.Write(buf[:n]); err != nil {
+			signal <- err
+			return
+		}
+	}
+}
+
+func CopyFromUdp(dst *codec.Conn, src io.Reader, signal chan error) {
+	buf := make([]byte, lib.MaxDatagramSize)
+
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			signal <- err
+			return
+		}
+
+		if err := lib.WriteDatagram(dst, buf[:n]); err != nil {
+			signal <- err
+			return
+		}
+
+		// datagrams are latency sensitive, never hold them in the compressor
+		if err := dst.Flush(); err != nil {
+			signal <- err
+			return
+		}
+	}
+}
+
+// SpliceUdp relays datagrams of a handshake.MethodUdp request. Each datagram travels through the tunnel
+// with a 2 byte length prefix. It returns why timeouts cut the association, if they did.
+func SpliceUdp(conn *codec.Conn, addr string, dialer ContextDialer, timeouts lib.Timeouts, reply func(net.Conn, error) error, b []byte) error {
+	defer conn.Close()
+
+	dialContext, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	remote, err := dialer.DialContext(dialContext, "udp", addr)
+	cancel()
+
+	if err != nil {
+		reply(nil, err)
+		return nil
+	}
+
+	defer remote.Close()
+
+	if err := reply(remote, nil); err != nil {
+		return nil
+	}
+
+	watchdog := lib.NewWatchdog(timeouts, func(error) {
+		conn.Conn.Close()
+		remote.Close()
+	})
+
+	// buffered, so the copy still running after return does not block forever on its signal
+	upstream := make(chan error, 1)
+	downstream := make(chan error, 1)
+
+	signals := []chan error{upstream, downstream}
+
+	go CopyToUdp(remote, watchdog.Reader(io.MultiReader(bytes.NewReader(b), conn)), upstream)
+	go CopyFromUdp(conn, watchdog.Reader(remote), downstream)
+
+	// the forwarder ends the stream once done with the association, so it ends with either copy, EOF included.
+	// Closing remote and conn on return unblocks the other.
+	Select(signals)
+
+	return watchdog.Stop()
+}
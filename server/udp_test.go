@@ -0,0 +1,76 @@
+package main
+
+import (
+	"lib"
+	"lib/assert"
+	"lib/codec"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSpliceUdp_Eof(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Null(t, err)
+	defer echo.Close()
+
+	go func() {
+		buf := make([]byte, lib.MaxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Null(t, err)
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		tunnel, err := l.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+
+		conn, err := codec.Server(tunnel, []codec.ID{codec.Identity})
+		if err != nil {
+			done <- err
+			return
+		}
+
+		// no idle timeout, so only the end of the stream ends the association
+		done <- SpliceUdp(conn, echo.LocalAddr().String(), &net.Dialer{}, lib.Timeouts{}, func(net.Conn, error) error {
+			return nil
+		}, nil)
+	}()
+
+	forwarder, err := net.Dial("tcp", l.Addr().String())
+	assert.Null(t, err)
+
+	client, err := codec.Client(forwarder, []codec.ID{codec.Identity})
+	assert.Null(t, err)
+
+	assert.Null(t, lib.WriteDatagram(client, []byte("ping")))
+	assert.Null(t, client.Flush())
+
+	buf := make([]byte, lib.MaxDatagramSize)
+	n, err := lib.ReadDatagram(client, buf)
+	assert.Null(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+
+	assert.Null(t, client.CloseWrite())
+
+	select {
+	case err := <-done:
+		assert.Null(t, err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("association outlived the stream")
+	}
+
+	client.Close()
+}